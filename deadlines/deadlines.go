@@ -0,0 +1,235 @@
+/*
+Package deadlines gives the RPCs of secure_greeter_client and
+secure_greeter_server time limits, so that a hung server can't hang the
+client for ever and a slow handler can't hold a connection for ever.
+
+The client gives each call a deadline, which gRPC sends to the server.
+-methodtimeouts gives the default deadline for each method, and -timeout,
+if it's given, overrides them all:
+
+	-methodtimeouts=SayHello=10s,grpc.health.v1.Health/Check=2s
+	-timeout=3s
+
+The server limits how long each handler may run, -handlertimeout for every
+method unless -handlertimeouts gives a limit for that one.  The handler gets
+a context whose deadline is the earlier of the client's and the server's, so
+a handler that watches its context stops in time.  If the server's limit
+runs out first, the client gets DEADLINE_EXCEEDED with a message saying so.
+The server also refuses at once, with DEADLINE_EXCEEDED, a request that
+arrives with less than -mindeadline left before its deadline, since it would
+probably run out of time half way through.
+
+In the method tables a name can be a method (SayHello), a service
+(helloworld.Greeter) or both (helloworld.Greeter/SayHello).  The most
+specific one that matches wins.  The limits only apply to unary RPCs,
+because streams such as the health service's Watch may run for ever.
+*/
+package deadlines
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Options holds the command line settings from which a Policy is built.
+type Options struct {
+	Timeout     time.Duration // the client's -timeout or the server's -handlertimeout
+	Methods     string        // comma-separated name=duration pairs
+	MinDeadline time.Duration // the server's -mindeadline
+}
+
+// ClientFlags defines the client's deadline flags in fs and returns the
+// Options that they set.
+func ClientFlags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	fs.DurationVar(&o.Timeout, "timeout", 0,
+		"deadline for every RPC, overriding -methodtimeouts (0 to use -methodtimeouts)")
+	fs.StringVar(&o.Methods, "methodtimeouts", "SayHello=10s",
+		"default deadlines by method, for example SayHello=10s,grpc.health.v1.Health/Check=2s")
+	return o
+}
+
+// ServerFlags defines the server's deadline flags in fs and returns the
+// Options that they set.
+func ServerFlags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	fs.DurationVar(&o.Timeout, "handlertimeout", 30*time.Second,
+		"longest time that any RPC handler may run (0 for no limit)")
+	fs.StringVar(&o.Methods, "handlertimeouts", "",
+		"longest handler times by method, overriding -handlertimeout, for example SayHello=2s")
+	fs.DurationVar(&o.MinDeadline, "mindeadline", 0,
+		"refuse requests with less than this left before their deadline (0 to accept any)")
+	return o
+}
+
+// Policy holds the time limits.
+type Policy struct {
+	// Timeout applies to every method.  On the client it overrides
+	// Methods.  On the server Methods overrides it.  0 means no limit.
+	Timeout time.Duration
+
+	// Methods holds the limits by method, service or service/method.
+	Methods map[string]time.Duration
+
+	// MinDeadline is the least time that a request must have left before
+	// its deadline for the server to accept it.
+	MinDeadline time.Duration
+}
+
+// New builds a Policy from the options and checks it.
+func New(o *Options) (*Policy, error) {
+	if o.Timeout < 0 || o.MinDeadline < 0 {
+		return nil, errors.New("time limits can't be negative")
+	}
+	methods, err := parseMethods(o.Methods)
+	if err != nil {
+		return nil, err
+	}
+	return &Policy{Timeout: o.Timeout, Methods: methods, MinDeadline: o.MinDeadline}, nil
+}
+
+// parseMethods parses a list of name=duration pairs.
+func parseMethods(list string) (map[string]time.Duration, error) {
+	methods := make(map[string]time.Duration)
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q should be method=duration, for example SayHello=10s", pair)
+		}
+		name := strings.Trim(strings.TrimSpace(pair[:i]), "/")
+		d, err := time.ParseDuration(strings.TrimSpace(pair[i+1:]))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("the time limit for %s should be a duration such as 10s, not %q", name, pair[i+1:])
+		}
+		methods[name] = d
+	}
+	return methods, nil
+}
+
+// forMethod returns the limit in Methods for a full method name,
+// /service/method, and whether there is one.
+func (p *Policy) forMethod(fullMethod string) (time.Duration, bool) {
+	name := strings.TrimPrefix(fullMethod, "/")
+	service, method := name, name
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		service, method = name[:i], name[i+1:]
+	}
+	for _, key := range []string{name, method, service} {
+		if d, ok := p.Methods[key]; ok {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// ClientTimeout returns the deadline that the client gives an RPC, or 0 for
+// none.
+func (p *Policy) ClientTimeout(fullMethod string) time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	d, _ := p.forMethod(fullMethod)
+	return d
+}
+
+// HandlerTimeout returns the longest time that the server lets an RPC's
+// handler run, or 0 for no limit.
+func (p *Policy) HandlerTimeout(fullMethod string) time.Duration {
+	if d, ok := p.forMethod(fullMethod); ok {
+		return d
+	}
+	return p.Timeout
+}
+
+// UnaryClientInterceptor is a grpc.UnaryClientInterceptor that gives each
+// RPC its deadline.  If the caller's context already has an earlier one, that
+// one stands.
+func (p *Policy) UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+	if d := p.ClientTimeout(method); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// UnaryServerInterceptor is a grpc.UnaryServerInterceptor that refuses
+// requests with too little time left and limits how long handlers run.
+func (p *Policy) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	if deadline, ok := ctx.Deadline(); ok && p.MinDeadline > 0 {
+		if left := time.Until(deadline); left < p.MinDeadline {
+			return nil, status.Errorf(codes.DeadlineExceeded,
+				"the request had %v left before its deadline, less than the server's minimum of %v",
+				left.Round(time.Millisecond), p.MinDeadline)
+		}
+	}
+	limit := p.HandlerTimeout(info.FullMethod)
+	if limit == 0 {
+		return handler(ctx, req)
+	}
+	handlerCtx, cancel := context.WithTimeout(ctx, limit)
+	defer cancel()
+	resp, err := handler(handlerCtx, req)
+	// If the client's deadline passed first, it has given up and the error
+	// doesn't matter.
+	if handlerCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, status.Errorf(codes.DeadlineExceeded,
+			"%s took longer than the server allows (%v)", info.FullMethod, limit)
+	}
+	return resp, err
+}
+
+// ClientString describes the client's deadlines, for the log.
+func (p *Policy) ClientString() string {
+	if p.Timeout > 0 {
+		return fmt.Sprintf("deadlines: %v for every RPC", p.Timeout)
+	}
+	return "deadlines: " + p.methodList()
+}
+
+// ServerString describes the server's limits, for the log.
+func (p *Policy) ServerString() string {
+	s := "handler time limits: "
+	if p.Timeout > 0 {
+		s += fmt.Sprintf("%v unless given, ", p.Timeout)
+	}
+	s += p.methodList()
+	if p.MinDeadline > 0 {
+		s += fmt.Sprintf("; requests need at least %v left before their deadline", p.MinDeadline)
+	}
+	return s
+}
+
+// methodList describes the limits by method.
+func (p *Policy) methodList() string {
+	if len(p.Methods) == 0 {
+		return "none by method"
+	}
+	var names []string
+	for name := range p.Methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s %v", name, p.Methods[name]))
+	}
+	return strings.Join(parts, ", ")
+}
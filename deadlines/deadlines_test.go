@@ -0,0 +1,153 @@
+package deadlines
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const sayHello = "/helloworld.Greeter/SayHello"
+
+func TestParse(t *testing.T) {
+	p, err := New(&Options{Methods: "SayHello=10s, grpc.health.v1.Health=2s,/helloworld.Greeter/Other=1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		method string
+		want   time.Duration
+	}{
+		{sayHello, 10 * time.Second},
+		{"/grpc.health.v1.Health/Check", 2 * time.Second},
+		{"/helloworld.Greeter/Other", time.Minute},
+		{"/admin.Admin/Reload", 0},
+	}
+	for _, test := range tests {
+		if got := p.ClientTimeout(test.method); got != test.want {
+			t.Errorf("%s: want %v, got %v", test.method, test.want, got)
+		}
+	}
+
+	// The most specific name wins.
+	p, err = New(&Options{Methods: "helloworld.Greeter=1s,SayHello=2s,helloworld.Greeter/SayHello=3s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.ClientTimeout(sayHello); got != 3*time.Second {
+		t.Errorf("want 3s, got %v", got)
+	}
+
+	for _, bad := range []string{"SayHello", "=1s", "SayHello=soon", "SayHello=0s", "SayHello=-1s"} {
+		if _, err := New(&Options{Methods: bad}); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+	if _, err := New(&Options{Timeout: -time.Second}); err == nil {
+		t.Error("expected an error for a negative timeout")
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	p, err := New(&Options{Timeout: 5 * time.Second, Methods: "SayHello=1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// On the client -timeout overrides the table.
+	if got := p.ClientTimeout(sayHello); got != 5*time.Second {
+		t.Errorf("client: want 5s, got %v", got)
+	}
+	// On the server the table overrides -handlertimeout.
+	if got := p.HandlerTimeout(sayHello); got != time.Second {
+		t.Errorf("server: want 1s, got %v", got)
+	}
+	if got := p.HandlerTimeout("/grpc.health.v1.Health/Check"); got != 5*time.Second {
+		t.Errorf("server: want 5s for other methods, got %v", got)
+	}
+}
+
+func TestClientInterceptor(t *testing.T) {
+	p, err := New(&Options{Methods: "SayHello=1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left time.Duration
+	var hasDeadline bool
+	invoker := func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+
+		var deadline time.Time
+		deadline, hasDeadline = ctx.Deadline()
+		left = time.Until(deadline)
+		return nil
+	}
+
+	p.UnaryClientInterceptor(context.Background(), sayHello, nil, nil, nil, invoker)
+	if !hasDeadline || left > time.Second || left < 900*time.Millisecond {
+		t.Errorf("want a deadline about 1s away, got %v %v", hasDeadline, left)
+	}
+
+	// An earlier deadline from the caller stands.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	p.UnaryClientInterceptor(ctx, sayHello, nil, nil, nil, invoker)
+	if left > 100*time.Millisecond {
+		t.Errorf("want the caller's deadline, got %v", left)
+	}
+
+	p.UnaryClientInterceptor(context.Background(), "/admin.Admin/Reload", nil, nil, nil, invoker)
+	if hasDeadline {
+		t.Error("want no deadline for a method without one")
+	}
+}
+
+func TestServerInterceptor(t *testing.T) {
+	p, err := New(&Options{Timeout: time.Minute, Methods: "SayHello=100ms", MinDeadline: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: sayHello}
+	// slow waits for its context, like a handler that watches it.
+	slow := func(ctx context.Context, req interface{}) (interface{}, error) {
+		select {
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-time.After(5 * time.Second):
+			return "done", nil
+		}
+	}
+	fast := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "done", nil
+	}
+
+	// The server's limit runs out.
+	began := time.Now()
+	_, err = p.UnaryServerInterceptor(context.Background(), nil, info, slow)
+	if status.Code(err) != codes.DeadlineExceeded || time.Since(began) > time.Second {
+		t.Errorf("want DeadlineExceeded after 100ms, got %v after %v", err, time.Since(began))
+	}
+
+	// Too little time left.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	called := false
+	_, err = p.UnaryServerInterceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	if status.Code(err) != codes.DeadlineExceeded || called {
+		t.Errorf("want the request refused with DeadlineExceeded, got %v (handler called %v)", err, called)
+	}
+
+	// Enough time left, or no deadline at all.
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, ctx := range []context.Context{ctx, context.Background()} {
+		if resp, err := p.UnaryServerInterceptor(ctx, nil, info, fast); err != nil || resp != "done" {
+			t.Errorf("want done, got %v %v", resp, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package keepalivepolicy
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/stats"
+)
+
+// Disconnects.  gRPC tells the server's stats handler (connLogger) when each
+// connection ends, but not why.  connLogger compares the connection's age
+// and idle time with the policy, and if the policy would have closed it just
+// then, it logs the connection at level INFO with the likely cause:
+//
+//   - max_connection_idle - the connection had no RPCs for
+//     -maxconnectionidle, or
+//   - max_connection_age - the connection had been open for
+//     -maxconnectionage.
+//
+// It's only likely - the client may have hung up at that moment.  Other
+// connections are logged at level DEBUG.
+//
+// Keepalive failures - pings that weren't answered and clients that ping too
+// often - are reported by gRPC's own logger, at its own levels.  Set
+// GRPC_GO_LOG_SEVERITY_LEVEL=info and GRPC_GO_LOG_VERBOSITY_LEVEL=2 to see
+// them.
+
+// connLogger is a stats.Handler that logs the connections that the server
+// closes because of -maxconnectionidle and -maxconnectionage.
+type connLogger struct {
+	policy *Policy
+}
+
+// conn is the history of a connection.
+type conn struct {
+	remote string
+	began  time.Time
+
+	mu         sync.Mutex
+	active     int       // RPCs running
+	lastActive time.Time // when the last RPC finished
+}
+
+type connKey struct{}
+
+func (l *connLogger) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	now := time.Now()
+	c := &conn{began: now, lastActive: now}
+	if info.RemoteAddr != nil {
+		c.remote = info.RemoteAddr.String()
+	}
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+func (l *connLogger) HandleConn(ctx context.Context, s stats.ConnStats) {
+	c, ok := ctx.Value(connKey{}).(*conn)
+	if !ok {
+		return
+	}
+	if _, ok := s.(*stats.ConnEnd); !ok {
+		return
+	}
+	age := time.Since(c.began)
+	c.mu.Lock()
+	active := c.active
+	idle := time.Since(c.lastActive)
+	c.mu.Unlock()
+	if likely := l.likelyCause(age, idle, active); len(likely) > 0 {
+		slog.Info("connection closed", "likely", likely, "remote", c.remote,
+			"age", age.Round(time.Millisecond), "idle", idle.Round(time.Millisecond), "rpcs", active)
+		return
+	}
+	slog.Debug("connection closed", "remote", c.remote, "age", age.Round(time.Millisecond),
+		"idle", idle.Round(time.Millisecond), "rpcs", active)
+}
+
+// likelyCause guesses why a connection closed, given how long it was open,
+// how long it had been idle and how many RPCs were still running.  It returns
+// "" if it can't have been the server's policy that closed it.  It's only a
+// guess - the client may have closed the connection just then.
+func (l *connLogger) likelyCause(age, idle time.Duration, active int) string {
+	// gRPC moves the maximum age by up to 10% either way, so that
+	// connections made at the same time don't all close at the same time.
+	maxAge := l.policy.MaxConnectionAge
+	if maxAge > 0 && age >= maxAge-maxAge/10 {
+		return "max_connection_age"
+	}
+	maxIdle := l.policy.MaxConnectionIdle
+	if maxIdle > 0 && active == 0 && idle >= maxIdle {
+		return "max_connection_idle"
+	}
+	return ""
+}
+
+func (l *connLogger) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (l *connLogger) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	c, ok := ctx.Value(connKey{}).(*conn)
+	if !ok {
+		return
+	}
+	switch s.(type) {
+	case *stats.Begin:
+		c.mu.Lock()
+		c.active++
+		c.mu.Unlock()
+	case *stats.End:
+		c.mu.Lock()
+		c.active--
+		c.lastActive = time.Now()
+		c.mu.Unlock()
+	}
+}
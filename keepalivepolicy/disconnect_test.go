@@ -0,0 +1,120 @@
+package keepalivepolicy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// lockedBuffer is a bytes.Buffer that gRPC's goroutines can log to while the
+// test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns the JSON log records written so far and empties the buffer.
+func (b *lockedBuffer) records(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		var r map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("%v in %s", err, line)
+		}
+		records = append(records, r)
+	}
+	b.buf.Reset()
+	return records
+}
+
+// logTo sends the default slog logger to a buffer until the test ends.
+func logTo(t *testing.T) *lockedBuffer {
+	b := &lockedBuffer{}
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(b, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return b
+}
+
+func TestLikelyCause(t *testing.T) {
+	l := &connLogger{policy: &Policy{MaxConnectionIdle: time.Minute, MaxConnectionAge: time.Hour}}
+	var tests = []struct {
+		age, idle time.Duration
+		active    int
+		want      string
+	}{
+		{55 * time.Minute, 0, 1, "max_connection_age"},
+		{50 * time.Minute, 0, 1, ""},
+		{10 * time.Minute, 2 * time.Minute, 0, "max_connection_idle"},
+		{10 * time.Minute, 2 * time.Minute, 1, ""},
+		{10 * time.Minute, 30 * time.Second, 0, ""},
+	}
+	for _, test := range tests {
+		if got := l.likelyCause(test.age, test.idle, test.active); got != test.want {
+			t.Errorf("age %v idle %v active %d: want %q, got %q", test.age, test.idle, test.active, test.want, got)
+		}
+	}
+}
+
+// TestMaxConnectionIdle runs a server that closes idle connections quickly
+// and checks that the log gives the likely cause when the connection closes.
+func TestMaxConnectionIdle(t *testing.T) {
+	logged := logTo(t)
+	p, err := New(&Options{MaxConnectionIdle: "200ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(p.ServerOptions()...)
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []map[string]interface{}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		for _, r := range logged.records(t) {
+			seen = append(seen, r)
+			if r["msg"] == "connection closed" && r["likely"] == "max_connection_idle" {
+				if r["level"] != "INFO" {
+					t.Errorf("want level INFO, got %v", r["level"])
+				}
+				return
+			}
+		}
+	}
+	t.Errorf("the idle connection's close wasn't logged, got %v", seen)
+}
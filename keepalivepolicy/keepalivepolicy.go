@@ -0,0 +1,350 @@
+/*
+Package keepalivepolicy controls how secure_greeter_client and
+secure_greeter_server keep their connections alive and how long the server
+lets a connection live.
+
+A connection that carries no traffic can be dropped without warning by a NAT
+router or a firewall along the way, and a connection to a machine that has
+crashed or lost its network stays open for a long time before TCP notices.
+Both ends can send HTTP/2 pings to keep the connection busy and to find out
+whether the other end is still there.  The server also limits how often a
+client may ping it, and can close connections that have been idle or open
+for too long so that the clients reconnect.
+
+Rather than setting each of those separately, you can choose a named profile:
+
+	default    gRPC's own defaults.  The server pings after two hours without
+	           traffic, the client never pings and connections last for ever.
+	lan        A fast, reliable network.  Both ends ping every few seconds when
+	           idle, so a dead peer is found within a minute.
+	flaky-wan  A link through NAT routers or a home broadband connection.  The
+	           client pings every 30 seconds, even between RPCs, which keeps
+	           the NAT mapping alive, and waits patiently for the answer.  The
+	           server replaces each connection after half an hour.
+	mobile     Clients on phone networks.  The client only pings while an RPC
+	           is running, so that an idle phone's radio can sleep, and the
+	           server closes connections that have been idle for five minutes,
+	           since a phone that has moved to another network never closes
+	           its old connection.
+
+The client and the server should use the same profile.  A client that pings
+more often than the server allows is told to go away ("too_many_pings") and
+pings half as often after that.
+
+Individual settings can then be overridden.  The result is checked at startup
+so that a mistake is reported straight away rather than as a stream of
+disconnects later.  A duration of 0 turns off the client's pings and the
+server's limits on connection idle time and age.
+*/
+package keepalivepolicy
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// Policy is a set of keepalive and connection lifetime settings.
+type Policy struct {
+	// Profile is the name of the profile that the policy started from.
+	Profile string
+
+	// Time is how long the server waits without traffic on a connection
+	// before it pings the client, and Timeout is how long it waits for the
+	// answer before it closes the connection.
+	Time    time.Duration
+	Timeout time.Duration
+
+	// MinClientTime is the shortest time between client pings that the
+	// server allows.  If PermitWithoutStream is false, the server also
+	// objects to pings when no RPC is running, and the client doesn't send
+	// them.
+	MinClientTime       time.Duration
+	PermitWithoutStream bool
+
+	// MaxConnectionIdle is how long the server lets a connection go without
+	// any RPCs before closing it, MaxConnectionAge is how long it lets any
+	// connection live, and MaxConnectionAgeGrace is how long RPCs still
+	// running at that age are given to finish.  0 means no limit.
+	MaxConnectionIdle     time.Duration
+	MaxConnectionAge      time.Duration
+	MaxConnectionAgeGrace time.Duration
+
+	// ClientTime is how long the client waits without traffic before it
+	// pings the server, and ClientTimeout is how long it waits for the
+	// answer.  A ClientTime of 0 means that the client doesn't ping.
+	ClientTime    time.Duration
+	ClientTimeout time.Duration
+}
+
+// Options holds the command line settings from which a Policy is built.  An
+// empty field means "use the profile's setting".
+type Options struct {
+	Profile               string
+	Time                  string
+	Timeout               string
+	MinClientTime         string
+	WithoutStream         string // "on" or "off"
+	MaxConnectionIdle     string
+	MaxConnectionAge      string
+	MaxConnectionAgeGrace string
+	ClientTime            string
+	ClientTimeout         string
+}
+
+// DefaultProfile is the profile used if none is given.
+const DefaultProfile = "default"
+
+// minClientTime is the shortest client ping interval that gRPC allows.  It
+// quietly uses this instead of anything shorter.
+const minClientTime = 10 * time.Second
+
+// profiles are the named starting points.
+var profiles = map[string]Policy{
+	"default": {
+		Time:          2 * time.Hour,
+		Timeout:       20 * time.Second,
+		MinClientTime: 5 * time.Minute,
+		ClientTimeout: 20 * time.Second,
+	},
+	"lan": {
+		Time:                30 * time.Second,
+		Timeout:             5 * time.Second,
+		MinClientTime:       5 * time.Second,
+		PermitWithoutStream: true,
+		ClientTime:          10 * time.Second,
+		ClientTimeout:       5 * time.Second,
+	},
+	"flaky-wan": {
+		Time:                  time.Minute,
+		Timeout:               20 * time.Second,
+		MinClientTime:         20 * time.Second,
+		PermitWithoutStream:   true,
+		MaxConnectionAge:      30 * time.Minute,
+		MaxConnectionAgeGrace: time.Minute,
+		ClientTime:            30 * time.Second,
+		ClientTimeout:         20 * time.Second,
+	},
+	"mobile": {
+		Time:              5 * time.Minute,
+		Timeout:           20 * time.Second,
+		MinClientTime:     time.Minute,
+		MaxConnectionIdle: 5 * time.Minute,
+		ClientTime:        2 * time.Minute,
+		ClientTimeout:     20 * time.Second,
+	},
+}
+
+// Profiles returns the names of the profiles.
+func Profiles() []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profileFlag defines -keepaliveprofile, which both programs have.
+func profileFlag(fs *flag.FlagSet, o *Options) {
+	fs.StringVar(&o.Profile, "keepaliveprofile", DefaultProfile,
+		"keepalive profile - "+strings.Join(Profiles(), ", "))
+	fs.StringVar(&o.WithoutStream, "keepalivewithoutstream", "",
+		"keepalive pings when no RPC is running, on or off (default: from the profile)")
+}
+
+// ServerFlags defines the server's keepalive command line flags in fs and
+// returns the Options that they set.
+func ServerFlags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	profileFlag(fs, o)
+	fs.StringVar(&o.Time, "keepalivetime", "",
+		"ping a client after this long without traffic (default: from the profile)")
+	fs.StringVar(&o.Timeout, "keepalivetimeout", "",
+		"close the connection if a ping isn't answered within this time (default: from the profile)")
+	fs.StringVar(&o.MinClientTime, "keepaliveminclienttime", "",
+		"shortest time allowed between a client's pings (default: from the profile)")
+	fs.StringVar(&o.MaxConnectionIdle, "maxconnectionidle", "",
+		"close a connection that has had no RPCs for this long, 0 for never (default: from the profile)")
+	fs.StringVar(&o.MaxConnectionAge, "maxconnectionage", "",
+		"close a connection that has been open this long, 0 for never (default: from the profile)")
+	fs.StringVar(&o.MaxConnectionAgeGrace, "maxconnectionagegrace", "",
+		"time given to RPCs still running when -maxconnectionage passes (default: from the profile)")
+	return o
+}
+
+// ClientFlags defines the client's keepalive command line flags in fs and
+// returns the Options that they set.
+func ClientFlags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	profileFlag(fs, o)
+	fs.StringVar(&o.ClientTime, "keepalivetime", "",
+		"ping the server after this long without traffic, 0 for never (default: from the profile)")
+	fs.StringVar(&o.ClientTimeout, "keepalivetimeout", "",
+		"close the connection if a ping isn't answered within this time (default: from the profile)")
+	return o
+}
+
+// New builds a Policy from the options and checks it.
+func New(o *Options) (*Policy, error) {
+	name := o.Profile
+	if len(name) == 0 {
+		name = DefaultProfile
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown keepalive profile %q - use one of %s",
+			name, strings.Join(Profiles(), ", "))
+	}
+	p := profile
+	p.Profile = name
+
+	durations := []struct {
+		flag  string
+		value string
+		field *time.Duration
+	}{
+		{"keepalivetime", o.Time, &p.Time},
+		{"keepalivetimeout", o.Timeout, &p.Timeout},
+		{"keepaliveminclienttime", o.MinClientTime, &p.MinClientTime},
+		{"maxconnectionidle", o.MaxConnectionIdle, &p.MaxConnectionIdle},
+		{"maxconnectionage", o.MaxConnectionAge, &p.MaxConnectionAge},
+		{"maxconnectionagegrace", o.MaxConnectionAgeGrace, &p.MaxConnectionAgeGrace},
+		{"keepalivetime", o.ClientTime, &p.ClientTime},
+		{"keepalivetimeout", o.ClientTimeout, &p.ClientTimeout},
+	}
+	for _, d := range durations {
+		if len(d.value) == 0 {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("-%s: %q is not a duration such as 30s or 5m", d.flag, d.value)
+		}
+		if v < 0 {
+			return nil, fmt.Errorf("-%s can't be negative", d.flag)
+		}
+		*d.field = v
+	}
+	// A profile's grace goes with its maximum age.  Only a grace that was
+	// given without an age is a mistake.
+	if p.MaxConnectionAge == 0 && len(o.MaxConnectionAgeGrace) == 0 {
+		p.MaxConnectionAgeGrace = 0
+	}
+	switch strings.ToLower(o.WithoutStream) {
+	case "":
+	case "on":
+		p.PermitWithoutStream = true
+	case "off":
+		p.PermitWithoutStream = false
+	default:
+		return nil, fmt.Errorf("-keepalivewithoutstream must be on or off, not %q", o.WithoutStream)
+	}
+
+	if err := p.Check(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Check returns an error if the policy can't work.
+func (p *Policy) Check() error {
+	if p.Time < time.Second {
+		// gRPC won't ping more often than once a second.
+		return errors.New("the server's keepalive time must be at least 1s")
+	}
+	if p.Timeout <= 0 || p.ClientTimeout <= 0 {
+		return errors.New("the keepalive timeout must be more than 0")
+	}
+	if p.MaxConnectionAgeGrace > 0 && p.MaxConnectionAge == 0 {
+		return errors.New("-maxconnectionagegrace needs -maxconnectionage")
+	}
+	if p.ClientTime == 0 {
+		return nil
+	}
+	if p.ClientTime < minClientTime {
+		return fmt.Errorf("the client's keepalive time must be at least %v - gRPC won't ping more often", minClientTime)
+	}
+	if p.ClientTime < p.MinClientTime {
+		return fmt.Errorf("the client pings every %v but a server with the %s profile only allows a ping every %v",
+			p.ClientTime, p.Profile, p.MinClientTime)
+	}
+	return nil
+}
+
+// ServerOptions returns the gRPC server options that apply the policy.
+// They include a stats handler that logs the connections that the server
+// has likely closed because of their idle time or age.
+func (p *Policy) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			MaxConnectionIdle:     p.MaxConnectionIdle,
+			MaxConnectionAge:      p.MaxConnectionAge,
+			MaxConnectionAgeGrace: p.MaxConnectionAgeGrace,
+			Time:                  p.Time,
+			Timeout:               p.Timeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             p.MinClientTime,
+			PermitWithoutStream: p.PermitWithoutStream,
+		}),
+		grpc.StatsHandler(&connLogger{policy: p}),
+	}
+}
+
+// DialOptions returns the gRPC dial options that apply the policy.
+func (p *Policy) DialOptions() []grpc.DialOption {
+	if p.ClientTime == 0 {
+		return nil
+	}
+	return []grpc.DialOption{grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                p.ClientTime,
+		Timeout:             p.ClientTimeout,
+		PermitWithoutStream: p.PermitWithoutStream,
+	})}
+}
+
+// ServerString describes the server's settings, for the log.
+func (p *Policy) ServerString() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "keepalive profile %s: ping clients after %v idle, timeout %v, clients may ping every %v",
+		p.Profile, p.Time, p.Timeout, p.MinClientTime)
+	if p.PermitWithoutStream {
+		b.WriteString(" even without RPCs")
+	} else {
+		b.WriteString(" during RPCs")
+	}
+	fmt.Fprintf(&b, ", max connection idle %s, max connection age %s",
+		limit(p.MaxConnectionIdle), limit(p.MaxConnectionAge))
+	if p.MaxConnectionAge > 0 {
+		fmt.Fprintf(&b, " (grace %v)", p.MaxConnectionAgeGrace)
+	}
+	return b.String()
+}
+
+// ClientString describes the client's settings, for the log.
+func (p *Policy) ClientString() string {
+	if p.ClientTime == 0 {
+		return fmt.Sprintf("keepalive profile %s: no pings", p.Profile)
+	}
+	s := fmt.Sprintf("keepalive profile %s: ping the server after %v idle, timeout %v",
+		p.Profile, p.ClientTime, p.ClientTimeout)
+	if p.PermitWithoutStream {
+		return s + ", even without RPCs"
+	}
+	return s + ", during RPCs only"
+}
+
+// limit describes a duration where 0 means no limit.
+func limit(d time.Duration) string {
+	if d == 0 {
+		return "none"
+	}
+	return d.String()
+}
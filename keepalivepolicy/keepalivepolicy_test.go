@@ -0,0 +1,103 @@
+package keepalivepolicy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProfiles(t *testing.T) {
+	for _, name := range Profiles() {
+		p, err := New(&Options{Profile: name})
+		if err != nil {
+			t.Errorf("profile %s: %v", name, err)
+			continue
+		}
+		if p.Profile != name {
+			t.Errorf("profile %s: got profile %s", name, p.Profile)
+		}
+		if len(p.ServerOptions()) == 0 {
+			t.Errorf("profile %s: no server options", name)
+		}
+	}
+
+	if _, err := New(&Options{Profile: "bogus"}); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+
+	// The default profile leaves the client's pings off.
+	p, err := New(&Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Profile != DefaultProfile || len(p.DialOptions()) != 0 {
+		t.Errorf("expected the default profile without client pings, got %s", p.ClientString())
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	p, err := New(&Options{
+		Profile:               "flaky-wan",
+		Time:                  "90s",
+		MaxConnectionIdle:     "10m",
+		MaxConnectionAge:      "0",
+		MaxConnectionAgeGrace: "0",
+		ClientTime:            "1m",
+		WithoutStream:         "off",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Time != 90*time.Second {
+		t.Errorf("expected keepalive time 90s, got %v", p.Time)
+	}
+	if p.MaxConnectionIdle != 10*time.Minute || p.MaxConnectionAge != 0 {
+		t.Errorf("expected max idle 10m and no max age, got %v and %v", p.MaxConnectionIdle, p.MaxConnectionAge)
+	}
+	if p.ClientTime != time.Minute || p.PermitWithoutStream {
+		t.Errorf("expected client pings every 1m during RPCs, got %s", p.ClientString())
+	}
+	if p.Timeout != 20*time.Second {
+		t.Errorf("expected the profile's timeout, got %v", p.Timeout)
+	}
+	if len(p.DialOptions()) != 1 {
+		t.Errorf("expected a keepalive dial option")
+	}
+
+	// Turning off the profile's maximum age turns off its grace too.
+	p, err = New(&Options{Profile: "flaky-wan", MaxConnectionAge: "0"})
+	if err != nil {
+		t.Fatalf("flaky-wan without a maximum age: %v", err)
+	}
+	if p.MaxConnectionAgeGrace != 0 {
+		t.Errorf("expected no grace without a maximum age, got %v", p.MaxConnectionAgeGrace)
+	}
+
+	// The override mustn't change the profile.
+	p, err = New(&Options{Profile: "flaky-wan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxConnectionAge != 30*time.Minute || !p.PermitWithoutStream {
+		t.Errorf("the flaky-wan profile was changed by an override")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	bad := []Options{
+		{Time: "500ms"},
+		{Time: "soon"},
+		{Timeout: "0"},
+		{MaxConnectionIdle: "-1m"},
+		{MaxConnectionAge: "0", MaxConnectionAgeGrace: "1m"},
+		{Profile: "flaky-wan", MaxConnectionAge: "0", MaxConnectionAgeGrace: "1m"},
+		{ClientTime: "5s"},
+		{ClientTime: "1m"}, // the default profile's server allows one every 5m
+		{Profile: "lan", ClientTimeout: "0"},
+		{WithoutStream: "maybe"},
+	}
+	for _, o := range bad {
+		if _, err := New(&o); err == nil {
+			t.Errorf("expected an error for %+v", o)
+		}
+	}
+}
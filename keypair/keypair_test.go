@@ -0,0 +1,225 @@
+package keypair
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// newCert creates a self-signed certificate and its key.
+func newCert(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func certPEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func TestLoadEncryptedPKCS8(t *testing.T) {
+	cert, key := newCert(t)
+	der, err := pkcs8.MarshalPrivateKey(key, []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certfile := writeFile(t, "server.crt", certPEM(cert))
+	keyfile := writeFile(t, "server.key", pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}))
+
+	t.Setenv("TEST_KEY_PASS", "secret")
+	loaded, err := Load(certfile, keyfile, &Passphrase{Env: "TEST_KEY_PASS"})
+	if err != nil {
+		t.Fatalf("with the right passphrase: %v", err)
+	}
+	if loaded.Leaf == nil || !loaded.Leaf.Equal(cert) {
+		t.Error("the wrong certificate was loaded")
+	}
+
+	passfile := writeFile(t, "pass", []byte("secret\n"))
+	if _, err := Load(certfile, keyfile, &Passphrase{File: passfile}); err != nil {
+		t.Errorf("with the passphrase in a file: %v", err)
+	}
+
+	t.Setenv("TEST_KEY_PASS", "wrong")
+	_, err = Load(certfile, keyfile, &Passphrase{Env: "TEST_KEY_PASS"})
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("with the wrong passphrase: want ErrWrongPassphrase, got %v", err)
+	}
+
+	if _, err := Load(certfile, keyfile, nil); err == nil {
+		t.Error("with no passphrase: want an error")
+	}
+}
+
+// TestPKCS8WrongPassword pins isPKCS8WrongPassword to the message that the
+// version of the pkcs8 package in go.mod gives for a wrong password, which
+// has no sentinel error to compare with.  If an upgrade rewords it, this
+// fails, rather than a wrong passphrase being reported as an unsupported
+// key.
+func TestPKCS8WrongPassword(t *testing.T) {
+	_, key := newCert(t)
+	der, err := pkcs8.MarshalPrivateKey(key, []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pkcs8.ParsePKCS8PrivateKey(der, []byte("secret")); err != nil {
+		t.Fatalf("with the right password: %v", err)
+	}
+	_, err = pkcs8.ParsePKCS8PrivateKey(der, []byte("wrong"))
+	if err == nil || !isPKCS8WrongPassword(err) {
+		t.Errorf("the pkcs8 package's wrong password error isn't recognised: %v", err)
+	}
+
+	// A key that can't be read isn't taken for a wrong password.
+	_, err = pkcs8.ParsePKCS8PrivateKey(der[:len(der)/2], []byte("secret"))
+	if err == nil || isPKCS8WrongPassword(err) {
+		t.Errorf("a truncated key was taken for a wrong password: %v", err)
+	}
+}
+
+func TestLoadLegacyEncrypted(t *testing.T) {
+	cert, _ := newCert(t)
+	certfile := writeFile(t, "server.crt", certPEM(cert))
+	keyfile := writeFile(t, "server.key", pem.EncodeToMemory(&pem.Block{
+		Type:    "EC PRIVATE KEY",
+		Headers: map[string]string{"Proc-Type": "4,ENCRYPTED", "DEK-Info": "AES-256-CBC,00000000000000000000000000000000"},
+		Bytes:   make([]byte, 128),
+	}))
+
+	_, err := Load(certfile, keyfile, &Passphrase{Env: "TEST_KEY_PASS"})
+	var unsupported *UnsupportedError
+	if !errors.As(err, &unsupported) {
+		t.Errorf("want an UnsupportedError, got %v", err)
+	}
+}
+
+func TestLoadPKCS12(t *testing.T) {
+	cert, key := newCert(t)
+	data, err := pkcs12.Modern.Encode(key, cert, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := writeFile(t, "server.p12", data)
+
+	t.Setenv("TEST_KEY_PASS", "secret")
+	loaded, err := Load(bundle, "", &Passphrase{Env: "TEST_KEY_PASS"})
+	if err != nil {
+		t.Fatalf("with the right passphrase: %v", err)
+	}
+	if !loaded.Leaf.Equal(cert) {
+		t.Error("the wrong certificate was loaded")
+	}
+
+	t.Setenv("TEST_KEY_PASS", "wrong")
+	_, err = Load(bundle, "", &Passphrase{Env: "TEST_KEY_PASS"})
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("with the wrong passphrase: want ErrWrongPassphrase, got %v", err)
+	}
+
+	_, err = Load(bundle, "", nil)
+	if err == nil || errors.Is(err, ErrWrongPassphrase) || !strings.Contains(err.Error(), "passenv") {
+		t.Errorf("with no passphrase: want an error saying how to give one, got %v", err)
+	}
+
+	// A bundle exported without a password opens with no passphrase source,
+	// but a passphrase that's given is used as it is.
+	data, err = pkcs12.Modern.Encode(key, cert, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := writeFile(t, "open.p12", data)
+	if _, err := Load(open, "", nil); err != nil {
+		t.Errorf("without a password: %v", err)
+	}
+	_, err = Load(open, "", &Passphrase{Env: "TEST_KEY_PASS"})
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("without a password but given one: want ErrWrongPassphrase, got %v", err)
+	}
+
+	_, err = Load(writeFile(t, "junk.p12", []byte("not a bundle")), "", nil)
+	var unsupported *UnsupportedError
+	if !errors.As(err, &unsupported) {
+		t.Errorf("with a broken bundle: want an UnsupportedError, got %v", err)
+	}
+}
+
+func TestPassphraseCheck(t *testing.T) {
+	if err := (&Passphrase{File: "a", Env: "B"}).Check(); err == nil {
+		t.Error("two sources: want an error")
+	}
+	if err := (&Passphrase{Prompt: true}).Check(); err != nil {
+		t.Errorf("one source: %v", err)
+	}
+}
+
+func TestReadCertificates(t *testing.T) {
+	cert, key := newCert(t)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	// A bundle with a key in it as well.
+	bundle := append(append(certPEM(cert), keyPEM...), certPEM(cert)...)
+	certs, err := ReadCertificates(writeFile(t, "bundle.pem", bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 {
+		t.Errorf("want 2 certificates, got %d", len(certs))
+	}
+
+	var tests = []struct {
+		data []byte
+		want string
+	}{
+		{[]byte("not PEM at all"), "contains no PEM data"},
+		{keyPEM, "a EC PRIVATE KEY block, which is not a certificate"},
+		{pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("junk")}), "can't be parsed"},
+	}
+	for _, test := range tests {
+		_, err := ReadCertificates(writeFile(t, "bad.pem", test.data))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("want an error saying %q, got %v", test.want, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Package logging sets up structured logging (log/slog) for
+secure_greeter_client and secure_greeter_server.  The log can be written as
+text, one line of key=value pairs per record, or as JSON, one object per line,
+which is easier for log collectors:
+
+	-logformat=text   time=... level=INFO msg="rpc" request_id=... method=...
+	-logformat=json   {"time":"...","level":"INFO","msg":"rpc","request_id":...}
+
+-loglevel chooses the least important level that's logged - debug, info, warn
+or error.  -v is the same as -loglevel=debug.
+
+The standard log package is redirected to the same place, so anything that
+still uses log.Printf is logged at level INFO.
+
+Credentials must never be logged.  As a safety net, the value of any
+attribute whose name suggests a credential - authorization, token, password,
+passphrase, secret or cookie - is replaced by "<redacted>".
+*/
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Options holds the logging settings.
+type Options struct {
+	Level   string // debug, info, warn or error
+	Format  string // text or json
+	Verbose bool   // the same as Level "debug"
+}
+
+// Flags defines the logging flags in fs and returns the Options that they
+// set.
+func Flags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	fs.StringVar(&o.Level, "loglevel", "info", "least important messages to log - debug, info, warn or error")
+	fs.StringVar(&o.Format, "logformat", "text", "log format - text or json")
+	fs.BoolVar(&o.Verbose, "v", false, "verbose mode, the same as -loglevel=debug")
+	return o
+}
+
+// ParseLevel parses a level name.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q - use debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// LevelOf returns the level that the options choose.
+func (o *Options) LevelOf() (slog.Level, error) {
+	level, err := ParseLevel(o.Level)
+	if err != nil {
+		return 0, err
+	}
+	if o.Verbose && level > slog.LevelDebug {
+		level = slog.LevelDebug
+	}
+	return level, nil
+}
+
+// Setup makes the default slog logger, and the standard log package, write
+// to w as the options say.  It returns the level, which can be changed while
+// the program runs.
+func Setup(o *Options, w io.Writer) (*slog.LevelVar, error) {
+	level := new(slog.LevelVar)
+	l, err := o.LevelOf()
+	if err != nil {
+		return nil, err
+	}
+	level.Set(l)
+
+	handlerOptions := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	var handler slog.Handler
+	switch o.Format {
+	case "text":
+		handler = slog.NewTextHandler(w, handlerOptions)
+	case "json":
+		handler = slog.NewJSONHandler(w, handlerOptions)
+	default:
+		return nil, fmt.Errorf("unknown log format %q - use text or json", o.Format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return level, nil
+}
+
+// sensitive holds the parts of attribute names that suggest a credential.
+var sensitive = []string{"authorization", "token", "password", "passphrase", "secret", "cookie"}
+
+// redact hides the values of attributes that look like credentials.  It's a
+// slog.HandlerOptions.ReplaceAttr function.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, s := range sensitive {
+		if strings.Contains(key, s) {
+			return slog.String(a.Key, "<redacted>")
+		}
+	}
+	return a
+}
+
+// Fatalf logs a message at level ERROR and exits, like log.Fatalf.
+func Fatalf(format string, args ...interface{}) {
+	slog.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
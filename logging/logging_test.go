@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLevel(t *testing.T) {
+	var tests = []struct {
+		args []string
+		want slog.Level
+	}{
+		{nil, slog.LevelInfo},
+		{[]string{"-loglevel", "warn"}, slog.LevelWarn},
+		{[]string{"-v"}, slog.LevelDebug},
+		{[]string{"-v", "-loglevel", "error"}, slog.LevelDebug},
+	}
+	for _, test := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		o := Flags(fs)
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		level, err := o.LevelOf()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level != test.want {
+			t.Errorf("%v: want %v, got %v", test.args, test.want, level)
+		}
+	}
+
+	o := &Options{Level: "loud", Format: "text"}
+	if _, err := o.LevelOf(); err == nil || !strings.Contains(err.Error(), "loud") {
+		t.Errorf("want an error about level loud, got %v", err)
+	}
+	o = &Options{Level: "info", Format: "xml"}
+	if _, err := Setup(o, &bytes.Buffer{}); err == nil {
+		t.Error("want an error about format xml")
+	}
+}
+
+// TestRedact checks that the JSON log hides credentials.
+func TestRedact(t *testing.T) {
+	var logged bytes.Buffer
+	old := slog.Default()
+	level, err := Setup(&Options{Level: "info", Format: "json"}, &logged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		slog.SetDefault(old)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	slog.Debug("not logged")
+	slog.Info("login", "user", "alice", "authorization", "Bearer abc", "refresh_token", "def")
+	var record map[string]interface{}
+	if err := json.Unmarshal(logged.Bytes(), &record); err != nil {
+		t.Fatalf("%v in %q", err, logged.String())
+	}
+	want := map[string]interface{}{
+		"msg":           "login",
+		"user":          "alice",
+		"authorization": "<redacted>",
+		"refresh_token": "<redacted>",
+	}
+	for k, v := range want {
+		if record[k] != v {
+			t.Errorf("%s: want %v, got %v", k, v, record[k])
+		}
+	}
+
+	// The level can be changed afterwards.
+	logged.Reset()
+	level.Set(slog.LevelDebug)
+	slog.Debug("logged")
+	if !strings.Contains(logged.String(), `"msg":"logged"`) {
+		t.Errorf("want the debug message, got %q", logged.String())
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/goblimey/grpc/admin"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	grpccred "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// runReload asks the server to reload its configuration, using the Admin
+// service's Reload RPC, and writes what changed, and which changes need a
+// restart, to out.  It returns an error if the server refused the new
+// configuration, saying what's wrong with it.
+//
+// The server only offers the Admin service on its admin listener, addr, and
+// only to a client certificate signed by its -adminclientca, so tlsConfig
+// must hold one.  It's the config that the client would use for gRPC, so the
+// server's certificate is checked in the same way.
+func runReload(addr string, tlsConfig *tls.Config, timeout time.Duration, out io.Writer) error {
+	if len(addr) == 0 {
+		return errors.New("reload needs -adminaddr, the address of the server's admin listener")
+	}
+	if len(tlsConfig.Certificates) == 0 {
+		return errors.New("reload needs a client certificate (-clientcert) that the admin listener accepts")
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(grpccred.NewTLS(tlsConfig)))
+	if err != nil {
+		return fmt.Errorf("reload failed - %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	report, err := admin.NewAdminClient(conn).Reload(ctx, &emptypb.Empty{})
+	if err != nil {
+		s := status.Convert(err)
+		return fmt.Errorf("reload failed - %v: %s", s.Code(), s.Message())
+	}
+	fmt.Fprintln(out, report.Value)
+	return nil
+}
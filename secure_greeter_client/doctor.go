@@ -0,0 +1,617 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/goblimey/grpc/keypair"
+	"github.com/goblimey/grpc/tlspolicy"
+)
+
+// The doctor command.  When the client can't connect, gRPC reports the
+// problem as a single line such as "transport: authentication handshake
+// failed: EOF" that doesn't say which step went wrong.  doctor goes through
+// the steps one at a time - DNS, TCP, TLS, the certificate chain, trust,
+// HTTP/2 - shows what it finds at each and finishes with a diagnosis in plain
+// English and a suggested fix for each problem:
+//
+//     secure_greeter_client -server=mydomain.com -certfile=ca.crt doctor
+//
+// It uses the same flags as a normal run, so it checks the configuration that
+// the client would actually use.
+
+// doctorOptions is what the doctor needs to know about the client's
+// configuration.
+type doctorOptions struct {
+	host          string // -server
+	port          int
+	serverName    string // the name the certificate must be valid for
+	caPaths       []string
+	systemRoots   bool
+	pins          []string
+	pinfile       string
+	pinOnly       bool
+	policy        *tlspolicy.Options
+	clientCert    string
+	clientKey     string
+	clientKeyPass *keypair.Passphrase
+	timeout       time.Duration
+}
+
+// finding is a problem that the doctor found, with a suggested fix.
+type finding struct {
+	problem string
+	fix     string
+}
+
+// doctor runs the checks.
+type doctor struct {
+	opts     doctorOptions
+	out      io.Writer
+	findings []finding
+	warnings []finding // things that may cause trouble but don't stop a connection
+}
+
+// TLS alert codes that the server may send (RFC 8446 section 6).
+const (
+	alertHandshakeFailure    = 40
+	alertBadCertificate      = 42
+	alertCertificateExpired  = 45
+	alertCertificateUnknown  = 46
+	alertUnknownCA           = 48
+	alertProtocolVersion     = 70
+	alertInsufficientSecure  = 71
+	alertUnrecognizedName    = 112
+	alertCertificateRequired = 116
+	alertNoApplicationProto  = 120
+)
+
+// runDoctor checks the connection to the server and writes a report to out.
+// It returns an error if it found a problem that would stop the client
+// working.
+func runDoctor(opts doctorOptions, out io.Writer) error {
+	d := &doctor{opts: opts, out: out}
+	d.run()
+	d.report()
+	if len(d.findings) > 0 {
+		return fmt.Errorf("found %d problem(s)", len(d.findings))
+	}
+	return nil
+}
+
+func (d *doctor) problem(problem, fix string) {
+	d.findings = append(d.findings, finding{problem, fix})
+}
+
+func (d *doctor) warn(problem, fix string) {
+	d.warnings = append(d.warnings, finding{problem, fix})
+}
+
+func (d *doctor) printf(format string, args ...interface{}) {
+	fmt.Fprintf(d.out, format, args...)
+}
+
+// run goes through the steps, stopping at the first one that fails since
+// the later ones depend on it.
+func (d *doctor) run() {
+	d.printf("Checking %s port %d (certificate name %s)\n", d.opts.host, d.opts.port, d.opts.serverName)
+
+	addrs := d.resolve()
+	if len(addrs) == 0 {
+		return
+	}
+	conn := d.connect(addrs)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+
+	config, ok := d.tlsConfig()
+	if !ok {
+		return
+	}
+	asked := false
+	config.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		asked = true
+		if len(config.Certificates) > 0 {
+			return &config.Certificates[0], nil
+		}
+		return &tls.Certificate{}, nil
+	}
+
+	tlsConn, state := d.handshake(conn, config)
+	if state == nil {
+		return
+	}
+	switch {
+	case asked && len(config.Certificates) > 0:
+		d.printf("    the server asked for a client certificate and we sent %s\n",
+			describeCert(config.Certificates[0].Leaf))
+	case asked:
+		d.printf("    the server asked for a client certificate and we have none\n")
+	}
+	d.showChain(state)
+	d.checkTrust(state.PeerCertificates)
+	d.checkHTTP2(tlsConn, state)
+}
+
+// resolve looks the server up in DNS, both ways.
+func (d *doctor) resolve() []string {
+	d.printf("\nDNS\n")
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.timeout)
+	defer cancel()
+
+	var addrs []string
+	if ip := net.ParseIP(d.opts.host); ip != nil {
+		d.printf("    %s is an IP address - no forward lookup needed\n", d.opts.host)
+		addrs = []string{ip.String()}
+	} else {
+		start := time.Now()
+		var err error
+		addrs, err = net.DefaultResolver.LookupHost(ctx, d.opts.host)
+		if err != nil {
+			d.printf("    lookup of %s failed after %v - %v\n", d.opts.host, since(start), err)
+			d.problem(fmt.Sprintf("the name %s can't be translated to an IP address", d.opts.host),
+				"check the spelling of -server, the server's DNS records and /etc/hosts")
+			return nil
+		}
+		d.printf("    %s -> %s (%v)\n", d.opts.host, strings.Join(addrs, ", "), since(start))
+	}
+
+	for _, addr := range addrs {
+		start := time.Now()
+		names, err := net.DefaultResolver.LookupAddr(ctx, addr)
+		if err != nil || len(names) == 0 {
+			d.printf("    %s -> no reverse DNS (%v)\n", addr, since(start))
+			if !net.ParseIP(addr).IsLoopback() {
+				d.warn(fmt.Sprintf("%s has no reverse DNS record", addr),
+					"ask whoever runs the server's DNS to add a PTR record for it.  "+
+						"Without one connections can be slow or unreliable")
+			}
+			continue
+		}
+		for i := range names {
+			names[i] = strings.TrimSuffix(names[i], ".")
+		}
+		d.printf("    %s -> %s (%v)\n", addr, strings.Join(names, ", "), since(start))
+	}
+	return addrs
+}
+
+// connect makes a TCP connection to the first address that answers.
+func (d *doctor) connect(addrs []string) net.Conn {
+	d.printf("\nTCP\n")
+	port := strconv.Itoa(d.opts.port)
+	var lastErr error
+	for _, addr := range addrs {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(addr, port), d.opts.timeout)
+		if err == nil {
+			d.printf("    connected to %s in %v\n", net.JoinHostPort(addr, port), since(start))
+			return conn
+		}
+		d.printf("    %s failed after %v - %v\n", net.JoinHostPort(addr, port), since(start), err)
+		lastErr = err
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(lastErr, syscall.ECONNREFUSED):
+		d.problem(fmt.Sprintf("nothing is listening on port %d", d.opts.port),
+			"check that the server is running and that -p is the same on the client and the server")
+	case errors.As(lastErr, &netErr) && netErr.Timeout():
+		d.problem("the connection timed out - nothing answered",
+			"a firewall is probably dropping the connection.  Check that the port is open, "+
+				"and forwarded if the server is behind NAT")
+	case errors.Is(lastErr, syscall.EHOSTUNREACH) || errors.Is(lastErr, syscall.ENETUNREACH):
+		d.problem("there is no route to the server", "check the network connection and the server's address")
+	default:
+		d.problem(fmt.Sprintf("cannot connect - %v", lastErr), "check the server's address and port")
+	}
+	return nil
+}
+
+// tlsConfig builds the TLS config from the client's options.  It doesn't
+// check the certificate - that's done separately so we can say exactly what
+// is wrong with it.
+func (d *doctor) tlsConfig() (*tls.Config, bool) {
+	config := &tls.Config{
+		ServerName:         d.opts.serverName,
+		InsecureSkipVerify: true, // checkTrust does the checks
+		NextProtos:         []string{"h2"},
+	}
+	policy, err := tlspolicy.New(d.opts.policy)
+	if err != nil {
+		d.problem(fmt.Sprintf("the TLS settings are wrong - %v", err), "fix -tlsprofile, -tlsmin, -tlsmax, -tlsciphers or -tlscurves")
+		return nil, false
+	}
+	policy.Apply(config)
+
+	if len(d.opts.clientCert) > 0 {
+		cert, err := keypair.Load(d.opts.clientCert, d.opts.clientKey, d.opts.clientKeyPass)
+		if err != nil {
+			var unsupported *keypair.UnsupportedError
+			switch {
+			case errors.Is(err, keypair.ErrWrongPassphrase):
+				d.problem(fmt.Sprintf("the client key can't be decrypted - %v", err),
+					"check the passphrase")
+			case errors.As(err, &unsupported):
+				d.problem(err.Error(), "convert the key to PKCS#8 or use a PKCS#12 bundle")
+			default:
+				d.problem(fmt.Sprintf("cannot load the client certificate - %v", err),
+					"check -clientcert and -clientkey")
+			}
+			return nil, false
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, true
+}
+
+// handshake does the TLS handshake on conn.
+func (d *doctor) handshake(conn net.Conn, config *tls.Config) (*tls.Conn, *tls.ConnectionState) {
+	d.printf("\nTLS\n")
+	conn.SetDeadline(time.Now().Add(d.opts.timeout))
+	tlsConn := tls.Client(conn, config)
+	start := time.Now()
+	err := tlsConn.Handshake()
+	if err == nil {
+		state := tlsConn.ConnectionState()
+		d.printf("    handshake took %v\n", since(start))
+		d.printf("    version %s, cipher suite %s\n", tls.VersionName(state.Version),
+			tls.CipherSuiteName(state.CipherSuite))
+		if len(state.OCSPResponse) > 0 {
+			d.printf("    the server stapled an OCSP response\n")
+		}
+		return tlsConn, &state
+	}
+	d.printf("    handshake failed after %v - %v\n", since(start), err)
+	d.explainHandshakeError(err)
+	return nil, nil
+}
+
+// explainHandshakeError turns a handshake failure into a finding.
+func (d *doctor) explainHandshakeError(err error) {
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	alert, isAlert := remoteAlert(err)
+	switch {
+	case errors.As(err, &recordErr):
+		d.problem("the server did not answer with TLS - it is probably running without encryption "+
+			"or something else is listening on the port",
+			"check the port, and that the server is secure_greeter_server with a certificate")
+	case isAlert:
+		d.explainAlert(alert)
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF):
+		d.problem("the server closed the connection during the handshake",
+			"look in the server's log.  The usual causes are a TLS version or cipher suite that the "+
+				"server doesn't allow, or a missing or rejected client certificate")
+		d.tryWithoutPolicy()
+	case errors.As(err, &netErr) && netErr.Timeout():
+		d.problem("the server accepted the connection but didn't complete the handshake",
+			"the server may be overloaded, or a proxy or firewall is interfering")
+	default:
+		d.problem(fmt.Sprintf("the handshake failed - %v", err), "look in the server's log")
+	}
+}
+
+// remoteAlert returns the code of the TLS alert that the server sent, if err
+// is one.  The TLS package reports an alert as a net.OpError with the op
+// "remote error" wrapping a value of its own unexported alert type, which is
+// a uint8.
+func remoteAlert(err error) (uint8, bool) {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" {
+		return 0, false
+	}
+	v := reflect.ValueOf(opErr.Err)
+	if v.Kind() != reflect.Uint8 {
+		return 0, false
+	}
+	return uint8(v.Uint()), true
+}
+
+// explainAlert explains a TLS alert from the server.
+func (d *doctor) explainAlert(code uint8) {
+	switch code {
+	case alertProtocolVersion:
+		d.problem("the server doesn't accept any of the TLS versions that we allow",
+			"make -tlsmin, -tlsmax and -tlsprofile agree with the server's settings")
+		d.tryWithoutPolicy()
+	case alertHandshakeFailure, alertInsufficientSecure:
+		d.problem("the server and the client have no cipher suite or key exchange curve in common",
+			"make -tlsprofile, -tlsciphers and -tlscurves agree with the server's settings")
+		d.tryWithoutPolicy()
+	case alertBadCertificate, alertCertificateUnknown, alertUnknownCA, alertCertificateExpired:
+		d.problem("the server rejected our client certificate",
+			"use a client certificate signed by the CA that the server's -clientca names, "+
+				"and check that it hasn't expired or been revoked")
+	case alertCertificateRequired:
+		d.problem("the server requires a client certificate (mutual TLS)",
+			"give the client certificate and key with -clientcert and -clientkey.  "+
+				"The server's certs command creates them with -clients")
+	case alertUnrecognizedName:
+		d.problem(fmt.Sprintf("the server has no certificate for the name %s", d.opts.serverName),
+			"connect with one of the server's names, or give one with -servername")
+	case alertNoApplicationProto:
+		d.problem("the server doesn't speak HTTP/2, so it isn't a gRPC server",
+			"check the port")
+	default:
+		d.problem(fmt.Sprintf("the server refused the handshake with TLS alert %d", code),
+			"look in the server's log")
+	}
+}
+
+// tryWithoutPolicy repeats the handshake with Go's most permissive settings
+// to find out what the server would accept, so that we can say which of our
+// TLS settings rules it out.
+func (d *doctor) tryWithoutPolicy() {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(d.opts.host, strconv.Itoa(d.opts.port)), d.opts.timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(d.opts.timeout))
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         d.opts.serverName,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS10,
+		NextProtos:         []string{"h2"},
+	})
+	if tlsConn.Handshake() != nil {
+		return
+	}
+	state := tlsConn.ConnectionState()
+	d.printf("    without our TLS settings the server agrees to %s with %s\n",
+		tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	if state.Version < tls.VersionTLS12 {
+		d.warn(fmt.Sprintf("the server only speaks %s, which is obsolete", tls.VersionName(state.Version)),
+			"upgrade the server - gRPC needs TLS 1.2 or later")
+	}
+}
+
+// showChain prints the certificates that the server presented.
+func (d *doctor) showChain(state *tls.ConnectionState) {
+	d.printf("\nCertificate chain\n")
+	now := time.Now()
+	for i, cert := range state.PeerCertificates {
+		d.printf("    %d: %s\n", i, cert.Subject.CommonName)
+		if sans := certSANs(cert); len(sans) > 0 {
+			d.printf("       names:     %s\n", strings.Join(sans, ", "))
+		}
+		d.printf("       issuer:    %s\n", cert.Issuer.CommonName)
+		d.printf("       valid:     %s to %s (%s)\n", cert.NotBefore.Format(time.RFC3339),
+			cert.NotAfter.Format(time.RFC3339), validityNote(cert, now))
+		d.printf("       key:       %s, signed with %v\n", keyType(cert), cert.SignatureAlgorithm)
+		if cert.IsCA {
+			d.printf("       CA certificate\n")
+		}
+	}
+}
+
+// validityNote says how long a certificate has left.
+func validityNote(cert *x509.Certificate, now time.Time) string {
+	switch {
+	case now.Before(cert.NotBefore):
+		return "NOT YET VALID"
+	case now.After(cert.NotAfter):
+		return fmt.Sprintf("EXPIRED %d days ago", int(now.Sub(cert.NotAfter).Hours()/24))
+	default:
+		return fmt.Sprintf("%d days left", int(cert.NotAfter.Sub(now).Hours()/24))
+	}
+}
+
+// keyType describes the public key in a certificate, for example "ECDSA
+// P-256".
+func keyType(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
+
+// checkTrust checks the chain against the configured roots and pins, the same
+// way as verifyServer, but explains each kind of failure.
+func (d *doctor) checkTrust(certs []*x509.Certificate) {
+	d.printf("\nTrust\n")
+	if len(certs) == 0 {
+		d.problem("the server did not present a certificate", "give the server a certificate")
+		return
+	}
+	leaf := certs[0]
+	now := time.Now()
+
+	if now.After(leaf.NotAfter) {
+		d.problem(fmt.Sprintf("the server certificate expired at %s", leaf.NotAfter.Format(time.RFC3339)),
+			"renew the certificate on the server (secure_greeter_server certs -force) - "+
+				"the server loads the new one without a restart")
+	} else if now.Before(leaf.NotBefore) {
+		d.problem(fmt.Sprintf("the server certificate isn't valid until %s", leaf.NotBefore.Format(time.RFC3339)),
+			"check the clocks on the client and the server")
+	} else if left := leaf.NotAfter.Sub(now); left < 14*24*time.Hour {
+		d.warn(fmt.Sprintf("the server certificate expires in %d days", int(left.Hours()/24)),
+			"renew it soon")
+	}
+
+	if err := leaf.VerifyHostname(d.opts.serverName); err != nil {
+		d.printf("    name check: FAILED\n")
+		d.problem(nameMismatchError(leaf, d.opts.serverName).Error(), "")
+	} else {
+		d.printf("    name check: the certificate is valid for %s\n", d.opts.serverName)
+	}
+
+	pins, err := loadPins(d.opts.pins, d.opts.pinfile)
+	if err != nil {
+		d.problem(err.Error(), "fix -pin or -pinfile")
+		return
+	}
+
+	candidates := []*x509.Certificate{leaf}
+	if !d.opts.pinOnly {
+		roots, count, err := loadRoots(d.opts.caPaths, d.opts.systemRoots)
+		if err != nil {
+			d.problem(err.Error(), "fix -certfile")
+			return
+		}
+		if len(d.opts.caPaths) == 0 {
+			d.printf("    roots: the system's trusted roots\n")
+		} else {
+			d.printf("    roots: %d CA certificates from %s (system roots %v)\n",
+				count, strings.Join(d.opts.caPaths, ", "), d.opts.systemRoots)
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		chains, err := leaf.Verify(opts)
+		if err != nil {
+			d.printf("    chain check: FAILED - %v\n", err)
+			d.explainVerifyError(err, leaf)
+		} else {
+			d.printf("    chain check: trusted via %s\n", chainNames(chains[0]))
+			candidates = nil
+			for _, chain := range chains {
+				candidates = append(candidates, chain...)
+			}
+		}
+	}
+
+	if len(pins) > 0 {
+		if pins.matchesAny(candidates) {
+			d.printf("    pin check: OK\n")
+		} else {
+			d.printf("    pin check: FAILED\n")
+			d.problem(fmt.Sprintf("the server certificate doesn't match any of the pins - its pin is %s",
+				formatPin(spkiPin(leaf))),
+				"if the server's key has been changed on purpose, check the new pin with the "+
+					"server's administrator and add it with -pin")
+		}
+	}
+}
+
+// explainVerifyError explains why the chain couldn't be verified.
+func (d *doctor) explainVerifyError(err error, leaf *x509.Certificate) {
+	var unknown x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknown):
+		if len(d.opts.caPaths) == 0 {
+			d.problem(fmt.Sprintf("the server certificate was issued by %q, which is not one of the system's "+
+				"trusted roots", leaf.Issuer.CommonName),
+				"if the server uses its own CA, copy its ca.crt to the client and give it with -certfile")
+		} else {
+			d.problem(fmt.Sprintf("the server certificate was issued by %q, which is not in %s",
+				leaf.Issuer.CommonName, strings.Join(d.opts.caPaths, ", ")),
+				"copy the CA certificate that signed the server certificate (ca.crt) from the server.  "+
+					"If the server's certificate was recreated with a new CA, the old ca.crt won't work")
+		}
+	case errors.As(err, &invalid):
+		switch invalid.Reason {
+		case x509.Expired:
+			// Already reported if it's the server's own certificate.
+			if invalid.Cert != leaf {
+				d.problem(fmt.Sprintf("a certificate in the chain (%s) has expired or isn't valid yet",
+					invalid.Cert.Subject.CommonName), "renew the CA certificate")
+			}
+		case x509.NotAuthorizedToSign:
+			d.problem(fmt.Sprintf("%s is not a CA certificate but it signed the server's certificate",
+				invalid.Cert.Subject.CommonName), "create the server certificate again with the certs command")
+		case x509.IncompatibleUsage:
+			d.problem("the server certificate is not allowed to be used by a server (extended key usage)",
+				"create the server certificate again with the certs command")
+		default:
+			d.problem(fmt.Sprintf("the certificate chain is not valid - %v", err), "")
+		}
+	default:
+		d.problem(fmt.Sprintf("the certificate chain is not valid - %v", err), "")
+	}
+}
+
+// chainNames describes a verified chain as leaf -> ... -> root.
+func chainNames(chain []*x509.Certificate) string {
+	var names []string
+	for _, cert := range chain {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return strings.Join(names, " -> ")
+}
+
+// checkHTTP2 checks that the server speaks HTTP/2, which gRPC runs over.  It
+// sends the HTTP/2 connection preface and an empty SETTINGS frame, and
+// expects a SETTINGS frame back.  With TLS 1.3 a rejected client certificate
+// only shows up here, because the server checks it after the handshake has
+// finished on our side.
+func (d *doctor) checkHTTP2(conn *tls.Conn, state *tls.ConnectionState) {
+	d.printf("\nHTTP/2\n")
+	if state.NegotiatedProtocol != "h2" {
+		d.printf("    the server did not agree to HTTP/2 (ALPN)\n")
+		d.problem("the server did not offer HTTP/2, so it probably isn't a gRPC server",
+			"check the port")
+		return
+	}
+	conn.SetDeadline(time.Now().Add(d.opts.timeout))
+	preface := "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	emptySettings := []byte{0, 0, 0, 4, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(append([]byte(preface), emptySettings...)); err != nil {
+		d.explainHandshakeError(err)
+		return
+	}
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		d.printf("    no answer - %v\n", err)
+		d.explainHandshakeError(err)
+		return
+	}
+	if header[3] != 4 {
+		d.problem("the server's first HTTP/2 frame was not SETTINGS - it may not be a gRPC server",
+			"check the port")
+		return
+	}
+	d.printf("    the server answered with HTTP/2 SETTINGS\n")
+}
+
+// report prints the diagnosis.
+func (d *doctor) report() {
+	d.printf("\nDiagnosis\n")
+	if len(d.findings) == 0 && len(d.warnings) == 0 {
+		d.printf("    No problems found.  If the client still fails, run it with -v and look in " +
+			"the server's log.\n")
+		return
+	}
+	for _, f := range d.findings {
+		d.printf("    PROBLEM: %s.\n", f.problem)
+		if len(f.fix) > 0 {
+			d.printf("        Fix: %s.\n", f.fix)
+		}
+	}
+	for _, f := range d.warnings {
+		d.printf("    WARNING: %s.\n", f.problem)
+		if len(f.fix) > 0 {
+			d.printf("        Fix: %s.\n", f.fix)
+		}
+	}
+}
+
+// since returns the time since start, rounded for printing.
+func since(start time.Time) time.Duration {
+	return time.Since(start).Round(100 * time.Microsecond)
+}
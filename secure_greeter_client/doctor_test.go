@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goblimey/grpc/tlspolicy"
+)
+
+// fakeGRPCServer listens on localhost with a certificate for the given hosts
+// and answers the HTTP/2 preface with a SETTINGS frame.  It returns the
+// port and a CA bundle holding the certificate.
+func fakeGRPCServer(t *testing.T, hosts ...string) (int, string) {
+	cert, key := selfSignedWithKey(t, hosts...)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		NextProtos:   []string{"h2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				preface := make([]byte, 24+9)
+				if _, err := io.ReadFull(conn, preface); err != nil {
+					return
+				}
+				conn.Write([]byte{0, 0, 0, 4, 0, 0, 0, 0, 0})
+			}()
+		}
+	}()
+
+	bundle := filepath.Join(t.TempDir(), "ca.crt")
+	err = ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln.Addr().(*net.TCPAddr).Port, bundle
+}
+
+func doctorOptionsFor(port int, serverName, bundle string) doctorOptions {
+	return doctorOptions{
+		host:       "127.0.0.1",
+		port:       port,
+		serverName: serverName,
+		caPaths:    []string{bundle},
+		policy:     &tlspolicy.Options{},
+		timeout:    5 * time.Second,
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	port, bundle := fakeGRPCServer(t, "mydomain.com")
+
+	var out bytes.Buffer
+	if err := runDoctor(doctorOptionsFor(port, "mydomain.com", bundle), &out); err != nil {
+		t.Errorf("good server: %v\n%s", err, out.String())
+	}
+	for _, want := range []string{"trusted via mydomain.com", "HTTP/2 SETTINGS", "ECDSA P-256"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("good server: report doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := runDoctor(doctorOptionsFor(port, "localhost", bundle), &out); err == nil {
+		t.Errorf("wrong name: want an error\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), `not valid for "localhost" - it is valid for mydomain.com`) {
+		t.Errorf("wrong name: report doesn't explain the mismatch:\n%s", out.String())
+	}
+
+	// A different CA.
+	_, otherBundle := fakeGRPCServer(t, "mydomain.com")
+	out.Reset()
+	if err := runDoctor(doctorOptionsFor(port, "mydomain.com", otherBundle), &out); err == nil {
+		t.Errorf("wrong CA: want an error\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "copy the CA certificate") {
+		t.Errorf("wrong CA: report doesn't suggest a fix:\n%s", out.String())
+	}
+}
+
+func TestDoctorNothingListening(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	var out bytes.Buffer
+	if err := runDoctor(doctorOptionsFor(port, "localhost", ""), &out); err == nil {
+		t.Errorf("want an error\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "nothing is listening") {
+		t.Errorf("report doesn't explain the problem:\n%s", out.String())
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// runHealth asks the server's health service whether service is serving and
+// writes the answer to out.  An empty service means the server as a whole.
+// If the server runs with -healthdetail, it describes any problems in the
+// x-health-detail header, which is written too.  It returns an error if the
+// server isn't serving or can't be asked, so that the client exits with a
+// non-zero status - scripts and orchestration systems can use it as a health
+// probe:
+//
+//	secure_greeter_client -certfile=ca.crt health helloworld.Greeter
+func runHealth(conn *grpc.ClientConn, service string, timeout time.Duration, out io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var header metadata.MD
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx,
+		&healthpb.HealthCheckRequest{Service: service}, grpc.Header(&header))
+	if err != nil {
+		return fmt.Errorf("health check failed - %v", err)
+	}
+
+	name := service
+	if len(name) == 0 {
+		name = "server"
+	}
+	fmt.Fprintf(out, "%s: %v\n", name, resp.Status)
+	if detail := header.Get("x-health-detail"); len(detail) > 0 {
+		fmt.Fprintf(out, "    %s\n", strings.Join(detail, "; "))
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("%s is not serving", name)
+	}
+	return nil
+}
@@ -19,7 +19,7 @@
  * Simple usage (localhost):
  *
  *    $ secure_greeter_client \
- *         -certfile=/home/simon/ca.certificate/selfsigned.crt
+ *         -certfile=/home/simon/certs/ca.crt
  *
  * The original software is Copyright 2015 Google and the changes 2017 Simon
  * Ritchie.  This version is distributed under the same licence conditions as
@@ -60,16 +60,31 @@ package main
 
 import (
 	"flag"
-	"io/ioutil"
 	"log"
+	"log/slog"
+	"os"
 	"strconv"
+	"sync/atomic"
+	"time"
 
+	"github.com/goblimey/grpc/deadlines"
 	pb "github.com/goblimey/grpc/helloworld"
+	"github.com/goblimey/grpc/keepalivepolicy"
+	"github.com/goblimey/grpc/keypair"
+	"github.com/goblimey/grpc/logging"
+	"github.com/goblimey/grpc/settings"
+	"github.com/goblimey/grpc/tlspolicy"
+	"github.com/goblimey/grpc/tracing"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 
 	"golang.org/x/oauth2"
@@ -82,17 +97,174 @@ const (
 )
 
 var (
-	verbose  = flag.Bool("v", false, "verbose mode")
-	port     = flag.Int("p", 50061, "port")
-	server   = flag.String("server", "localhost", "the server")
-	certfile = flag.String("certfile", "", "the certificate file")
+	port       = flag.Int("p", 50061, "port")
+	server     = flag.String("server", "localhost", "the server")
+	servername = flag.String("servername", "",
+		"the name to check the server certificate against, if it's not the same as -server")
+	certfile = flag.String("certfile", "",
+		"comma-separated CA bundle files or directories (default: the system's trusted roots)")
+	systemroots = flag.Bool("systemroots", true,
+		"trust the system's roots as well as the -certfile bundles")
+	requirestaple = flag.Bool("requirestaple", false,
+		"refuse the server unless it staples a valid OCSP response to its certificate")
+	expirywarn = flag.Int("expirywarn", 14,
+		"warn if the server certificate expires within this many days (0 to turn off)")
+	pinfile = flag.String("pinfile", "", "file of server public key pins, one per line")
+	pinonly = flag.Bool("pinonly", false,
+		"trust the server if its key matches a pin, without checking it against -certfile")
+
+	clientcert = flag.String("clientcert", "",
+		"client certificate file, or PKCS#12 bundle, for mutual TLS")
+	clientkey = flag.String("clientkey", "", "client private key file for mutual TLS")
+	adminaddr = flag.String("adminaddr", "",
+		"the server's admin listener, host:port, for the reload command - it needs -clientcert")
+	authtoken = flag.String("token", "",
+		"OAUTH access token to send to the server (default: the built-in fake token)")
+
+	count       = flag.Int("count", 1, "greet the server this many times (0 for ever)")
+	interval    = flag.Duration("interval", time.Second, "time between greetings, with -count")
+	metricsaddr = flag.String("metricsaddr", "",
+		"serve Prometheus metrics at /metrics on this address, for example localhost:9091")
+	metricsfile = flag.String("metricsfile", "",
+		"write Prometheus metrics to this file after each greeting")
+
+	maxattempts = flag.Int("maxattempts", 3,
+		"attempts at each greeting, including the first, up to 5 (1 turns retries off)")
+	retrybackoff    = flag.Duration("retrybackoff", 100*time.Millisecond, "backoff before the first retry")
+	retrymaxbackoff = flag.Duration("retrymaxbackoff", 2*time.Second, "longest backoff between retries")
+	retrymultiplier = flag.Float64("retrymultiplier", 2, "multiply the retry backoff by this after each retry")
+	retrycodes      = flag.String("retrycodes", "UNAVAILABLE",
+		"comma-separated status codes to retry, for example UNAVAILABLE,RESOURCE_EXHAUSTED")
+	trytimeout = flag.Duration("trytimeout", 0,
+		"time limit for each attempt at a greeting, after which it's retried (0 for no limit)")
+	connectbackoff    = flag.Duration("connectbackoff", time.Second, "wait this long before reconnecting after a failure")
+	connectmaxbackoff = flag.Duration("connectmaxbackoff", 2*time.Minute, "longest wait before reconnecting")
+	connectmultiplier = flag.Float64("connectmultiplier", 1.6,
+		"multiply the reconnection wait by this after each failure")
+	connecttimeout = flag.Duration("connecttimeout", 20*time.Second, "shortest time allowed for each connection attempt")
 )
 
+// tlsOptions holds the TLS security policy flags (-tlsprofile and so on).
+var tlsOptions = tlspolicy.Flags(flag.CommandLine)
+
+// keepaliveOptions holds the keepalive flags (-keepaliveprofile and so on).
+// See the keepalivepolicy package.
+var keepaliveOptions = keepalivepolicy.ClientFlags(flag.CommandLine)
+
+// deadlineOptions holds the deadline flags (-timeout and -methodtimeouts).
+// See the deadlines package.
+var deadlineOptions = deadlines.ClientFlags(flag.CommandLine)
+
+// logOptions holds the logging flags (-loglevel, -logformat and -v).  See
+// the logging package.
+var logOptions = logging.Flags(flag.CommandLine)
+
+// traceOptions holds the tracing flags (-trace and so on).  See the tracing
+// package.
+var traceOptions = tracing.Flags(flag.CommandLine)
+
+// clientKeyPass holds the flags that give the passphrase of an encrypted
+// client key (-clientkeypassfile and so on).
+var clientKeyPass = keypair.Flags(flag.CommandLine, "clientkey")
+
+// conf fills in the flags that aren't on the command line from the
+// configuration file and GREETER_CLIENT_ environment variables.  See the
+// settings package.
+var conf = settings.New(flag.CommandLine, "GREETER_CLIENT_")
+
+func init() {
+	conf.Secret("token")
+}
+
+// pins holds the -pin options.
+var pins pinList
+
+func init() {
+	flag.Var(&pins, "pin",
+		"SHA-256 pin of a server public key, as sha256/base64 (can be given more than once)")
+}
+
+// requestIDHeader is the request header holding the request ID.
+const requestIDHeader = "x-request-id"
+
+// newRequestID makes up a request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func main() {
-	flag.Parse()
+	if err := conf.Parse(os.Args[1:]); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if _, err := logging.Setup(logOptions, os.Stderr); err != nil {
+		log.Fatalf("%v", err)
+	}
+	stopTracing, err := tracing.Setup(traceOptions, "secure_greeter_client")
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	// Send the spans that are still waiting before we exit.
+	defer flushTraces(stopTracing)
+
+	// "secure_greeter_client config print" shows the settings from the
+	// configuration file, the environment and the command line combined,
+	// with the token hidden.
+	if flag.Arg(0) == "config" {
+		if flag.Arg(1) != "print" {
+			logging.Fatalf("usage: secure_greeter_client [flags] config print")
+		}
+		conf.Print(os.Stdout)
+		return
+	}
 
 	address := *server + ":" + strconv.Itoa(*port) // "localhost;50061"
 
+	// By default the server certificate must be valid for the name given by
+	// -server.  -servername overrides that, so we can connect by IP address or
+	// through a tunnel and still check the certificate against the server's
+	// real name.  The name is also sent to the server (SNI) so that it can
+	// choose the right certificate.
+	expectedName := *server
+	if len(*servername) > 0 {
+		expectedName = *servername
+	}
+
+	// "secure_greeter_client fetch-pin" prints the server's pin rather than
+	// greeting it.
+	if flag.Arg(0) == "fetch-pin" {
+		err := runFetchPin(address, expectedName, flag.Args()[1:], os.Stdin, os.Stdout)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		return
+	}
+
+	// "secure_greeter_client doctor" checks the connection step by step and
+	// explains what's wrong with it.  See doctor.go.
+	if flag.Arg(0) == "doctor" {
+		err := runDoctor(doctorOptions{
+			host:          *server,
+			port:          *port,
+			serverName:    expectedName,
+			caPaths:       settings.SplitList(*certfile),
+			systemRoots:   *systemroots,
+			pins:          pins,
+			pinfile:       *pinfile,
+			pinOnly:       *pinonly,
+			policy:        tlsOptions,
+			clientCert:    *clientcert,
+			clientKey:     *clientkey,
+			clientKeyPass: clientKeyPass,
+			timeout:       10 * time.Second,
+		}, os.Stdout)
+		if err != nil {
+			logging.Fatalf("doctor %v", err)
+		}
+		return
+	}
+
 	// The dial options control the style of connection, for example encrypted
 	// (https) or plain text (http).
 	var opts []grpc.DialOption
@@ -103,69 +275,200 @@ func main() {
 	// token and the server always expects to receive it.  In the real world the
 	// client would get a token from an OAUTH source such as a Hydra system, and
 	// the server would check with the OAUTH server that the token is valid.
-	if *verbose {
-		log.Printf("getting auth token")
-	}
+	slog.Debug("getting auth token")
 	tokenText := "{\"access_token\":\"rTO69tZATgSqamjQn7v9HA\",\"expires_in\":3600,\"refresh_token\":\"xBqf2OWbT_KvWW8LHOPF0A\",\"scope\":\"everything\",\"token_type\":\"Bearer\"}"
 	var token oauth2.Token
 	if err := json.Unmarshal([]byte(tokenText), &token); err != nil {
-		log.Fatalf("error unmarshalling JSON from OAUTH token: %v", err)
+		logging.Fatalf("error unmarshalling JSON from OAUTH token: %v", err)
 	}
-	if *verbose {
-		log.Printf("got auth token %s type %s", token.AccessToken, token.TokenType)
+	if len(*authtoken) > 0 {
+		token.AccessToken = *authtoken
 	}
+	// Never log the token itself.
+	slog.Debug("got auth token", "type", token.TokenType, "expires_in", token.ExpiresIn)
 
-	// Create the OAUTH dial option from the token
+	// Create the OAUTH dial option from the token.  Fetching the token for
+	// each RPC gets its own span in the trace.
 	credentials := oauth.NewOauthAccess(&token)
-	oauthDialOption := grpc.WithPerRPCCredentials(credentials)
+	oauthDialOption := grpc.WithPerRPCCredentials(tracedCredentials{credentials})
 
 	// add the interceptor as a server option
 	opts = append(opts, oauthDialOption)
 
-	// Load the self-signed CA certificate.  If the client and server run on
-	// different machines you have to generate this on the server and copy it
-	// to the client machine.  I generated mine using Jason Woods' lc_tlscert app:
+	// Give each RPC a deadline, so that a hung server can't hang the client
+	// (see the deadlines package), count and time the RPCs, for
+	// -metricsaddr and -metricsfile (see metrics.go), and give each one a
+	// span, whose trace the server continues (see the tracing package).
+	limits, err := deadlines.New(deadlineOptions)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	slog.Debug(limits.ClientString())
+	metrics := newClientMetrics(metricsRegistry)
+	opts = append(opts, grpc.WithChainUnaryInterceptor(limits.UnaryClientInterceptor,
+		metrics.unary, tracing.UnaryClientInterceptor))
+	if len(*metricsaddr) > 0 {
+		go serveMetrics(*metricsaddr)
+	}
+
+	// Ping the server to keep the connection alive and to notice when it's
+	// gone, as the keepalive policy says.  See the keepalivepolicy package.
+	keepalive, err := keepalivepolicy.New(keepaliveOptions)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	opts = append(opts, keepalive.DialOptions()...)
+	slog.Debug(keepalive.ClientString())
+
+	// Retry failed greetings and back off between connection attempts.  See
+	// retry.go.
+	retryable, err := parseCodes(*retrycodes)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	retry := &retryPolicy{
+		maxAttempts:       *maxattempts,
+		initialBackoff:    *retrybackoff,
+		maxBackoff:        *retrymaxbackoff,
+		multiplier:        *retrymultiplier,
+		codes:             retryable,
+		tryTimeout:        *trytimeout,
+		connectBackoff:    *connectbackoff,
+		connectMaxBackoff: *connectmaxbackoff,
+		connectMultiplier: *connectmultiplier,
+		connectTimeout:    *connecttimeout,
+	}
+	if err := retry.check(); err != nil {
+		logging.Fatalf("%v", err)
+	}
+	opts = append(opts, retry.dialOptions()...)
+	slog.Debug("retry policy: " + retry.String())
+
+	// Load the CA certificates.  If the server has a certificate from a public
+	// CA such as Let's Encrypt, the system's trusted roots are enough and you
+	// don't need -certfile.  If you made your own CA, the client needs a copy of
+	// its certificate.  If the client and server run on different machines you
+	// have to generate this on the server and copy it to the client machine.
+	// The server's certs command creates it:
 	//
-	//    go get github.com/driskell/log-courier
-	//    go intall github.com/driskell/log-courier/lc-tlscert
-	//    lc-tlscert
-	//    (Give your server name as the common name)
+	//    secure_greeter_server certs -hosts=mydomain.com,localhost
 	//
-	// The common name must match the server name that you use when you run the
-	// client.  If the client and server are on the same machine you can use
-	// "localhost".
+	// The server name that you use when you run the client must be one of the
+	// names that the server certificate is valid for.  The certs command sets
+	// those from the -hosts list.
 	//
-	// That processes creates a .crt file and a .key file.  You only need a copy of
-	// the .crt file.  The .key file contains the private key and it stays on the
-	// server.
+	// That process creates ca.crt, ca.key, server.crt and server.key.  You only
+	// need a copy of ca.crt.  The .key files contain private keys and they stay
+	// on the server.
 	//
-	// Danger Will Robinson:  I found instructions on the web showing other ways to
-	// generate a self-signed certificate but the result didn't work for gRPC.
+	// -certfile can list several CA bundles, or directories of them.  They're
+	// added to the system roots unless -systemroots=false.  See loadRoots.
+	//
+	// As well as (or instead of) checking the certificate against the CA, we
+	// can check that the server's public key is one that we expect - see
+	// pin.go.  With -pinonly the CA isn't needed at all.
+
+	serverPins, err := loadPins(pins, *pinfile)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	if *pinonly && len(serverPins) == 0 {
+		logging.Fatalf("-pinonly needs at least one pin")
+	}
+	if len(serverPins) == 1 {
+		slog.Warn("only one pin given - add a backup pin, otherwise replacing " +
+			"the server's key will lock this client out")
+	}
+
+	var caCertPool *x509.CertPool
+	if !*pinonly {
+		var count int
+		caCertPool, count, err = loadRoots(settings.SplitList(*certfile), *systemroots)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		if len(*certfile) == 0 {
+			slog.Debug("using the system's trusted roots")
+		} else {
+			slog.Debug("loaded CA certificates", "count", count, "files", *certfile,
+				"system_roots", *systemroots)
+		}
+	}
+
+	// We do the certificate checks ourselves rather than leaving them to the
+	// TLS package, so that if the name doesn't match we can say which names
+	// the certificate does have, and so that we can check the pins.  See
+	// verifyServer.
+	tlsConfig := tls.Config{
+		ServerName:            expectedName,
+		InsecureSkipVerify:    true, // verifyServer does the checks
+		VerifyPeerCertificate: verifyServer(caCertPool, expectedName, serverPins),
+	}
+	if *expirywarn > 0 {
+		within := time.Duration(*expirywarn) * 24 * time.Hour
+		tlsConfig.VerifyPeerCertificate = warnExpiry(tlsConfig.VerifyPeerCertificate, within)
+	}
+	if *requirestaple {
+		tlsConfig.VerifyConnection = requireStaple
+	}
 
-	caCert, err := ioutil.ReadFile(*certfile)
+	// Apply the TLS security policy - allowed versions, cipher suites and so
+	// on.  See the tlspolicy package.
+	policy, err := tlspolicy.New(tlsOptions)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatalf("%v", err)
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	policy.Apply(&tlsConfig)
+	slog.Debug(policy.String())
 
-	tlsConfig := tls.Config{RootCAs: caCertPool}
+	// If the server insists on mutual TLS we have to present a certificate
+	// signed by the CA that it trusts.  The server's certs command creates
+	// them with -clients.  A PKCS#12 bundle holds both, so it doesn't need
+	// -clientkey.
+	if len(*clientcert) > 0 || len(*clientkey) > 0 {
+		if len(*clientcert) == 0 || (len(*clientkey) == 0 && !keypair.IsPKCS12(*clientcert)) {
+			logging.Fatalf("you must specify both the client cert file and the client key file")
+		}
+		if err := clientKeyPass.Check(); err != nil {
+			logging.Fatalf("%v", err)
+		}
+		cert, err := keypair.Load(*clientcert, *clientkey, clientKeyPass)
+		if err != nil {
+			logging.Fatalf("cannot load the client certificate - %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// "secure_greeter_client reload" asks the server to reload its
+	// configuration, through the Admin service on the server's admin
+	// listener.  See admin.go.
+	if flag.Arg(0) == "reload" {
+		if err := runReload(*adminaddr, &tlsConfig, 10*time.Second, os.Stdout); err != nil {
+			logging.Fatalf("%v", err)
+		}
+		return
+	}
 
 	tlsDialOption := grpc.WithTransportCredentials(grpccred.NewTLS(&tlsConfig))
 	// add the TLS as a server option
 	opts = append(opts, tlsDialOption)
 
-	if *verbose {
-		log.Printf("connecting to server %s", address)
-	}
+	slog.Debug("connecting to server", "address", address)
 	conn, err := grpc.Dial(address, opts...)
 	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+		logging.Fatalf("did not connect: %v", err)
 	}
 	defer conn.Close()
 
-	if *verbose {
-		log.Printf("connected to server")
+	slog.Debug("connected to server")
+
+	// "secure_greeter_client health [service]" asks the server whether it's
+	// serving rather than greeting it.  See health.go.
+	if flag.Arg(0) == "health" {
+		if err := runHealth(conn, flag.Arg(1), 10*time.Second, os.Stdout); err != nil {
+			logging.Fatalf("%v", err)
+		}
+		return
 	}
 
 	// Set up a connection to the server.
@@ -176,9 +479,97 @@ func main() {
 	if len(flag.Args()) > 1 {
 		name = flag.Arg(1)
 	}
-	r, err := c.SayHello(context.Background(), &pb.HelloRequest{Name: name})
+
+	// Normally we greet the server once.  With -count we carry on, so the
+	// client can be left running as a probe, and a failure doesn't stop it.
+	if *count == 1 {
+		requestID, attempts, err := greet(c, name)
+		writeMetrics(*metricsfile)
+		if err != nil {
+			flushTraces(stopTracing)
+			logging.Fatalf("%s after %d attempts: %v (request ID %s)", failure(err), attempts, err, requestID)
+		}
+		return
+	}
+	failures := 0
+	for i := 0; *count <= 0 || i < *count; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+		requestID, attempts, err := greet(c, name)
+		writeMetrics(*metricsfile)
+		if err != nil {
+			failures++
+			slog.Error(failure(err), "error", err, "request_id", requestID, "attempts", attempts)
+		}
+	}
+	if failures > 0 {
+		flushTraces(stopTracing)
+		logging.Fatalf("%d of %d greetings failed", failures, *count)
+	}
+}
+
+// flushTraces sends the trace spans that are still waiting and stops the
+// exporter.
+func flushTraces(stop func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := stop(ctx); err != nil {
+		slog.Error("cannot send the last trace spans", "error", err)
+	}
+}
+
+// greet says hello to the server and logs its reply.  It returns the request
+// ID, which lets the server's operator find the request in its log, and the
+// number of attempts that it took (see retry.go).  The server uses our
+// request ID if it's acceptable and sends back the one that it used.  Every
+// attempt sends the same one.
+//
+// Each greeting is a trace, with the RPC and the token fetch inside it.
+func greet(c pb.GreeterClient, name string) (requestID string, attempts int, err error) {
+	ctx, span := tracing.Start(context.Background(), "greet")
+	defer func() { tracing.End(span, err) }()
+
+	requestID = newRequestID()
+	ctx = metadata.AppendToOutgoingContext(ctx, requestIDHeader, requestID)
+	ctx, counter := withAttempts(ctx)
+	var header metadata.MD
+	r, err := c.SayHello(ctx, &pb.HelloRequest{Name: name}, grpc.Header(&header))
+	attempts = int(atomic.LoadInt32(counter))
+	if ids := header.Get(requestIDHeader); len(ids) > 0 {
+		requestID = ids[0]
+	}
 	if err != nil {
-		log.Fatalf("could not greet: %v", err)
+		return requestID, attempts, err
+	}
+	attrs := []interface{}{"message", r.Message, "request_id", requestID, "attempts", attempts}
+	if traceID := tracing.TraceID(ctx); len(traceID) > 0 {
+		attrs = append(attrs, "trace_id", traceID)
+	}
+	slog.Info("greeting", attrs...)
+	return requestID, attempts, nil
+}
+
+// failure describes a failed greeting.  A greeting that ran out of time -
+// the client's deadline or the server's time limit - is reported as a
+// timeout, since the cure is different.
+func failure(err error) string {
+	if status.Code(err) == codes.DeadlineExceeded {
+		return "greeting timed out"
 	}
-	log.Printf("Greeting: %s", r.Message)
+	return "could not greet"
+}
+
+// tracedCredentials gives each fetch of the OAUTH token a span in the RPC's
+// trace.  The fake token is fixed, but a real token source might have to
+// ask the OAUTH server for a new one, which is worth seeing in a trace.
+type tracedCredentials struct {
+	grpccred.PerRPCCredentials
+}
+
+func (c tracedCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	ctx, span := tracing.Start(ctx, "fetch token")
+	md, err := c.PerRPCCredentials.GetRequestMetadata(ctx, uri...)
+	tracing.End(span, err)
+	return md, err
 }
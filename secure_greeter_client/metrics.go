@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics.  When the client greets the server repeatedly (-count and
+// -interval), for example as a probe, it can publish Prometheus metrics
+// about its RPCs:
+//
+//   - greeter_client_rpcs_total - RPCs finished, by method and status code,
+//   - greeter_client_rpc_duration_seconds - a histogram of RPC latency, by
+//     method, and
+//   - greeter_client_rpcs_in_flight - RPCs running now, by method.
+//
+// -metricsaddr serves them at /metrics for Prometheus to scrape.
+// -metricsfile writes them to a file after each greeting instead, in the
+// text format that node_exporter's textfile collector reads.  The file is
+// replaced in one step, so the collector never sees half of it.
+
+// metricsRegistry holds the client's Prometheus metrics.
+var metricsRegistry = prometheus.NewRegistry()
+
+// clientMetrics counts and times RPCs.
+type clientMetrics struct {
+	rpcs     *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+}
+
+// newClientMetrics creates the metrics and registers them with reg.
+func newClientMetrics(reg prometheus.Registerer) *clientMetrics {
+	m := &clientMetrics{
+		rpcs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greeter_client_rpcs_total",
+			Help: "RPCs finished, by method and status code.",
+		}, []string{"method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "greeter_client_rpc_duration_seconds",
+			Help:    "How long RPCs took, including connecting, by method.",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"method"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "greeter_client_rpcs_in_flight",
+			Help: "RPCs running now, by method.",
+		}, []string{"method"}),
+	}
+	reg.MustRegister(m.rpcs, m.latency, m.inFlight)
+	return m
+}
+
+// unary is a grpc.UnaryClientInterceptor that counts and times RPCs.
+func (m *clientMetrics) unary(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+	began := time.Now()
+	inFlight := m.inFlight.WithLabelValues(method)
+	inFlight.Inc()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	inFlight.Dec()
+	m.latency.WithLabelValues(method).Observe(time.Since(began).Seconds())
+	m.rpcs.WithLabelValues(method, status.Code(err).String()).Inc()
+	return err
+}
+
+// serveMetrics publishes the metrics at /metrics on addr.  It runs until the
+// listener fails, so it should be started as a goroutine.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	slog.Info("serving metrics", "url", "http://"+addr+"/metrics")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("metrics listener failed", "addr", addr, "error", err)
+	}
+}
+
+// writeMetrics writes the metrics to file, if it's not empty.
+func writeMetrics(file string) {
+	if len(file) == 0 {
+		return
+	}
+	if err := prometheus.WriteToTextfile(file, metricsRegistry); err != nil {
+		slog.Error("cannot write the metrics", "file", file, "error", err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/goblimey/grpc/keypair"
+)
+
+// Certificate pinning.  Rather than (or as well as) trusting any certificate
+// signed by the CA in -certfile, the client can be told exactly which public
+// keys the server is allowed to have.  A pin is the base64-encoded SHA-256
+// hash of a certificate's SubjectPublicKeyInfo - the same format used by
+// HTTP Public Key Pinning and curl's --pinnedpubkey, for example:
+//
+//     sha256/9Qf1ZzP4Yr2p5Y0cC8D4Z8tX3vO3fKfJ2nq0Z+0Gx2E=
+//
+// The pin identifies the key, not the certificate, so it survives renewing a
+// certificate as long as the key stays the same.  You should always have at
+// least two pins - the key that's in use and a backup, such as the key of the
+// CA that signs the server certificates or a spare key that you'll move to
+// next - otherwise replacing the server's key will lock every client out.
+// (A CA pin only counts when the chain is checked against -certfile too.
+// With -pinonly there's no verified chain, so the pin must match the server's
+// own key.)
+//
+// Get the pin of a running server with
+//
+//     secure_greeter_client -server=mydomain.com fetch-pin
+//
+// or of a certificate file with
+//
+//     secure_greeter_client fetch-pin ca.crt
+
+// pinSet is a set of pins, held as base64 strings without the sha256/ prefix.
+type pinSet map[string]bool
+
+// pinList is a flag.Value holding the -pin options.  The flag can be given
+// more than once.
+type pinList []string
+
+func (p *pinList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pinList) Set(value string) error {
+	if _, err := parsePin(value); err != nil {
+		return err
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+// Items returns the pins given, for the settings package.
+func (p *pinList) Items() []string {
+	return *p
+}
+
+// Reset removes the pins given, for the settings package.
+func (p *pinList) Reset() {
+	*p = nil
+}
+
+// parsePin checks a pin and returns it without its prefix.  The prefix
+// "sha256/" (or curl's "sha256//") is optional.
+func parsePin(pin string) (string, error) {
+	pin = strings.TrimSpace(pin)
+	pin = strings.TrimPrefix(pin, "sha256/")
+	pin = strings.TrimPrefix(pin, "/")
+	hash, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(hash) != sha256.Size {
+		return "", fmt.Errorf("%q is not a valid pin - it should be sha256/ followed by "+
+			"a base64-encoded SHA-256 hash", pin)
+	}
+	return pin, nil
+}
+
+// loadPins builds a pinSet from the -pin options and the lines of the -pinfile
+// file.  In the file, blank lines and lines starting with # are ignored.
+func loadPins(pins []string, pinfile string) (pinSet, error) {
+	set := make(pinSet)
+	for _, p := range pins {
+		pin, err := parsePin(p)
+		if err != nil {
+			return nil, err
+		}
+		set[pin] = true
+	}
+	if len(pinfile) > 0 {
+		data, err := ioutil.ReadFile(pinfile)
+		if err != nil {
+			return nil, err
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			pin, err := parsePin(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", pinfile, i+1, err)
+			}
+			set[pin] = true
+		}
+	}
+	return set, nil
+}
+
+// matchesAny returns true if the public key of any of the certificates
+// matches one of the pins.
+func (s pinSet) matchesAny(certs []*x509.Certificate) bool {
+	for _, cert := range certs {
+		if s[spkiPin(cert)] {
+			return true
+		}
+	}
+	return false
+}
+
+// spkiPin returns the pin of a certificate's public key, without the prefix.
+func spkiPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// formatPin adds the prefix to a pin.
+func formatPin(pin string) string {
+	return "sha256/" + pin
+}
+
+// runFetchPin implements the fetch-pin command.  With no files it connects to
+// the server, shows the certificates that it presents and, if the user
+// confirms that they are the right ones, prints their pins.  The certificates
+// aren't checked against any roots - the whole point is to find out what the
+// server has - so the user must check the fingerprint with whoever runs the
+// server before trusting it.
+//
+// If files are given, it prints the pins of the certificates in them instead.
+func runFetchPin(address, serverName string, files []string, in io.Reader, out io.Writer) error {
+	if len(files) > 0 {
+		for _, file := range files {
+			certs, err := keypair.ReadCertificates(file)
+			if err != nil {
+				return err
+			}
+			for _, cert := range certs {
+				fmt.Fprintf(out, "%s: %s\n    -pin=%s\n", file, certSubject(cert),
+					formatPin(spkiPin(cert)))
+			}
+		}
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true, // we only want to look at the certificate
+	})
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s - %v", address, err)
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	conn.Close()
+
+	fmt.Fprintf(out, "%s presented %d certificate(s):\n", address, len(certs))
+	for i, cert := range certs {
+		fingerprint := sha256.Sum256(cert.Raw)
+		fmt.Fprintf(out, "\n%d: %s\n", i, certSubject(cert))
+		fmt.Fprintf(out, "    issued by:   %s\n", cert.Issuer.CommonName)
+		fmt.Fprintf(out, "    valid until: %s\n", cert.NotAfter.Format(time.RFC3339))
+		fmt.Fprintf(out, "    SHA-256 fingerprint: %s\n", formatFingerprint(fingerprint[:]))
+	}
+
+	fmt.Fprintf(out, "\nCheck the fingerprint with the server's administrator "+
+		"(on the server: openssl x509 -noout -fingerprint -sha256 -in server.crt).\n")
+	fmt.Fprintf(out, "Is this the right server? [y/N] ")
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		return fmt.Errorf("certificate not confirmed - no pin printed")
+	}
+
+	fmt.Fprintf(out, "\nServer certificate pin:\n    -pin=%s\n", formatPin(spkiPin(certs[0])))
+	for _, cert := range certs[1:] {
+		fmt.Fprintf(out, "Pin for %s (can be used as a backup pin):\n    -pin=%s\n",
+			certSubject(cert), formatPin(spkiPin(cert)))
+	}
+	if len(certs) == 1 {
+		fmt.Fprintf(out, "Add a backup pin, for example the pin of the CA that signed the "+
+			"certificate (not with -pinonly):\n    secure_greeter_client fetch-pin ca.crt\n")
+	}
+	return nil
+}
+
+// certSubject returns the common name of a certificate followed by its SANs.
+func certSubject(cert *x509.Certificate) string {
+	sans := certSANs(cert)
+	if len(sans) == 0 {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.CommonName + " (" + strings.Join(sans, ", ") + ")"
+}
+
+// formatFingerprint formats a hash as colon-separated hex, the way openssl
+// does.
+func formatFingerprint(hash []byte) string {
+	parts := make([]string, len(hash))
+	for i, b := range hash {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
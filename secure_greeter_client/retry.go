@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+)
+
+// Retries.  A greeting that fails with one of the status codes in
+// -retrycodes (by default UNAVAILABLE, which means that the server couldn't
+// be reached or went away) is tried again, up to -maxattempts times in all.
+// Before each retry the client waits for a random time up to a backoff that
+// starts at -retrybackoff and is multiplied by -retrymultiplier each time, up
+// to -retrymaxbackoff.  gRPC does the retrying itself, following the retry
+// policy in the service config that the client gives it.
+//
+// -trytimeout limits how long each attempt may take, so that one slow
+// attempt doesn't use up the whole greeting.  gRPC's service config can't
+// say that, so the stats handler gives each attempt its own deadline.  An
+// attempt that runs out of time fails with DEADLINE_EXCEEDED, which is then
+// retried as well.
+//
+// Separately, when gRPC can't connect to the server it waits before trying
+// again, -connectbackoff at first, multiplied by -connectmultiplier after
+// each failure up to -connectmaxbackoff.  Each connection attempt gets at
+// least -connecttimeout.
+//
+// The log says how many attempts each greeting took.
+
+// retryServices are the services whose RPCs are retried.  Greeting is safe
+// to repeat.  The health service's Watch is a stream that runs for ever, so
+// a per-try timeout would break it.
+var retryServices = []string{"helloworld.Greeter"}
+
+// maxAttemptsLimit is the most attempts that gRPC allows.  It quietly uses
+// this instead of anything larger.
+const maxAttemptsLimit = 5
+
+// retryPolicy holds the retry and connection backoff settings.
+type retryPolicy struct {
+	maxAttempts       int
+	initialBackoff    time.Duration
+	maxBackoff        time.Duration
+	multiplier        float64
+	codes             []codes.Code
+	tryTimeout        time.Duration
+	connectBackoff    time.Duration
+	connectMaxBackoff time.Duration
+	connectMultiplier float64
+	connectTimeout    time.Duration
+}
+
+// parseCodes parses a comma-separated list of status code names such as
+// UNAVAILABLE,RESOURCE_EXHAUSTED.
+func parseCodes(list string) ([]codes.Code, error) {
+	var result []codes.Code
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if len(name) == 0 {
+			continue
+		}
+		var c codes.Code
+		if err := c.UnmarshalJSON([]byte(`"` + name + `"`)); err != nil {
+			return nil, fmt.Errorf("unknown status code %q - use names such as UNAVAILABLE", name)
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+// check returns an error if the settings can't work.
+func (p *retryPolicy) check() error {
+	if p.maxAttempts < 1 || p.maxAttempts > maxAttemptsLimit {
+		return fmt.Errorf("-maxattempts must be from 1 to %d, not %d", maxAttemptsLimit, p.maxAttempts)
+	}
+	if p.maxAttempts > 1 {
+		if p.initialBackoff <= 0 || p.maxBackoff < p.initialBackoff {
+			return errors.New("-retrybackoff must be more than 0 and no more than -retrymaxbackoff")
+		}
+		if p.multiplier < 1 {
+			return errors.New("-retrymultiplier must be at least 1")
+		}
+		if len(p.codes) == 0 {
+			return errors.New("-retrycodes doesn't give any status codes to retry")
+		}
+		for _, c := range p.codes {
+			if c == codes.OK {
+				return errors.New("-retrycodes can't include OK")
+			}
+		}
+	}
+	if p.tryTimeout < 0 {
+		return errors.New("-trytimeout can't be negative")
+	}
+	if p.connectBackoff <= 0 || p.connectMaxBackoff < p.connectBackoff {
+		return errors.New("-connectbackoff must be more than 0 and no more than -connectmaxbackoff")
+	}
+	if p.connectMultiplier < 1 {
+		return errors.New("-connectmultiplier must be at least 1")
+	}
+	if p.connectTimeout <= 0 {
+		return errors.New("-connecttimeout must be more than 0")
+	}
+	return nil
+}
+
+// retryableCodes returns the status codes to retry.  With -trytimeout an
+// attempt that runs out of time is retried too.
+func (p *retryPolicy) retryableCodes() []codes.Code {
+	result := append([]codes.Code(nil), p.codes...)
+	if p.tryTimeout > 0 {
+		for _, c := range result {
+			if c == codes.DeadlineExceeded {
+				return result
+			}
+		}
+		result = append(result, codes.DeadlineExceeded)
+	}
+	return result
+}
+
+// serviceConfig returns the gRPC service config that holds the retry policy,
+// in JSON.  See https://github.com/grpc/grpc/blob/master/doc/service_config.md.
+func (p *retryPolicy) serviceConfig() string {
+	type name struct {
+		Service string `json:"service"`
+	}
+	type retry struct {
+		MaxAttempts          int          `json:"maxAttempts"`
+		InitialBackoff       string       `json:"initialBackoff"`
+		MaxBackoff           string       `json:"maxBackoff"`
+		BackoffMultiplier    float64      `json:"backoffMultiplier"`
+		RetryableStatusCodes []codes.Code `json:"retryableStatusCodes"`
+	}
+	type methodConfig struct {
+		Name        []name `json:"name"`
+		RetryPolicy *retry `json:"retryPolicy,omitempty"`
+	}
+	mc := methodConfig{}
+	for _, service := range retryServices {
+		mc.Name = append(mc.Name, name{service})
+	}
+	if p.maxAttempts > 1 {
+		mc.RetryPolicy = &retry{
+			MaxAttempts:       p.maxAttempts,
+			InitialBackoff:    seconds(p.initialBackoff),
+			MaxBackoff:        seconds(p.maxBackoff),
+			BackoffMultiplier: p.multiplier,
+			// gRPC takes the codes as numbers as well as names.
+			RetryableStatusCodes: p.retryableCodes(),
+		}
+	}
+	config, _ := json.Marshal(map[string][]methodConfig{"methodConfig": {mc}})
+	return string(config)
+}
+
+// seconds formats a duration as the service config wants it, for example
+// 0.1s.
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%gs", d.Seconds())
+}
+
+// dialOptions returns the dial options that apply the policy.
+func (p *retryPolicy) dialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithDefaultServiceConfig(p.serviceConfig()),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  p.connectBackoff,
+				Multiplier: p.connectMultiplier,
+				Jitter:     backoff.DefaultConfig.Jitter,
+				MaxDelay:   p.connectMaxBackoff,
+			},
+			MinConnectTimeout: p.connectTimeout,
+		}),
+		grpc.WithStatsHandler(&attemptHandler{tryTimeout: p.tryTimeout}),
+	}
+}
+
+// String describes the policy, for the log.
+func (p *retryPolicy) String() string {
+	var b strings.Builder
+	if p.maxAttempts > 1 {
+		var names []string
+		for _, c := range p.retryableCodes() {
+			names = append(names, c.String())
+		}
+		fmt.Fprintf(&b, "up to %d attempts, retrying %s after %v backing off by %g to %v",
+			p.maxAttempts, strings.Join(names, ","), p.initialBackoff, p.multiplier, p.maxBackoff)
+	} else {
+		b.WriteString("no retries")
+	}
+	if p.tryTimeout > 0 {
+		fmt.Fprintf(&b, ", %v per attempt", p.tryTimeout)
+	}
+	fmt.Fprintf(&b, "; reconnect after %v backing off by %g to %v, connect timeout %v",
+		p.connectBackoff, p.connectMultiplier, p.connectMaxBackoff, p.connectTimeout)
+	return b.String()
+}
+
+// attemptsKey is the context key for an RPC's attempt counter.
+type attemptsKey struct{}
+
+// attemptKey is the context key for an attempt's state.
+type attemptKey struct{}
+
+// attempt is the state of one attempt at an RPC.
+type attempt struct {
+	transparent bool               // see HandleRPC
+	cancel      context.CancelFunc // cancels the attempt's deadline, if it has one
+}
+
+// withAttempts returns a context for an RPC that counts its attempts, and
+// the counter.
+func withAttempts(ctx context.Context) (context.Context, *int32) {
+	n := new(int32)
+	return context.WithValue(ctx, attemptsKey{}, n), n
+}
+
+// attemptHandler is a stats.Handler that counts the attempts at each RPC and
+// gives each attempt at a retried RPC its own deadline.  gRPC tags and
+// reports each attempt separately, with a context made from the RPC's.
+type attemptHandler struct {
+	tryTimeout time.Duration
+}
+
+func (h *attemptHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	a := &attempt{}
+	if h.tryTimeout > 0 && retried(info.FullMethodName) {
+		ctx, a.cancel = context.WithTimeout(ctx, h.tryTimeout)
+	}
+	return context.WithValue(ctx, attemptKey{}, a)
+}
+
+func (h *attemptHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	a, ok := ctx.Value(attemptKey{}).(*attempt)
+	if !ok {
+		return
+	}
+	switch s := s.(type) {
+	case *stats.Begin:
+		// When an attempt never got as far as the server, gRPC tries again
+		// at once without counting it against -maxattempts.
+		a.transparent = s.IsTransparentRetryAttempt
+	case *stats.End:
+		if a.cancel != nil {
+			a.cancel()
+		}
+		// Attempts are counted as they end rather than as they begin.  When
+		// an attempt fails before it reaches a connection, gRPC sometimes
+		// begins one and then throws it away without ending it.
+		if n, ok := ctx.Value(attemptsKey{}).(*int32); ok && !a.transparent {
+			atomic.AddInt32(n, 1)
+		}
+	}
+}
+
+func (h *attemptHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *attemptHandler) HandleConn(ctx context.Context, s stats.ConnStats) {}
+
+// retried says whether an RPC is covered by the retry policy.  method is
+// the full method name, /service/method.
+func retried(method string) bool {
+	for _, service := range retryServices {
+		if strings.HasPrefix(method, "/"+service+"/") {
+			return true
+		}
+	}
+	return false
+}
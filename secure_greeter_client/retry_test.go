@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/goblimey/grpc/helloworld"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// flakyGreeter fails the first few greetings, or makes them slow.
+type flakyGreeter struct {
+	failures int32         // fail this many greetings with UNAVAILABLE
+	slow     int32         // then make this many take a second
+	calls    int32         // greetings so far
+	delay    time.Duration // how slow a slow greeting is
+}
+
+func (g *flakyGreeter) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	n := atomic.AddInt32(&g.calls, 1)
+	if n <= g.failures {
+		return nil, status.Error(codes.Unavailable, "try again")
+	}
+	if n <= g.failures+g.slow {
+		select {
+		case <-time.After(g.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &pb.HelloReply{Message: "Hello " + in.Name}, nil
+}
+
+// testPolicy returns a policy with short backoffs.
+func testPolicy() *retryPolicy {
+	return &retryPolicy{
+		maxAttempts:       3,
+		initialBackoff:    10 * time.Millisecond,
+		maxBackoff:        50 * time.Millisecond,
+		multiplier:        2,
+		codes:             []codes.Code{codes.Unavailable},
+		connectBackoff:    time.Second,
+		connectMaxBackoff: time.Minute,
+		connectMultiplier: 1.6,
+		connectTimeout:    time.Second,
+	}
+}
+
+func TestRetryCheck(t *testing.T) {
+	if err := testPolicy().check(); err != nil {
+		t.Fatal(err)
+	}
+	bad := []func(p *retryPolicy){
+		func(p *retryPolicy) { p.maxAttempts = 0 },
+		func(p *retryPolicy) { p.maxAttempts = 6 },
+		func(p *retryPolicy) { p.initialBackoff = 0 },
+		func(p *retryPolicy) { p.maxBackoff = time.Millisecond },
+		func(p *retryPolicy) { p.multiplier = 0.5 },
+		func(p *retryPolicy) { p.codes = nil },
+		func(p *retryPolicy) { p.codes = []codes.Code{codes.OK} },
+		func(p *retryPolicy) { p.tryTimeout = -time.Second },
+		func(p *retryPolicy) { p.connectMaxBackoff = time.Millisecond },
+		func(p *retryPolicy) { p.connectTimeout = 0 },
+	}
+	for i, change := range bad {
+		p := testPolicy()
+		change(p)
+		if err := p.check(); err == nil {
+			t.Errorf("%d: expected an error for %+v", i, p)
+		}
+	}
+
+	// With one attempt the retry settings don't matter.
+	p := testPolicy()
+	p.maxAttempts = 1
+	p.codes = nil
+	if err := p.check(); err != nil {
+		t.Errorf("one attempt: %v", err)
+	}
+
+	got, err := parseCodes("unavailable, RESOURCE_EXHAUSTED")
+	if err != nil || len(got) != 2 || got[0] != codes.Unavailable || got[1] != codes.ResourceExhausted {
+		t.Errorf("want Unavailable and ResourceExhausted, got %v %v", got, err)
+	}
+	if _, err := parseCodes("UNAVAILABLE,NOPE"); err == nil {
+		t.Error("expected an error for an unknown code")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var tests = []struct {
+		name         string
+		greeter      *flakyGreeter
+		change       func(p *retryPolicy)
+		wantCode     codes.Code
+		wantAttempts int
+	}{
+		{"no failures", &flakyGreeter{}, nil, codes.OK, 1},
+		{"one failure", &flakyGreeter{failures: 1}, nil, codes.OK, 2},
+		{"too many failures", &flakyGreeter{failures: 5}, nil, codes.Unavailable, 3},
+		{"retries off", &flakyGreeter{failures: 1}, func(p *retryPolicy) { p.maxAttempts = 1 }, codes.Unavailable, 1},
+		{"slow attempt", &flakyGreeter{slow: 1, delay: 5 * time.Second},
+			func(p *retryPolicy) { p.tryTimeout = 200 * time.Millisecond }, codes.OK, 2},
+	}
+	for _, test := range tests {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := grpc.NewServer()
+		pb.RegisterGreeterServer(s, test.greeter)
+		go s.Serve(lis)
+
+		p := testPolicy()
+		if test.change != nil {
+			test.change(p)
+		}
+		opts := append(p.dialOptions(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		conn, err := grpc.NewClient(lis.Addr().String(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, attempts, err := greet(pb.NewGreeterClient(conn), "test")
+		if status.Code(err) != test.wantCode {
+			t.Errorf("%s: want %v, got %v", test.name, test.wantCode, err)
+		}
+		if attempts != test.wantAttempts {
+			t.Errorf("%s: want %d attempts, got %d", test.name, test.wantAttempts, attempts)
+		}
+		conn.Close()
+		s.Stop()
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/goblimey/grpc/keypair"
+)
+
+// loadRoots builds the pool of CA certificates that the server's certificate
+// is checked against.
+//
+// paths is a list of CA bundle files and directories.  A bundle is a PEM file
+// holding one or more certificates.  For a directory, every .crt, .pem and
+// .cer file in it is loaded.  If useSystem is true the bundles are added to
+// the system's trusted roots, otherwise they're the only roots.  With no paths
+// the system roots are always used.
+//
+// A bundle that doesn't contain any usable certificates is an error - it's
+// almost certainly the wrong file, and quietly ignoring it would give an empty
+// pool and a baffling handshake failure later.
+func loadRoots(paths []string, useSystem bool) (*x509.CertPool, int, error) {
+	var pool *x509.CertPool
+	if useSystem || len(paths) == 0 {
+		var err error
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			if len(paths) == 0 {
+				return nil, 0, fmt.Errorf("cannot load the system's trusted roots - %v.  "+
+					"Give a CA bundle with -certfile", err)
+			}
+			pool = x509.NewCertPool()
+		}
+	} else {
+		pool = x509.NewCertPool()
+	}
+
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot open CA bundle %s - %v", path, err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		dirFiles, err := bundlesInDir(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(dirFiles) == 0 {
+			return nil, 0, fmt.Errorf("CA directory %s contains no .crt, .pem or .cer files", path)
+		}
+		files = append(files, dirFiles...)
+	}
+
+	count := 0
+	for _, file := range files {
+		certs, err := keypair.ReadCertificates(file)
+		if err != nil {
+			return nil, 0, fmt.Errorf("bad CA bundle - %v", err)
+		}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+		count += len(certs)
+	}
+	return pool, count, nil
+}
+
+// bundlesInDir returns the CA bundle files in a directory, sorted by name.
+func bundlesInDir(dir string) ([]string, error) {
+	var files []string
+	for _, pattern := range []string{"*.crt", "*.pem", "*.cer"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// requireStaple checks that the server stapled a valid OCSP response to its
+// certificate - that is, a response signed by the certificate's issuer (or a
+// responder that the issuer has delegated to) saying that the certificate
+// hasn't been revoked.  It's used as tls.Config.VerifyConnection when the
+// client is run with -requirestaple.  It's called after verifyServer has
+// checked the certificate itself.
+//
+// The issuer must be one of the certificates that the server sends, which is
+// normal for certificates from public CAs.
+func requireStaple(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("the server did not present a certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	if len(cs.OCSPResponse) == 0 {
+		return fmt.Errorf("the server did not staple an OCSP response to its certificate for %s "+
+			"(-requirestaple)", describeCert(leaf))
+	}
+
+	var issuer *x509.Certificate
+	for _, cert := range cs.PeerCertificates[1:] {
+		if leaf.CheckSignatureFrom(cert) == nil {
+			issuer = cert
+			break
+		}
+	}
+	if issuer == nil {
+		return errors.New("cannot check the stapled OCSP response - the server did not send " +
+			"the certificate of its issuer")
+	}
+
+	resp, err := ocsp.ParseResponseForCert(cs.OCSPResponse, leaf, issuer)
+	if err != nil {
+		return fmt.Errorf("the stapled OCSP response is not valid - %v", err)
+	}
+	now := time.Now()
+	if !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate) {
+		return fmt.Errorf("the stapled OCSP response is out of date - it expired at %s",
+			resp.NextUpdate.Format(time.RFC3339))
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("the server certificate for %s was revoked at %s",
+			describeCert(leaf), resp.RevokedAt.Format(time.RFC3339))
+	default:
+		return errors.New("the stapled OCSP response says the certificate's status is unknown")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// verifyServer returns a function that checks the certificates that the server
+// presents during the TLS handshake.  It's used as
+// tls.Config.VerifyPeerCertificate.
+//
+// The checks are the same as the ones that the TLS package does by default -
+// the certificate must be signed by one of the roots and must be valid for
+// serverName - but when the name check fails, the error lists the names that
+// the certificate IS valid for.  The default error only gives one kind (DNS
+// names or IP addresses, depending on what we asked for), which makes it hard
+// to work out what -servername should be.
+//
+// serverName is the name that we expect the certificate to carry.  It's the
+// -servername option if that's given, otherwise the -server option, so it
+// can be an IP address.
+//
+// If pins is not empty, the public key of one of the certificates in the
+// chain must also match one of the pins.  If roots is nil the chain isn't
+// checked at all and the pin must match the server's own certificate - see
+// pin.go.  The certificate must still be within its validity period.
+func verifyServer(roots *x509.CertPool, serverName string, pins pinSet) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("the server did not present a certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("cannot parse the server certificate - %v", err)
+			}
+			certs[i] = cert
+		}
+		leaf := certs[0]
+
+		// The certificates that a pin may match.  Without a verified chain
+		// that's only the leaf - anybody can send a copy of some other
+		// certificate along with theirs.
+		candidates := []*x509.Certificate{leaf}
+
+		if roots != nil {
+			opts := x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			chains, err := leaf.Verify(opts)
+			if err != nil {
+				return fmt.Errorf("cannot verify the server certificate for %s - %v",
+					describeCert(leaf), err)
+			}
+			candidates = nil
+			for _, chain := range chains {
+				candidates = append(candidates, chain...)
+			}
+		} else {
+			// Verify checks the validity period along with the chain, so
+			// without a chain we must check it ourselves.  Otherwise a pinned
+			// certificate would be accepted for ever.
+			now := time.Now()
+			if now.After(leaf.NotAfter) {
+				return fmt.Errorf("the server certificate for %s expired at %s",
+					describeCert(leaf), leaf.NotAfter.Format(time.RFC3339))
+			}
+			if now.Before(leaf.NotBefore) {
+				return fmt.Errorf("the server certificate for %s is not valid until %s",
+					describeCert(leaf), leaf.NotBefore.Format(time.RFC3339))
+			}
+		}
+
+		if err := leaf.VerifyHostname(serverName); err != nil {
+			return nameMismatchError(leaf, serverName)
+		}
+
+		if len(pins) > 0 && !pins.matchesAny(candidates) {
+			return fmt.Errorf("the server certificate for %s does not match any of the pins - "+
+				"its pin is %s", describeCert(leaf), formatPin(spkiPin(leaf)))
+		}
+		return nil
+	}
+}
+
+// warnExpiry wraps a VerifyPeerCertificate function and, if the server's
+// certificate passes the checks but expires within the given time, logs a
+// warning so that somebody can get it renewed before it stops the client
+// working.
+func warnExpiry(verify func([][]byte, [][]*x509.Certificate) error,
+	within time.Duration) func([][]byte, [][]*x509.Certificate) error {
+
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if err := verify(rawCerts, chains); err != nil {
+			return err
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return nil
+		}
+		if left := time.Until(leaf.NotAfter); left < within {
+			slog.Warn(fmt.Sprintf("the server certificate for %s expires in %d days - "+
+				"ask the server's administrator to renew it", describeCert(leaf), int(left.Hours()/24)),
+				"expires", leaf.NotAfter)
+		}
+		return nil
+	}
+}
+
+// nameMismatchError returns an error explaining that cert isn't valid for
+// serverName, listing the names that it is valid for.
+func nameMismatchError(cert *x509.Certificate, serverName string) error {
+	sans := certSANs(cert)
+	if len(sans) == 0 {
+		return fmt.Errorf("the server certificate is not valid for %q - it has no subject "+
+			"alternative names, only the common name %q, which is no longer checked.  "+
+			"Create a new certificate with the server's names as SANs",
+			serverName, cert.Subject.CommonName)
+	}
+	return fmt.Errorf("the server certificate is not valid for %q - it is valid for %s.  "+
+		"Connect using one of those names or give one of them with -servername",
+		serverName, strings.Join(sans, ", "))
+}
+
+// certSANs returns the DNS and IP subject alternative names in a certificate.
+func certSANs(cert *x509.Certificate) []string {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+// describeCert returns a short description of a certificate for error
+// messages.
+func describeCert(cert *x509.Certificate) string {
+	sans := certSANs(cert)
+	if len(sans) == 0 {
+		return fmt.Sprintf("%q", cert.Subject.CommonName)
+	}
+	return strings.Join(sans, ", ")
+}
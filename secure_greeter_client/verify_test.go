@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a self-signed certificate valid for the given DNS names
+// and IP addresses.
+func selfSigned(t *testing.T, hosts ...string) *x509.Certificate {
+	cert, _ := selfSignedWithKey(t, hosts...)
+	return cert
+}
+
+// selfSignedWithKey is selfSigned, also returning the private key.
+func selfSignedWithKey(t *testing.T, hosts ...string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return selfSignedBetween(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), hosts...)
+}
+
+// selfSignedBetween is selfSignedWithKey with the given validity period.
+func selfSignedBetween(t *testing.T, notBefore, notAfter time.Time, hosts ...string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestVerifyServer(t *testing.T) {
+	cert := selfSigned(t, "mydomain.com", "10.1.2.3")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	raw := [][]byte{cert.Raw}
+
+	for _, name := range []string{"mydomain.com", "10.1.2.3"} {
+		if err := verifyServer(roots, name, nil)(raw, nil); err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+
+	err := verifyServer(roots, "localhost", nil)(raw, nil)
+	if err == nil {
+		t.Fatal("expected an error for localhost")
+	}
+	if !strings.Contains(err.Error(), "mydomain.com, 10.1.2.3") {
+		t.Errorf("error doesn't list the certificate's names: %v", err)
+	}
+
+	// A certificate that isn't signed by one of the roots is refused.
+	err = verifyServer(x509.NewCertPool(), "mydomain.com", nil)(raw, nil)
+	if err == nil {
+		t.Error("expected an error for an untrusted certificate")
+	}
+}
+
+func TestVerifyServerPins(t *testing.T) {
+	cert := selfSigned(t, "mydomain.com")
+	other := selfSigned(t, "other.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	raw := [][]byte{cert.Raw}
+
+	goodPins, err := loadPins([]string{formatPin(spkiPin(other)), formatPin(spkiPin(cert))}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	badPins, err := loadPins([]string{formatPin(spkiPin(other))}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pin is checked along with the CA ...
+	if err := verifyServer(roots, "mydomain.com", goodPins)(raw, nil); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := verifyServer(roots, "mydomain.com", badPins)(raw, nil); err == nil {
+		t.Error("expected an error for a certificate that matches no pin")
+	}
+
+	// ... or instead of it.
+	if err := verifyServer(nil, "mydomain.com", goodPins)(raw, nil); err != nil {
+		t.Errorf("pin only: unexpected error %v", err)
+	}
+	if err := verifyServer(nil, "mydomain.com", badPins)(raw, nil); err == nil {
+		t.Error("pin only: expected an error for a certificate that matches no pin")
+	}
+
+	// Pin only, a copy of the pinned certificate sent along with some other
+	// certificate doesn't count.
+	raw = [][]byte{other.Raw, cert.Raw}
+	certPin := pinSet{spkiPin(cert): true}
+	if err := verifyServer(nil, "other.com", certPin)(raw, nil); err == nil {
+		t.Error("pin only: expected an error when only a chain certificate matches")
+	}
+}
+
+func TestVerifyServerPinOnlyValidity(t *testing.T) {
+	now := time.Now()
+	expired, _ := selfSignedBetween(t, now.Add(-2*time.Hour), now.Add(-time.Hour), "mydomain.com")
+	early, _ := selfSignedBetween(t, now.Add(time.Hour), now.Add(2*time.Hour), "mydomain.com")
+	for _, cert := range []*x509.Certificate{expired, early} {
+		pins := pinSet{spkiPin(cert): true}
+		err := verifyServer(nil, "mydomain.com", pins)([][]byte{cert.Raw}, nil)
+		if err == nil {
+			t.Errorf("pin only: a certificate valid from %v to %v was accepted", cert.NotBefore, cert.NotAfter)
+		}
+	}
+}
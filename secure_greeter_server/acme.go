@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME mode.  Instead of reading its certificate from files, the server can get
+// one from a certificate authority that supports the ACME protocol, such as
+// Let's Encrypt, and renew it automatically before it expires:
+//
+//     secure_greeter_server -p 443 -acmedomains=mydomain.com -acmeemail=me@mydomain.com
+//
+// The CA has to check that we control the domain.  It does that by connecting
+// to the domain and asking for a challenge response, either over TLS on port
+// 443 (TLS-ALPN-01, which the gRPC port answers if it's 443) or over HTTP on
+// port 80 (HTTP-01, which needs -acmehttp=:80).  Behind a firewall or NAT you
+// need to forward one of those ports to this server.
+//
+// The ACME account key and the certificates are kept in -acmecache, so they
+// survive a restart.  Keep that directory private - it holds private keys.
+//
+// To test against a local ACME server such as Pebble
+// (https://github.com/letsencrypt/pebble), give its directory URL with -acmedir
+// and its root certificate with -acmeca, and configure Pebble's validation
+// ports to match the server's.
+
+// acmeCertSource gets certificates using ACME.
+type acmeCertSource struct {
+	manager *autocert.Manager
+	domains []string
+
+	mu     sync.Mutex
+	leaves map[string]*x509.Certificate // the latest certificate for each set of names
+}
+
+// newACMECertSource creates an acmeCertSource for the given domains.  dirURL
+// is the CA's ACME directory URL and cacheDir is where the account key and
+// certificates are kept.  If caFile is not empty, the ACME directory's HTTPS
+// certificate is checked against the CA certificates in it rather than the
+// system roots.
+func newACMECertSource(domains []string, dirURL, cacheDir, email, caFile string) (*acmeCertSource, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("ACME mode needs at least one domain")
+	}
+
+	client := &acme.Client{DirectoryURL: dirURL}
+	if len(caFile) > 0 {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = &http.Client{
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      email,
+		Client:     client,
+	}
+	return &acmeCertSource{manager: m, domains: domains}, nil
+}
+
+// GetCertificate returns the certificate for a handshake, fetching or renewing
+// it if necessary.  It also answers TLS-ALPN-01 challenges.  It has the
+// signature of tls.Config.GetCertificate.
+//
+// A client that connects by IP address doesn't send a server name, and the
+// manager refuses to guess, so we use the first domain.
+func (a *acmeCertSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(hello.ServerName) == 0 {
+		withName := *hello
+		withName.ServerName = a.domains[0]
+		hello = &withName
+	}
+	cert, err := a.manager.GetCertificate(hello)
+	if err != nil {
+		return nil, err
+	}
+	if !isChallenge(hello) {
+		a.noteExpiry(cert)
+	}
+	return cert, nil
+}
+
+// isChallenge says whether a handshake is the CA checking a TLS-ALPN-01
+// challenge.  It offers acme-tls/1 and nothing else, and gets a short-lived
+// challenge certificate rather than ours.  This is the test that autocert
+// uses.
+func isChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// noteExpiry records the certificate, logging it when it's new or renewed.
+func (a *acmeCertSource) noteExpiry(cert *tls.Certificate) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return
+		}
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.leaves == nil {
+		a.leaves = make(map[string]*x509.Certificate)
+	}
+	key := strings.Join(certNames(leaf), ",")
+	if old, ok := a.leaves[key]; !ok || !old.NotAfter.Equal(leaf.NotAfter) {
+		slog.Info("ACME certificate", "names", certNames(leaf), "expires", leaf.NotAfter)
+	}
+	a.leaves[key] = leaf
+}
+
+// NotAfter returns the time that the earliest of the certificates used so far
+// expires, or the zero time if we haven't got one yet.
+func (a *acmeCertSource) NotAfter() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var earliest time.Time
+	for _, leaf := range a.leaves {
+		if earliest.IsZero() || leaf.NotAfter.Before(earliest) {
+			earliest = leaf.NotAfter
+		}
+	}
+	return earliest
+}
+
+// Leaves returns the certificates that have been used so far.
+func (a *acmeCertSource) Leaves() []*x509.Certificate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var leaves []*x509.Certificate
+	for _, leaf := range a.leaves {
+		leaves = append(leaves, leaf)
+	}
+	return leaves
+}
+
+// prefetch gets the certificates for all the domains straight away rather
+// than waiting for the first client, so that a problem with the ACME setup is
+// logged at startup.  The manager chooses between an ECDSA and an RSA
+// certificate depending on what the client hello says it supports, so we
+// pretend to be a modern client and get the ECDSA one that most clients will
+// want.
+func (a *acmeCertSource) prefetch() {
+	for _, domain := range a.domains {
+		hello := &tls.ClientHelloInfo{
+			ServerName:       domain,
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+		if _, err := a.GetCertificate(hello); err != nil {
+			slog.Error("cannot get an ACME certificate", "domain", domain, "error", err)
+		}
+	}
+}
+
+// serveHTTPChallenges answers HTTP-01 challenges on addr.  Any other request
+// is redirected to HTTPS.  It runs until the listener fails, so it should be
+// started as a goroutine.
+func (a *acmeCertSource) serveHTTPChallenges(addr string) {
+	slog.Info("answering ACME HTTP-01 challenges", "addr", addr)
+	if err := http.ListenAndServe(addr, a.manager.HTTPHandler(nil)); err != nil {
+		slog.Error("ACME HTTP-01 listener failed", "addr", addr, "error", err)
+	}
+}
+
+// nextProtos returns the ALPN protocols that the TLS config must offer.  gRPC
+// adds h2 itself, but the TLS-ALPN-01 challenge needs acme-tls/1 as well.
+func (a *acmeCertSource) nextProtos() []string {
+	return []string{"h2", acme.ALPNProto}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestACMEExpiry(t *testing.T) {
+	a := &acmeCertSource{}
+	if !a.NotAfter().IsZero() {
+		t.Errorf("want the zero time before any certificate, got %v", a.NotAfter())
+	}
+
+	now := time.Now()
+	cert := func(name string, validFor time.Duration) *tls.Certificate {
+		return &tls.Certificate{Leaf: &x509.Certificate{DNSNames: []string{name}, NotAfter: now.Add(validFor)}}
+	}
+	a.noteExpiry(cert("a.example.com", 60*24*time.Hour))
+	a.noteExpiry(cert("b.example.com", 30*24*time.Hour))
+	a.noteExpiry(cert("a.example.com", 60*24*time.Hour))
+
+	// The earliest expiry, whichever certificate was used last.
+	if got := a.NotAfter(); !got.Equal(now.Add(30 * 24 * time.Hour)) {
+		t.Errorf("want b.example.com's expiry, got %v", got)
+	}
+	if n := len(a.Leaves()); n != 2 {
+		t.Errorf("want 2 leaves, got %d", n)
+	}
+
+	if !isChallenge(&tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}}) {
+		t.Error("a TLS-ALPN-01 challenge wasn't recognised")
+	}
+	for _, protos := range [][]string{nil, {"h2"}, {"h2", acme.ALPNProto}} {
+		if isChallenge(&tls.ClientHelloInfo{SupportedProtos: protos}) {
+			t.Errorf("%v taken for a challenge", protos)
+		}
+	}
+}
+
+// acmeStub is just enough of an ACME CA to test against.  It authorises every
+// order straight away, without any challenges, and signs the CSR with its own
+// CA.
+type acmeStub struct {
+	*httptest.Server
+	ca    *x509.Certificate
+	caKey crypto.Signer
+
+	mu       sync.Mutex
+	validity time.Duration     // how long the certificates it issues last
+	orders   int               // the number of orders so far
+	chains   map[string][]byte // the PEM chain for each certificate URL
+}
+
+func newACMEStub(t *testing.T) *acmeStub {
+	newKey := func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	ca, caKey, err := createCA(t.TempDir(), "ACME stub CA", time.Hour, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &acmeStub{ca: ca, caKey: caKey, validity: time.Hour, chains: make(map[string][]byte)}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *acmeStub) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", time.Now().UnixNano()))
+
+	var payload []byte
+	if r.Method == http.MethodPost {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &jws); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if payload, err = base64.RawURLEncoding.DecodeString(jws.Payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	switch {
+	case r.URL.Path == "/dir":
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+		})
+	case r.URL.Path == "/nonce":
+		w.WriteHeader(http.StatusOK)
+	case r.URL.Path == "/account":
+		w.Header().Set("Location", s.URL+"/account/1")
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case r.URL.Path == "/order":
+		s.orders++
+		w.Header().Set("Location", fmt.Sprintf("%s/order/%d", s.URL, s.orders))
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"status":         "ready",
+			"authorizations": []string{},
+			"finalize":       fmt.Sprintf("%s/finalize/%d", s.URL, s.orders),
+		})
+	case scan(r.URL.Path, "/finalize/%d", &n):
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		if err := json.Unmarshal(payload, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		chain, err := s.issue(req.CSR)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		certURL := fmt.Sprintf("%s/cert/%d", s.URL, n)
+		s.chains[certURL] = chain
+		w.Header().Set("Location", fmt.Sprintf("%s/order/%d", s.URL, n))
+		writeJSON(w, http.StatusOK, map[string]string{"status": "valid", "certificate": certURL})
+	case scan(r.URL.Path, "/cert/%d", &n):
+		chain, ok := s.chains[s.URL+r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(chain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// issue signs a base64url-encoded CSR and returns the PEM chain.
+func (s *acmeStub) issue(b64CSR string) ([]byte, error) {
+	der, err := base64.RawURLEncoding.DecodeString(b64CSR)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(s.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, s.ca, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf})
+	return append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Raw})...), nil
+}
+
+func (s *acmeStub) orderCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.orders
+}
+
+func (s *acmeStub) setValidity(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.validity = d
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func scan(path, format string, n *int) bool {
+	_, err := fmt.Sscanf(path, format, n)
+	return err == nil
+}
+
+// TestACMEIssueAndRenew gets a certificate from the ACME stub, gets it again
+// from the cache after a restart, and then has it renewed.  It trusts the
+// stub's HTTPS certificate through -acmeca, as it would Pebble's.
+func TestACMEIssueAndRenew(t *testing.T) {
+	const domain = "mydomain.test"
+	stub := newACMEStub(t)
+	caFile := filepath.Join(t.TempDir(), "acme-ca.crt")
+	stubCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: stub.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, stubCert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := t.TempDir()
+
+	// A client that supports ECDSA, and doesn't send a server name.
+	hello := &tls.ClientHelloInfo{
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+	getLeaf := func(a *acmeCertSource) *x509.Certificate {
+		cert, err := a.GetCertificate(hello)
+		if err != nil {
+			t.Fatalf("GetCertificate failed - %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf
+	}
+	newSource := func() *acmeCertSource {
+		a, err := newACMECertSource([]string{domain}, stub.URL+"/dir", cacheDir, "", caFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	// Issuance.
+	first := getLeaf(newSource())
+	if err := first.CheckSignatureFrom(stub.ca); err != nil {
+		t.Errorf("the certificate wasn't issued by the stub - %v", err)
+	}
+	if err := first.VerifyHostname(domain); err != nil {
+		t.Error(err)
+	}
+	if n := stub.orderCount(); n != 1 {
+		t.Errorf("want 1 order, got %d", n)
+	}
+
+	// Caching.  A new source with the same cache, as after a restart, uses
+	// the certificate that's there rather than ordering another.
+	a := newSource()
+	if got := getLeaf(a); got.SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Errorf("want the cached certificate %v, got %v", first.SerialNumber, got.SerialNumber)
+	}
+	if n := stub.orderCount(); n != 1 {
+		t.Errorf("the cached certificate wasn't used - want 1 order, got %d", n)
+	}
+	if !a.NotAfter().Equal(first.NotAfter) {
+		t.Errorf("want expiry %v, got %v", first.NotAfter, a.NotAfter())
+	}
+
+	// Renewal.  A source that renews two hours before expiry finds that the
+	// cached certificate, with an hour left, is due and replaces it in the
+	// background.  The replacement lasts long enough not to be due itself.
+	stub.setValidity(4 * time.Hour)
+	a = newSource()
+	a.manager.RenewBefore = 2 * time.Hour
+	getLeaf(a)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		renewed := getLeaf(a)
+		if renewed.SerialNumber.Cmp(first.SerialNumber) != 0 {
+			if !renewed.NotAfter.After(first.NotAfter) {
+				t.Errorf("the renewed certificate expires at %v, no later than the old one", renewed.NotAfter)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the certificate wasn't renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := stub.orderCount(); n != 2 {
+		t.Errorf("want 2 orders, got %d", n)
+	}
+}
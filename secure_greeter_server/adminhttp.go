@@ -0,0 +1,496 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goblimey/grpc/admin"
+	"github.com/goblimey/grpc/settings"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	channelzservice "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// The admin pages.  With -adminaddr the server serves some pages for
+// whoever looks after it, on a separate HTTP listener:
+//
+//	/debug/pprof/  Go's profiler - CPU and memory profiles, goroutine dumps
+//	/channelz/     gRPC's channelz data - the connections that the server
+//	               has, with their streams, messages and keepalives
+//	/config        the running configuration, with secrets hidden
+//	/buildinfo     the version, how it was built and how long it's been up
+//	/metrics       the Prometheus metrics (see metrics.go)
+//	/reload        a POST reloads the configuration (see reload.go)
+//
+// With a client certificate the listener also serves the Admin gRPC service
+// (see admin/admin.proto), whose Reload RPC does the same as /reload.
+// secure_greeter_client's reload command uses it.
+//
+// They give away a lot about the server, so they have their own access
+// policy, separate from the OAUTH tokens that the gRPC service uses.  By
+// default the listener must be on a loopback address, so only someone logged
+// in to the machine can reach it.  With -adminclientca it can listen
+// anywhere, but it uses TLS and the browser must present a client
+// certificate signed by that CA (mutual TLS).  -adminallow can narrow that
+// down to certificates with particular names.
+//
+// /reload and the Reload RPC change how the server runs rather than just
+// looking at it, so they're only offered with mutual TLS, when we know who
+// is asking.  Without it, send the server SIGHUP instead.
+
+// maxAdminSockets is the most connections that the channelz page lists for
+// each server.
+const maxAdminSockets = 1000
+
+// adminPages serves the admin pages.
+type adminPages struct {
+	conf     *settings.Settings
+	channelz channelzpb.ChannelzServer
+	started  time.Time
+
+	// allow holds the client certificate names that may see the pages.  If
+	// it's empty, any certificate that the TLS config accepts will do.
+	allow []string
+
+	// reload reloads the configuration.  It's nil, and neither /reload nor
+	// the Admin service is offered, unless the pages need a client
+	// certificate.
+	reload *reloader
+}
+
+// newAdminPages creates the admin pages.  allow is the -adminallow list.
+func newAdminPages(conf *settings.Settings, allow []string) *adminPages {
+	// The channelz service is meant to be offered over gRPC, but all we need
+	// is its implementation, which we catch as it's registered.
+	var catcher channelzCatcher
+	channelzservice.RegisterChannelzServiceToServer(&catcher)
+	return &adminPages{conf: conf, channelz: catcher.server, started: time.Now(), allow: allow}
+}
+
+// channelzCatcher is a grpc.ServiceRegistrar that keeps the channelz
+// service's implementation.
+type channelzCatcher struct {
+	server channelzpb.ChannelzServer
+}
+
+func (c *channelzCatcher) RegisterService(desc *grpc.ServiceDesc, impl interface{}) {
+	c.server = impl.(channelzpb.ChannelzServer)
+}
+
+// checkAdminAddr checks that the admin listener's address is a loopback
+// address, unless it's protected by mutual TLS.
+func checkAdminAddr(addr string, mutualTLS bool) error {
+	if mutualTLS {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("bad -adminaddr %q - %v", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("-adminaddr %s isn't a loopback address - use localhost, or give -adminclientca "+
+		"so that the admin pages need a client certificate", addr)
+}
+
+// handler returns the handler for all of the pages.
+func (a *adminPages) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", a.index)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/channelz/", a.channelzServers)
+	mux.HandleFunc("/channelz/socket", a.channelzSocket)
+	mux.HandleFunc("/config", a.config)
+	mux.HandleFunc("/buildinfo", a.buildInfo)
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	if a.reload == nil {
+		return a.authorize(mux)
+	}
+	mux.HandleFunc("/reload", a.reloadConfig)
+	rpc := grpc.NewServer()
+	admin.RegisterAdminServer(rpc, adminService{a.reload})
+	return a.authorize(grpcOrHTTP(rpc, mux))
+}
+
+// grpcOrHTTP sends gRPC requests to rpc and the rest to pages.  gRPC needs
+// HTTP/2, which the admin listener offers when it uses TLS.
+func grpcOrHTTP(rpc *grpc.Server, pages http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			rpc.ServeHTTP(w, r)
+			return
+		}
+		pages.ServeHTTP(w, r)
+	})
+}
+
+// authorize refuses requests whose client certificate isn't on the allow
+// list.  The TLS config has already checked that the certificate was signed
+// by the admin CA.
+func (a *adminPages) authorize(next http.Handler) http.Handler {
+	if len(a.allow) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "a client certificate is needed", http.StatusForbidden)
+			return
+		}
+		cert := r.TLS.PeerCertificates[0]
+		if !allowed(cert, a.allow) {
+			slog.Warn("admin page refused", "client_cert", cert.Subject.CommonName,
+				"peer", r.RemoteAddr, "path", r.URL.Path)
+			http.Error(w, "your certificate isn't allowed to see the admin pages", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowed returns true if the certificate's common name or one of its
+// subject alternative names is in allow.
+func allowed(cert *x509.Certificate, allow []string) bool {
+	names := append(certNames(cert), cert.Subject.CommonName)
+	for _, name := range names {
+		for _, a := range allow {
+			if name == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var indexPage = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html><head><title>secure_greeter_server</title></head><body>
+<h1>secure_greeter_server</h1>
+<ul>
+<li><a href="/debug/pprof/">pprof</a> - profiles and goroutine dumps</li>
+<li><a href="/channelz/">channelz</a> - connections and streams</li>
+<li><a href="/config">config</a> - the running configuration</li>
+<li><a href="/buildinfo">buildinfo</a> - version and build</li>
+<li><a href="/metrics">metrics</a> - Prometheus metrics</li>
+{{if .}}<li>POST /reload - reload the configuration</li>{{end}}
+</ul>
+</body></html>
+`))
+
+func (a *adminPages) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	indexPage.Execute(w, a.reload != nil)
+}
+
+// reloadConfig reloads the configuration and shows what changed, and which
+// changes need a restart.  If the new configuration is refused it says why,
+// with status 422.
+func (a *adminPages) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST to reload the configuration", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	report, err := a.reload.reloadAndLog(reloadTrigger("admin page", r.TLS))
+	if err != nil {
+		http.Error(w, "configuration not reloaded - "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	fmt.Fprintln(w, report.String())
+}
+
+// adminService is the Admin gRPC service.
+type adminService struct {
+	reload *reloader
+}
+
+// Reload reloads the configuration and returns what changed, and which
+// changes need a restart.  If the new configuration is refused it fails with
+// FAILED_PRECONDITION, saying why.
+func (s adminService) Reload(ctx context.Context, _ *emptypb.Empty) (*wrapperspb.StringValue, error) {
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	report, err := s.reload.reloadAndLog(reloadTrigger("admin RPC", state))
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "configuration not reloaded - %v", err)
+	}
+	return wrapperspb.String(report.String()), nil
+}
+
+// reloadTrigger describes a reload asked for through the admin listener, for
+// the log, with the name on the client certificate if there is one.
+func reloadTrigger(how string, state *tls.ConnectionState) string {
+	if state != nil && len(state.PeerCertificates) > 0 {
+		return how + " (" + state.PeerCertificates[0].Subject.CommonName + ")"
+	}
+	return how
+}
+
+// config shows the running configuration, as the config print command does.
+// Settings changed by a reload show their new values.
+func (a *adminPages) config(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	a.conf.Print(w)
+}
+
+// buildInfo shows the version and how the server was built.
+func (a *adminPages) buildInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeBuildInfo(w, a.started, time.Now())
+}
+
+// writeBuildInfo writes the build information that Go records in the
+// binary, and the uptime.
+func writeBuildInfo(w io.Writer, started, now time.Time) {
+	fmt.Fprintf(w, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		fmt.Fprintf(w, "path: %s\n", info.Path)
+		fmt.Fprintf(w, "module: %s %s\n", info.Main.Path, info.Main.Version)
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs", "vcs.revision", "vcs.time", "vcs.modified", "GOOS", "GOARCH", "CGO_ENABLED", "-tags":
+				fmt.Fprintf(w, "%s: %s\n", s.Key, s.Value)
+			}
+		}
+	}
+	fmt.Fprintf(w, "started: %s\n", started.Format(time.RFC3339))
+	fmt.Fprintf(w, "uptime: %s\n", now.Sub(started).Round(time.Second))
+	fmt.Fprintf(w, "goroutines: %d\n", runtime.NumGoroutine())
+}
+
+// channelzServer is a gRPC server and its connections, for the channelz
+// page.
+type channelzServer struct {
+	*channelzpb.Server
+	Sockets []*channelzpb.Socket
+}
+
+var channelzFuncs = template.FuncMap{
+	"addr": formatAddress,
+	"time": formatTimestamp,
+	"tls":  formatSecurity,
+}
+
+var channelzPage = template.Must(template.New("channelz").Funcs(channelzFuncs).Parse(`<!DOCTYPE html>
+<html><head><title>channelz</title>
+<style>td, th { padding: 0 0.5em; text-align: left }</style>
+</head><body>
+<h1>channelz</h1>
+{{range .Servers}}
+<h2>Server {{.GetRef.GetServerId}}</h2>
+<p>Calls: {{.GetData.GetCallsStarted}} started, {{.GetData.GetCallsSucceeded}} succeeded,
+{{.GetData.GetCallsFailed}} failed.  Last call started {{time .GetData.GetLastCallStartedTimestamp}}.</p>
+<h3>Connections</h3>
+<table>
+<tr><th>socket</th><th>remote</th><th>TLS</th><th>streams started</th><th>succeeded</th><th>failed</th>
+<th>messages sent</th><th>received</th><th>keepalives sent</th><th>last message received</th></tr>
+{{range .Sockets}}
+<tr><td><a href="/channelz/socket?id={{.GetRef.GetSocketId}}">{{.GetRef.GetSocketId}}</a></td>
+<td>{{addr .Remote}}</td><td>{{tls .Security}}</td>
+<td>{{.GetData.GetStreamsStarted}}</td><td>{{.GetData.GetStreamsSucceeded}}</td><td>{{.GetData.GetStreamsFailed}}</td>
+<td>{{.GetData.GetMessagesSent}}</td><td>{{.GetData.GetMessagesReceived}}</td><td>{{.GetData.GetKeepAlivesSent}}</td>
+<td>{{time .GetData.GetLastMessageReceivedTimestamp}}</td></tr>
+{{else}}
+<tr><td colspan="10">no connections</td></tr>
+{{end}}
+</table>
+{{end}}
+{{if .Channels}}
+<h2>Client channels</h2>
+<table>
+<tr><th>channel</th><th>target</th><th>state</th><th>calls started</th><th>succeeded</th><th>failed</th></tr>
+{{range .Channels}}
+<tr><td>{{.GetRef.GetChannelId}}</td><td>{{.GetData.GetTarget}}</td><td>{{.GetData.GetState.GetState}}</td>
+<td>{{.GetData.GetCallsStarted}}</td><td>{{.GetData.GetCallsSucceeded}}</td><td>{{.GetData.GetCallsFailed}}</td></tr>
+{{end}}
+</table>
+{{end}}
+</body></html>
+`))
+
+// channelzServers lists the gRPC servers, with their connections, and the
+// client channels.
+func (a *adminPages) channelzServers(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/channelz/" {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	servers, err := a.channelz.GetServers(ctx, &channelzpb.GetServersRequest{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var page struct {
+		Servers  []channelzServer
+		Channels []*channelzpb.Channel
+	}
+	for _, s := range servers.GetServer() {
+		sockets, err := a.serverSockets(ctx, s.GetRef().GetServerId())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Servers = append(page.Servers, channelzServer{Server: s, Sockets: sockets})
+	}
+	channels, err := a.channelz.GetTopChannels(ctx, &channelzpb.GetTopChannelsRequest{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Channels = channels.GetChannel()
+	if err := channelzPage.Execute(w, page); err != nil {
+		slog.Error("cannot show the channelz page", "error", err)
+	}
+}
+
+// serverSockets returns a server's connections, up to maxAdminSockets.
+func (a *adminPages) serverSockets(ctx context.Context, serverID int64) ([]*channelzpb.Socket, error) {
+	var sockets []*channelzpb.Socket
+	var start int64
+	for len(sockets) < maxAdminSockets {
+		resp, err := a.channelz.GetServerSockets(ctx,
+			&channelzpb.GetServerSocketsRequest{ServerId: serverID, StartSocketId: start})
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range resp.GetSocketRef() {
+			socket, err := a.channelz.GetSocket(ctx, &channelzpb.GetSocketRequest{SocketId: ref.GetSocketId()})
+			if err != nil {
+				continue // it closed while we were looking
+			}
+			sockets = append(sockets, socket.GetSocket())
+			start = ref.GetSocketId() + 1
+		}
+		if resp.GetEnd() || len(resp.GetSocketRef()) == 0 {
+			break
+		}
+	}
+	return sockets, nil
+}
+
+var socketPage = template.Must(template.New("socket").Funcs(channelzFuncs).Parse(`<!DOCTYPE html>
+<html><head><title>channelz socket {{.GetRef.GetSocketId}}</title>
+<style>td, th { padding: 0 0.5em; text-align: left }</style>
+</head><body>
+<h1>Socket {{.GetRef.GetSocketId}}</h1>
+<p><a href="/channelz/">all connections</a></p>
+<table>
+<tr><th>local</th><td>{{addr .Local}}</td></tr>
+<tr><th>remote</th><td>{{addr .Remote}}</td></tr>
+<tr><th>security</th><td>{{tls .Security}}</td></tr>
+<tr><th>streams</th><td>{{.GetData.GetStreamsStarted}} started, {{.GetData.GetStreamsSucceeded}} succeeded, {{.GetData.GetStreamsFailed}} failed</td></tr>
+<tr><th>messages</th><td>{{.GetData.GetMessagesSent}} sent, {{.GetData.GetMessagesReceived}} received</td></tr>
+<tr><th>keepalives sent</th><td>{{.GetData.GetKeepAlivesSent}}</td></tr>
+<tr><th>last stream created</th><td>by us {{time .GetData.GetLastLocalStreamCreatedTimestamp}}, by the peer {{time .GetData.GetLastRemoteStreamCreatedTimestamp}}</td></tr>
+<tr><th>last message</th><td>sent {{time .GetData.GetLastMessageSentTimestamp}}, received {{time .GetData.GetLastMessageReceivedTimestamp}}</td></tr>
+<tr><th>flow control windows</th><td>local {{.GetData.GetLocalFlowControlWindow.GetValue}}, remote {{.GetData.GetRemoteFlowControlWindow.GetValue}}</td></tr>
+</table>
+</body></html>
+`))
+
+// channelzSocket shows one connection in detail.
+func (a *adminPages) channelzSocket(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "give the socket's id", http.StatusBadRequest)
+		return
+	}
+	resp, err := a.channelz.GetSocket(r.Context(), &channelzpb.GetSocketRequest{SocketId: id})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := socketPage.Execute(w, resp.GetSocket()); err != nil {
+		slog.Error("cannot show the channelz socket page", "error", err)
+	}
+}
+
+// formatAddress formats a channelz address.
+func formatAddress(addr *channelzpb.Address) string {
+	if tcp := addr.GetTcpipAddress(); tcp != nil {
+		return net.JoinHostPort(net.IP(tcp.GetIpAddress()).String(), strconv.Itoa(int(tcp.GetPort())))
+	}
+	if uds := addr.GetUdsAddress(); uds != nil {
+		return uds.GetFilename()
+	}
+	return "-"
+}
+
+// formatTimestamp formats a channelz time, or "never".
+func formatTimestamp(ts *timestamppb.Timestamp) string {
+	if ts == nil || (ts.GetSeconds() == 0 && ts.GetNanos() == 0) {
+		return "never"
+	}
+	return ts.AsTime().Local().Format("2006-01-02 15:04:05")
+}
+
+// formatSecurity describes a connection's security - the cipher suite and
+// the client's certificate, if it sent one.
+func formatSecurity(sec *channelzpb.Security) string {
+	t := sec.GetTls()
+	if t == nil {
+		return "none"
+	}
+	s := t.GetStandardName()
+	if len(s) == 0 {
+		s = "TLS"
+	}
+	if der := t.GetRemoteCertificate(); len(der) > 0 {
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			s += ", client " + cert.Subject.CommonName
+		}
+	}
+	return s
+}
+
+// serveAdmin serves the admin pages on addr.  If tlsConfig isn't nil it uses
+// TLS.  It runs until the listener fails, so it should be started as a
+// goroutine.
+func serveAdmin(addr string, handler http.Handler, tlsConfig *tls.Config) {
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+	var err error
+	if tlsConfig != nil {
+		slog.Info("serving the admin pages", "url", "https://"+addr+"/")
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		slog.Info("serving the admin pages", "url", "http://"+addr+"/")
+		err = server.ListenAndServe()
+	}
+	slog.Error("admin listener failed", "addr", addr, "error", err)
+}
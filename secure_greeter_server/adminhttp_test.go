@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/goblimey/grpc/admin"
+	"github.com/goblimey/grpc/settings"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestCheckAdminAddr(t *testing.T) {
+	var tests = []struct {
+		addr      string
+		mutualTLS bool
+		ok        bool
+	}{
+		{"localhost:9092", false, true},
+		{"127.0.0.1:9092", false, true},
+		{"[::1]:9092", false, true},
+		{":9092", false, false},
+		{"0.0.0.0:9092", false, false},
+		{"mydomain.com:9092", false, false},
+		{":9092", true, true},
+		{"9092", false, false},
+	}
+	for _, test := range tests {
+		err := checkAdminAddr(test.addr, test.mutualTLS)
+		if (err == nil) != test.ok {
+			t.Errorf("%s (mutual TLS %v): want ok %v, got %v", test.addr, test.mutualTLS, test.ok, err)
+		}
+	}
+}
+
+// get fetches an admin page and returns the status code and body.
+func get(h http.Handler, path string, state *tls.ConnectionState) (int, string) {
+	r := httptest.NewRequest("GET", path, nil)
+	r.TLS = state
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code, w.Body.String()
+}
+
+func TestAdminPages(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("greeting", "hello", "")
+	fs.String("token", "", "")
+	conf := settings.New(fs, "TEST_ADMIN_")
+	conf.Secret("token")
+	if err := conf.Parse([]string{"-token", "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	h := newAdminPages(conf, nil).handler()
+
+	// A server with a connection, for channelz.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go s.Serve(lis)
+	defer s.Stop()
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := get(h, "/channelz/", nil)
+	if code != http.StatusOK {
+		t.Fatalf("channelz: want 200, got %d %s", code, body)
+	}
+	// Find our connection, the one whose local address is the server's.
+	var found bool
+	for _, m := range regexp.MustCompile(`socket\?id=(\d+)`).FindAllStringSubmatch(body, -1) {
+		_, socket := get(h, "/channelz/socket?id="+m[1], nil)
+		if strings.Contains(socket, lis.Addr().String()) {
+			found = true
+			if !strings.Contains(socket, "1 started, 1 succeeded, 0 failed") {
+				t.Errorf("want one successful stream, got %s", socket)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("the connection isn't on the channelz page: %s", body)
+	}
+
+	var pages = []struct {
+		path string
+		want []string
+	}{
+		{"/config", []string{`greeting: "hello"`, `token: "<redacted>"`}},
+		{"/buildinfo", []string{"go: go", "uptime: "}},
+		{"/debug/pprof/", []string{"goroutine"}},
+		{"/", []string{`href="/channelz/"`}},
+	}
+	for _, page := range pages {
+		code, body := get(h, page.path, nil)
+		if code != http.StatusOK {
+			t.Errorf("%s: want 200, got %d", page.path, code)
+		}
+		for _, want := range page.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: want %q in %s", page.path, want, body)
+			}
+		}
+		if strings.Contains(body, "abc") {
+			t.Errorf("%s: the secret is shown: %s", page.path, body)
+		}
+	}
+}
+
+func TestAdminAllow(t *testing.T) {
+	h := newAdminPages(nil, []string{"alice"}).handler()
+	state := func(name string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+	if code, _ := get(h, "/buildinfo", state("alice")); code != http.StatusOK {
+		t.Errorf("alice: want 200, got %d", code)
+	}
+	if code, _ := get(h, "/buildinfo", state("bob")); code != http.StatusForbidden {
+		t.Errorf("bob: want 403, got %d", code)
+	}
+	if code, _ := get(h, "/buildinfo", nil); code != http.StatusForbidden {
+		t.Errorf("no certificate: want 403, got %d", code)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "greeter.yaml")
+	write := func(text string) {
+		if err := ioutil.WriteFile(file, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("level: 1\n")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("level", 0, "")
+	conf := settings.New(fs, "TEST_ADMIN_RELOAD_")
+	if err := conf.Parse([]string{"-config", file}); err != nil {
+		t.Fatal(err)
+	}
+	r := &reloader{conf: conf}
+	r.add(func(snap *settings.Snapshot) (func(), error) { return func() {}, nil }, "level")
+	level := func() string { return conf.Current().String("level") }
+
+	// Without mutual TLS there's no reload page.
+	pages := newAdminPages(conf, nil)
+	if code, _ := get(pages.handler(), "/reload", nil); code != http.StatusNotFound {
+		t.Errorf("without a reloader: want 404, got %d", code)
+	}
+
+	pages.reload = r
+	h := pages.handler()
+	post := func() (int, string) {
+		req := httptest.NewRequest("POST", "/reload", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	if code, _ := get(h, "/reload", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: want 405, got %d", code)
+	}
+	write("level: 2\n")
+	if code, body := post(); code != http.StatusOK || !strings.Contains(body, "applied level (1 -> 2)") || level() != "2" {
+		t.Errorf("want level 2 applied, got %d %q and level %s", code, body, level())
+	}
+	write("level: two\n")
+	if code, body := post(); code != http.StatusUnprocessableEntity || !strings.Contains(body, "bad value for level") {
+		t.Errorf("want the bad value refused, got %d %q", code, body)
+	}
+
+	// The Reload RPC does the same through gRPC, which needs the HTTP/2
+	// that the listener offers with TLS.
+	srv := httptest.NewUnstartedServer(h)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	conn, err := grpc.NewClient(srv.Listener.Addr().String(),
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := admin.NewAdminClient(conn)
+
+	write("level: 3\n")
+	report, err := client.Reload(context.Background(), &emptypb.Empty{})
+	if err != nil || !strings.Contains(report.GetValue(), "applied level (2 -> 3)") || level() != "3" {
+		t.Errorf("RPC: want level 3 applied, got %q %v and level %s", report.GetValue(), err, level())
+	}
+	write("level: three\n")
+	_, err = client.Reload(context.Background(), &emptypb.Empty{})
+	if status.Code(err) != codes.FailedPrecondition || !strings.Contains(status.Convert(err).Message(), "bad value for level") {
+		t.Errorf("RPC: want the bad value refused with FAILED_PRECONDITION, got %v", err)
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/goblimey/grpc/keypair"
+	"github.com/goblimey/grpc/settings"
+)
+
+// The certs command creates the certificates and keys needed to run the
+// secure greeter:
+//
+//     secure_greeter_server certs -dir=certs -hosts=mydomain.com,localhost,127.0.0.1 -clients=alice,bob
+//
+// It creates a local certificate authority (ca.crt and ca.key) and uses it to
+// sign a server certificate (server.crt and server.key) and, optionally, a
+// client certificate for each named client (alice.crt and alice.key and so
+// on) for mutual TLS.  If the directory already contains a CA, that's reused,
+// so you can run the command again later to add clients without having to
+// copy a new CA certificate to every client.  Existing certificates are left
+// alone unless -force is given, so to renew the server certificate, run it
+// again with -force (which also replaces the certificates of any clients
+// named by -clients).
+//
+// With -revoke it revokes client certificates instead, adding them to the CA's
+// certificate revocation list, ca.crl.  See revocation.go.
+//
+// Earlier versions of this example told you to create a self-signed
+// certificate using lc-tlscert and to set its common name to the server's
+// name.  That's fragile - modern TLS implementations, including Go's, ignore
+// the common name and only check the subject alternative names (SANs).  The
+// certificates made here carry every name and IP address given by -hosts as
+// SANs, so one certificate can serve mydomain.com and localhost.
+
+const (
+	caCertFile     = "ca.crt"
+	caKeyFile      = "ca.key"
+	caCRLFile      = "ca.crl"
+	serverCertFile = "server.crt"
+	serverKeyFile  = "server.key"
+)
+
+// runCerts implements the certs command.  args are the command line arguments
+// that follow the command name.
+func runCerts(args []string) error {
+	hostname, _ := os.Hostname()
+	defaultHosts := "localhost,127.0.0.1,::1"
+	if len(hostname) > 0 && hostname != "localhost" {
+		defaultHosts = hostname + "," + defaultHosts
+	}
+
+	fs := flag.NewFlagSet("certs", flag.ExitOnError)
+	dir := fs.String("dir", ".", "directory to write the certificates and keys into")
+	hosts := fs.String("hosts", defaultHosts,
+		"comma-separated DNS names and IP addresses that the server certificate is valid for")
+	clients := fs.String("clients", "",
+		"comma-separated names of clients to create mutual TLS certificates for")
+	keyType := fs.String("keytype", "ecdsa", "key type - ecdsa or rsa")
+	rsaBits := fs.Int("rsabits", 2048, "key size for RSA keys")
+	validity := fs.Duration("validity", 365*24*time.Hour,
+		"how long the server and client certificates are valid for")
+	caValidity := fs.Duration("cavalidity", 10*365*24*time.Hour,
+		"how long a new CA certificate is valid for")
+	caName := fs.String("caname", "secure greeter local CA", "common name of a new CA")
+	force := fs.Bool("force", false, "overwrite existing server and client files")
+	revoke := fs.String("revoke", "",
+		"comma-separated names of clients whose certificates should be revoked")
+	reason := fs.String("reason", "unspecified", "revocation reason, for example keyCompromise")
+	updateCRL := fs.Bool("crl", false, "write the CRL again with a new next update time")
+	crlValidity := fs.Duration("crlvalidity", 30*24*time.Hour,
+		"how long a CRL is valid for - write it again with -crl before then")
+	fs.Parse(args)
+
+	if *keyType != "ecdsa" && *keyType != "rsa" {
+		return fmt.Errorf("unknown key type %q - use ecdsa or rsa", *keyType)
+	}
+
+	// Check all the names before anything is written.
+	clientNames := settings.SplitList(*clients)
+	revokeNames := settings.SplitList(*revoke)
+	for _, name := range append(clientNames, revokeNames...) {
+		if err := checkClientName(name); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+
+	newKey := func() (crypto.Signer, error) {
+		if *keyType == "rsa" {
+			return rsa.GenerateKey(rand.Reader, *rsaBits)
+		}
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+
+	// Load the CA if there is one already, otherwise create it.
+	caCert, caKey, err := loadCA(*dir)
+	if err != nil {
+		return err
+	}
+	if caCert == nil {
+		caCert, caKey, err = createCA(*dir, *caName, *caValidity, newKey)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created CA %s\n", filepath.Join(*dir, caCertFile))
+	} else {
+		fmt.Printf("using existing CA %s\n", filepath.Join(*dir, caCertFile))
+	}
+
+	// Revoking certificates or refreshing the CRL is a separate job.
+	if len(*revoke) > 0 || *updateCRL {
+		code, err := reasonCode(*reason)
+		if err != nil {
+			return err
+		}
+		return writeCRL(*dir, revokeNames, code, *crlValidity, caCert, caKey)
+	}
+
+	// Create the server certificate.
+	var dnsNames []string
+	var ips []net.IP
+	for _, h := range settings.SplitList(*hosts) {
+		if ip := net.ParseIP(h); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, h)
+		}
+	}
+	if len(dnsNames) == 0 && len(ips) == 0 {
+		return errors.New("the server certificate needs at least one name - use -hosts")
+	}
+	commonName := ""
+	if len(dnsNames) > 0 {
+		commonName = dnsNames[0]
+	} else {
+		commonName = ips[0].String()
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if fileExists(filepath.Join(*dir, serverCertFile)) && !*force {
+		fmt.Printf("%s already exists - use -force to replace it, for example to renew it\n",
+			filepath.Join(*dir, serverCertFile))
+	} else {
+		err = createLeaf(*dir, serverCertFile, serverKeyFile, template, *validity,
+			caCert, caKey, newKey, *force)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created server certificate %s valid for %s\n",
+			filepath.Join(*dir, serverCertFile), strings.Join(certNames(template), ", "))
+	}
+
+	// Create the client certificates.
+	for _, name := range clientNames {
+		template := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		if fileExists(filepath.Join(*dir, name+".crt")) && !*force {
+			fmt.Printf("%s already exists - use -force to replace it\n",
+				filepath.Join(*dir, name+".crt"))
+			continue
+		}
+		err = createLeaf(*dir, name+".crt", name+".key", template, *validity,
+			caCert, caKey, newKey, *force)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created client certificate %s for %s\n",
+			filepath.Join(*dir, name+".crt"), name)
+	}
+
+	// Tell the user what goes where.
+	fmt.Printf("\nOn the server run:\n\n")
+	fmt.Printf("    secure_greeter_server -certfile=%s -keyfile=%s",
+		filepath.Join(*dir, serverCertFile), filepath.Join(*dir, serverKeyFile))
+	if len(clientNames) > 0 {
+		fmt.Printf(" -clientca=%s", filepath.Join(*dir, caCertFile))
+	}
+	fmt.Printf("\n\nCopy %s to every client machine.", filepath.Join(*dir, caCertFile))
+	fmt.Printf("  Keep %s and %s secret - they never leave this machine.\n",
+		filepath.Join(*dir, caKeyFile), filepath.Join(*dir, serverKeyFile))
+	for _, name := range clientNames {
+		fmt.Printf("\nCopy %s and %s to client %s and run:\n\n", filepath.Join(*dir, name+".crt"),
+			filepath.Join(*dir, name+".key"), name)
+		fmt.Printf("    secure_greeter_client -certfile=%s -clientcert=%s -clientkey=%s\n",
+			filepath.Join(*dir, caCertFile), filepath.Join(*dir, name+".crt"), filepath.Join(*dir, name+".key"))
+	}
+	return nil
+}
+
+// writeCRL adds the certificates of the named clients to the CA's certificate
+// revocation list, ca.crl, creating it if necessary, and signs it again.  The
+// entries already in the list are kept.  Give the list to the server with
+// -crlfile.
+func writeCRL(dir string, clients []string, reason int, validity time.Duration,
+	caCert *x509.Certificate, caKey crypto.Signer) error {
+
+	crlPath := filepath.Join(dir, caCRLFile)
+	var entries []x509.RevocationListEntry
+	number := big.NewInt(1)
+	if fileExists(crlPath) {
+		old, err := loadCRL(crlPath)
+		if err != nil {
+			return err
+		}
+		if err := old.crl.CheckSignatureFrom(caCert); err != nil {
+			return fmt.Errorf("%s was not issued by this CA - %v", crlPath, err)
+		}
+		entries = old.crl.RevokedCertificateEntries
+		if old.crl.Number != nil {
+			number.Add(old.crl.Number, big.NewInt(1))
+		}
+	}
+
+	now := time.Now()
+	for _, name := range clients {
+		certs, err := keypair.ReadCertificates(filepath.Join(dir, name+".crt"))
+		if err != nil {
+			return err
+		}
+		serial := certs[0].SerialNumber
+		already := false
+		for _, entry := range entries {
+			if entry.SerialNumber.Cmp(serial) == 0 {
+				already = true
+			}
+		}
+		if already {
+			fmt.Printf("%s (serial %s) is already revoked\n", name, serial)
+			continue
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: now,
+			ReasonCode:     reason,
+		})
+		fmt.Printf("revoked %s (serial %s), reason %s\n", name, serial, reasonName(reason))
+	}
+
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    number,
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(validity),
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, caCert, caKey)
+	if err != nil {
+		return err
+	}
+	crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	if err := os.WriteFile(crlPath, crlPEM, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s with %d revoked certificate(s), valid until %s\n",
+		crlPath, len(entries), template.NextUpdate.Format(time.RFC3339))
+	fmt.Printf("Run the server with -crlfile=%s - it rereads the file every -crlpoll.\n", crlPath)
+	return nil
+}
+
+// loadCA loads the CA certificate and key from dir.  If neither file exists it
+// returns nils and no error.
+func loadCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return nil, nil, nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot load the existing CA %s - %v", certPath, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse the existing CA %s - %v", certPath, err)
+	}
+	if !cert.IsCA {
+		return nil, nil, fmt.Errorf("%s is not a CA certificate", certPath)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, nil, fmt.Errorf("the CA certificate %s expired at %s",
+			certPath, cert.NotAfter.Format(time.RFC3339))
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("the CA key %s can't be used for signing", keyPath)
+	}
+	return cert, key, nil
+}
+
+// createCA creates a self-signed CA certificate and key and writes them to dir.
+func createCA(dir, name string, validity time.Duration,
+	newKey func() (crypto.Signer, error)) (*x509.Certificate, crypto.Signer, error) {
+
+	key, err := newKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePair(dir, caCertFile, caKeyFile, der, key, false); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// createLeaf fills in the rest of template, creates a certificate from it
+// signed by the CA and writes it and a new key to dir.
+func createLeaf(dir, certName, keyName string, template *x509.Certificate,
+	validity time.Duration, caCert *x509.Certificate, caKey crypto.Signer,
+	newKey func() (crypto.Signer, error), force bool) error {
+
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	template.SerialNumber, err = newSerialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template.NotBefore = now.Add(-5 * time.Minute)
+	template.NotAfter = now.Add(validity)
+	if template.NotAfter.After(caCert.NotAfter) {
+		// A certificate can't outlive the CA that signed it.
+		template.NotAfter = caCert.NotAfter
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template.BasicConstraintsValid = true
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		return err
+	}
+	return writePair(dir, certName, keyName, der, key, force)
+}
+
+// writePair writes a certificate and its key as PEM files.  The key file is
+// only readable by its owner.  Unless force is set, existing files are left
+// alone and an error is returned.
+func writePair(dir, certName, keyName string, der []byte, key crypto.Signer, force bool) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPath := filepath.Join(dir, certName)
+	keyPath := filepath.Join(dir, keyName)
+	if !force {
+		for _, path := range []string{certPath, keyPath} {
+			if fileExists(path) {
+				return fmt.Errorf("%s already exists - use -force to replace it", path)
+			}
+		}
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, certPEM, 0644)
+}
+
+// newSerialNumber returns a random 128-bit certificate serial number.
+func newSerialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
+
+// clientNamePattern matches the names that checkClientName accepts.
+var clientNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// checkClientName returns an error if name can't be used for a client
+// certificate.  The name is used to make the names of the client's files, so
+// it mustn't contain anything, such as a slash, that would put them outside
+// the directory, and it mustn't be the name of the CA's or the server's files,
+// which would be overwritten.  The comparison ignores case because some file
+// systems do.
+func checkClientName(name string) error {
+	if !clientNamePattern.MatchString(name) {
+		return fmt.Errorf("client name %q may only contain letters, digits, '.', '_' and '-'", name)
+	}
+	for _, file := range []string{caCertFile, serverCertFile} {
+		if strings.EqualFold(name+".crt", file) {
+			return fmt.Errorf("%q can't be used as a client name - %s is taken", name, file)
+		}
+	}
+	return nil
+}
+
+// fileExists returns true if something exists at path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
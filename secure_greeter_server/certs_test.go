@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goblimey/grpc/keypair"
+)
+
+func TestCheckClientName(t *testing.T) {
+	var tests = []struct {
+		name string
+		ok   bool
+	}{
+		{"alice", true},
+		{"bob.smith-2_x", true},
+		{"ca", false},
+		{"Server", false},
+		{"../alice", false},
+		{"a/b", false},
+		{"alice bob", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		err := checkClientName(test.name)
+		if test.ok && err != nil {
+			t.Errorf("%q: unexpected error %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%q: expected an error", test.name)
+		}
+	}
+}
+
+func TestRunCertsRefusesBadClientNames(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "certs")
+	if err := runCerts([]string{"-dir", dir, "-hosts", "localhost", "-clients", "alice,../evil"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	// Nothing should have been written, inside the directory or out of it.
+	for _, path := range []string{dir, filepath.Join(parent, "evil.crt")} {
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("%s was created", path)
+		}
+	}
+}
+
+// TestRunCertsRoundTrip creates a CA, a server certificate and a client
+// certificate with each key type and checks what's in them.
+func TestRunCertsRoundTrip(t *testing.T) {
+	for _, keyType := range []string{"ecdsa", "rsa"} {
+		dir := t.TempDir()
+		err := runCerts([]string{"-dir", dir, "-hosts", "mydomain.com,localhost,127.0.0.1",
+			"-clients", "alice", "-keytype", keyType})
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		read := func(name string) *x509.Certificate {
+			certs, err := keypair.ReadCertificates(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatalf("%s: %v", keyType, err)
+			}
+			return certs[0]
+		}
+		ca, server, alice := read(caCertFile), read(serverCertFile), read("alice.crt")
+
+		if len(server.DNSNames) != 2 || server.DNSNames[0] != "mydomain.com" || server.DNSNames[1] != "localhost" ||
+			len(server.IPAddresses) != 1 || !server.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("%s: unexpected SANs %v %v", keyType, server.DNSNames, server.IPAddresses)
+		}
+		for _, cert := range []*x509.Certificate{server, alice} {
+			var ok bool
+			switch keyType {
+			case "ecdsa":
+				_, ok = cert.PublicKey.(*ecdsa.PublicKey)
+			case "rsa":
+				_, ok = cert.PublicKey.(*rsa.PublicKey)
+			}
+			if !ok {
+				t.Errorf("%s: %s has a %T key", keyType, cert.Subject.CommonName, cert.PublicKey)
+			}
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		for _, name := range []string{"mydomain.com", "localhost", "127.0.0.1"} {
+			_, err := server.Verify(x509.VerifyOptions{Roots: roots, DNSName: name,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+			if err != nil {
+				t.Errorf("%s: the server certificate doesn't verify for %s - %v", keyType, name, err)
+			}
+		}
+		_, err = alice.Verify(x509.VerifyOptions{Roots: roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+		if err != nil {
+			t.Errorf("%s: the client certificate doesn't verify - %v", keyType, err)
+		}
+		if len(alice.ExtKeyUsage) != 1 || alice.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+			t.Errorf("%s: want only client auth, got %v", keyType, alice.ExtKeyUsage)
+		}
+		if _, err := loadKeyPair(filepath.Join(dir, "alice.crt"), filepath.Join(dir, "alice.key")); err != nil {
+			t.Errorf("%s: %v", keyType, err)
+		}
+	}
+}
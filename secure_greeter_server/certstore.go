@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goblimey/grpc/keypair"
+)
+
+// maxUnknownNames is the number of unknown server names that a certStore
+// remembers.
+const maxUnknownNames = 1000
+
+// certStore holds several certificates and chooses between them using the
+// server name that the client sends in its TLS hello (Server Name Indication,
+// or SNI).  That allows one server to answer to, say, mydomain.com and
+// localhost using a different certificate for each.
+//
+// Each certificate is held by its own certWatcher, so each is reloaded
+// independently when its files change.  If the client doesn't send a server
+// name (for example because it connected using an IP address) or sends one
+// that none of the certificates is valid for, the store falls back to the
+// default certificate.
+type certStore struct {
+	watchers []*certWatcher
+	fallback *certWatcher
+
+	mu      sync.Mutex
+	unknown map[string]bool // server names we've already complained about
+}
+
+// pairList is a flag.Value holding a list of cert and key file pairs, each
+// given as "certfile:keyfile", or PKCS#12 bundles.  The flag can be given more
+// than once.
+type pairList []string
+
+func (p *pairList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pairList) Set(value string) error {
+	if !strings.Contains(value, ":") && !keypair.IsPKCS12(value) {
+		return fmt.Errorf("%q should be certfile:keyfile or a PKCS#12 bundle", value)
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+// Items returns the pairs given, for the settings package.
+func (p *pairList) Items() []string {
+	return *p
+}
+
+// Reset removes the pairs given, for the settings package.
+func (p *pairList) Reset() {
+	*p = nil
+}
+
+// newCertStore creates a certStore.  The first pair is the default.  It's
+// followed by any pairs in pairs and then by any pairs found in dir.  An error
+// is returned if any of the pairs can't be loaded or if there are no pairs at
+// all.
+func newCertStore(certfile, keyfile string, pairs []string, dir string) (*certStore, error) {
+	s := &certStore{unknown: make(map[string]bool)}
+
+	if len(certfile) > 0 || len(keyfile) > 0 {
+		if len(certfile) == 0 || (len(keyfile) == 0 && !keypair.IsPKCS12(certfile)) {
+			return nil, errors.New("you must specify the cert file and the key file")
+		}
+		if err := s.add(certfile, keyfile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, pair := range pairs {
+		certfile, keyfile := pair, ""
+		if i := strings.LastIndex(pair, ":"); i >= 0 {
+			certfile, keyfile = pair[:i], pair[i+1:]
+		}
+		if err := s.add(certfile, keyfile); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(dir) > 0 {
+		if err := s.addDir(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.watchers) == 0 {
+		return nil, errors.New("you must specify the cert file and the key file")
+	}
+	s.fallback = s.watchers[0]
+	return s, nil
+}
+
+// add loads a cert and key file pair into the store.
+func (s *certStore) add(certfile, keyfile string) error {
+	w, err := newCertWatcher(certfile, keyfile)
+	if err != nil {
+		return err
+	}
+	s.watchers = append(s.watchers, w)
+	return nil
+}
+
+// addDir loads every pair in dir.  A pair is a file name.crt with a matching
+// name.key, or a PKCS#12 bundle name.p12 or name.pfx.  CA certificates, such
+// as the ca.crt that the certs command creates, are skipped, as are client
+// certificates (those that can't be used for server authentication) and .crt
+// files with no matching key.  Each pair is loaded once and handed to its
+// watcher.
+func (s *certStore) addDir(dir string) error {
+	var certfiles []string
+	for _, pattern := range []string{"*.crt", "*.p12", "*.pfx"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		certfiles = append(certfiles, matches...)
+	}
+	sort.Strings(certfiles)
+	for _, certfile := range certfiles {
+		keyfile := certfile
+		if !keypair.IsPKCS12(certfile) {
+			keyfile = strings.TrimSuffix(certfile, ".crt") + ".key"
+			if _, err := os.Stat(keyfile); err != nil {
+				slog.Warn("certificate has no matching key file - skipping it",
+					"certfile", certfile, "keyfile", keyfile)
+				continue
+			}
+		}
+		w := &certWatcher{certfile: certfile, keyfile: keyfile}
+		cert, certMod, keyMod, err := w.load()
+		if err != nil {
+			return err
+		}
+		if cert.Leaf.IsCA {
+			continue
+		}
+		if !forServers(cert.Leaf) {
+			slog.Info("certificate is not for a server - skipping it", "certfile", certfile)
+			continue
+		}
+		w.install(cert, certMod, keyMod)
+		s.watchers = append(s.watchers, w)
+	}
+	return nil
+}
+
+// forServers returns true if the certificate may be used by a TLS server.
+// The certs command creates client certificates in the same directory as the
+// server's, and those are only for client authentication.  A certificate
+// that doesn't list its uses may be used for anything.
+func forServers(cert *x509.Certificate) bool {
+	if len(cert.ExtKeyUsage) == 0 {
+		return true
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageServerAuth || usage == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// watch starts a goroutine for each certificate that reloads it when its
+// files change.  See certWatcher.watch.
+func (s *certStore) watch(pollInterval time.Duration, stop <-chan struct{}) {
+	for _, w := range s.watchers {
+		go w.watch(pollInterval, stop)
+	}
+}
+
+// GetCertificate returns the certificate to use for a handshake.  It has the
+// signature of tls.Config.GetCertificate.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello == nil || len(hello.ServerName) == 0 {
+		return s.fallback.GetCertificate(hello)
+	}
+
+	for _, w := range s.watchers {
+		cert, _ := w.GetCertificate(hello)
+		if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+			return cert, nil
+		}
+	}
+
+	// We don't have a certificate for that name.  Log it, but only once per
+	// name, otherwise a misconfigured client could fill up the log.  The number
+	// of names we remember is capped, so a client that sends random names
+	// can't eat up our memory.
+	s.mu.Lock()
+	if !s.unknown[hello.ServerName] && len(s.unknown) < maxUnknownNames {
+		s.unknown[hello.ServerName] = true
+		from := "unknown peer"
+		if hello.Conn != nil {
+			from = hello.Conn.RemoteAddr().String()
+		}
+		slog.Warn("no certificate for the server name requested - using the default certificate",
+			"server_name", hello.ServerName, "peer", from)
+	}
+	s.mu.Unlock()
+	return s.fallback.GetCertificate(hello)
+}
+
+// Leaves returns the active certificate of each watcher.
+func (s *certStore) Leaves() []*x509.Certificate {
+	var leaves []*x509.Certificate
+	for _, w := range s.watchers {
+		leaves = append(leaves, w.Leaf())
+	}
+	return leaves
+}
+
+// NotAfter returns the earliest expiry time of all the certificates.
+func (s *certStore) NotAfter() time.Time {
+	earliest := s.watchers[0].NotAfter()
+	for _, w := range s.watchers[1:] {
+		if w.NotAfter().Before(earliest) {
+			earliest = w.NotAfter()
+		}
+	}
+	return earliest
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertStoreChoosesBySNI(t *testing.T) {
+	dir := t.TempDir()
+	defaultCert := filepath.Join(dir, "default.pem")
+	defaultKey := filepath.Join(dir, "default.pem.key")
+	writeSelfSigned(t, "default.example.com", time.Hour, defaultCert, defaultKey)
+	writeSelfSigned(t, "localhost", time.Hour,
+		filepath.Join(dir, "local.crt"), filepath.Join(dir, "local.key"))
+	writeSelfSigned(t, "mydomain.com", time.Hour,
+		filepath.Join(dir, "mydomain.crt"), filepath.Join(dir, "mydomain.key"))
+
+	store, err := newCertStore(defaultCert, defaultKey, nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.watchers) != 3 {
+		t.Fatalf("expected 3 certificates, got %d", len(store.watchers))
+	}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"mydomain.com", "mydomain.com"},
+		{"localhost", "localhost"},
+		{"", "default.example.com"},
+		{"unknown.example.com", "default.example.com"},
+	}
+	for _, test := range tests {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Leaf.Subject.CommonName != test.want {
+			t.Errorf("server name %q: expected %s, got %s",
+				test.serverName, test.want, cert.Leaf.Subject.CommonName)
+		}
+	}
+}
+
+// TestCertStoreSkipsClientCerts checks that the CA and client certificates
+// that the certs command puts next to the server's aren't served, while a
+// certificate with no extended key usage, which is valid for anything, is.
+func TestCertStoreSkipsClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	newKey := func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	caCert, caKey, err := createCA(dir, "test CA", time.Hour, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := []struct {
+		name  string
+		usage []x509.ExtKeyUsage
+	}{
+		{"localhost", []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}},
+		{"alice", []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}},
+		{"anything.example.com", nil},
+	}
+	for _, leaf := range leaves {
+		template := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: leaf.name},
+			DNSNames:    []string{leaf.name},
+			ExtKeyUsage: leaf.usage,
+		}
+		if err := createLeaf(dir, leaf.name+".crt", leaf.name+".key", template, time.Hour,
+			caCert, caKey, newKey, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := newCertStore("", "", nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, w := range store.watchers {
+		names = append(names, w.Leaf().Subject.CommonName)
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "anything.example.com localhost" {
+		t.Errorf("expected anything.example.com and localhost, got %v", names)
+	}
+}
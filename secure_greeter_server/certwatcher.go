@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/goblimey/grpc/keypair"
+)
+
+// certWatcher holds the server's certificate and private key and reloads them
+// when the files change, so that a renewed certificate can be installed without
+// restarting the server and dropping every client.  The TLS config gets the
+// certificate through GetCertificate, which is called on every handshake, so
+// new connections pick up the new certificate as soon as it's been swapped in.
+// Existing connections carry on with the certificate they started with.
+//
+// A reload is triggered when the modification time of either file changes
+// (checked every pollInterval).  SIGHUP is handled by the configuration
+// reloader, which loads the whole set of certificates again - see reload.go.
+// The new pair is validated before it's used.  If it's broken, for example because
+// the cert file has been replaced but the key file hasn't yet, the watcher
+// logs the problem and carries on with the old pair.
+type certWatcher struct {
+	certfile string
+	keyfile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+	notAfter time.Time
+}
+
+// newCertWatcher creates a certWatcher and loads the initial certificate.  It
+// returns an error if the initial pair can't be loaded, since the server can't
+// do anything useful without it.
+//
+// A PKCS#12 bundle holds the key as well as the certificate, so for one of
+// those keyfile may be empty.
+func newCertWatcher(certfile, keyfile string) (*certWatcher, error) {
+	if len(keyfile) == 0 && keypair.IsPKCS12(certfile) {
+		keyfile = certfile
+	}
+	w := &certWatcher{certfile: certfile, keyfile: keyfile}
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// GetCertificate returns the current certificate.  It has the signature of
+// tls.Config.GetCertificate.
+func (w *certWatcher) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.cert, nil
+}
+
+// Leaf returns the active certificate, parsed.
+func (w *certWatcher) Leaf() *x509.Certificate {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.cert.Leaf
+}
+
+// NotAfter returns the expiry time of the active certificate.
+func (w *certWatcher) NotAfter() time.Time {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.notAfter
+}
+
+// reload loads the certificate and key files, checks them and, if they are
+// OK, makes them the active pair.  If anything is wrong it returns an error
+// and leaves the active pair alone.
+func (w *certWatcher) reload() error {
+	cert, certMod, keyMod, err := w.load()
+	if err != nil {
+		return err
+	}
+	w.install(cert, certMod, keyMod)
+	return nil
+}
+
+// load loads and checks the certificate and key files without making them
+// the active pair.  It also returns the modification times of the files,
+// taken before they were read, so that a change made while they were being
+// read is spotted at the next poll.
+func (w *certWatcher) load() (*tls.Certificate, time.Time, time.Time, error) {
+	certMod, keyMod, err := w.modTimes()
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	cert, err := loadKeyPair(w.certfile, w.keyfile)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	return cert, certMod, keyMod, nil
+}
+
+// install makes cert, loaded by load, the active pair.
+func (w *certWatcher) install(cert *tls.Certificate, certMod, keyMod time.Time) {
+	w.mu.Lock()
+	w.cert = cert
+	w.certMod = certMod
+	w.keyMod = keyMod
+	w.notAfter = cert.Leaf.NotAfter
+	w.mu.Unlock()
+
+	slog.Info("loaded certificate", "file", w.certfile, "names", certNames(cert.Leaf),
+		"expires", cert.Leaf.NotAfter)
+}
+
+// modTimes returns the modification times of the cert file and the key file.
+func (w *certWatcher) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(w.certfile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("cannot open the cert file %s - %v", w.certfile, err)
+	}
+	keyInfo, err := os.Stat(w.keyfile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("cannot open the key file %s - %v", w.keyfile, err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// changed returns true if either file has been modified since the active pair
+// was loaded.
+func (w *certWatcher) changed() bool {
+	certMod, keyMod, err := w.modTimes()
+	if err != nil {
+		// The files may be in the middle of being replaced.  Try again next
+		// time.
+		return false
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return !certMod.Equal(w.certMod) || !keyMod.Equal(w.keyMod)
+}
+
+// watch polls the files every pollInterval and reloads them when they change.
+// It runs until the stop channel is closed, so it should be started as a
+// goroutine.
+func (w *certWatcher) watch(pollInterval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if w.changed() {
+				slog.Info("certificate files changed - reloading", "file", w.certfile)
+				w.reloadAndLog()
+			}
+		}
+	}
+}
+
+// reloadAndLog reloads the pair and logs any failure.
+func (w *certWatcher) reloadAndLog() {
+	if err := w.reload(); err != nil {
+		slog.Error("certificate reload failed, keeping the old certificate",
+			"file", w.certfile, "expires", w.NotAfter(), "error", err)
+	}
+}
+
+// loadKeyPair loads a certificate and private key and checks that they are
+// usable.  The key may be encrypted, and certfile may be a PKCS#12 bundle
+// holding the key as well, in which case keyfile is the same file.  The
+// passphrase comes from the -keypass flags.  keypair.Load checks that the key
+// matches the certificate; on top of that we refuse a certificate that has
+// already expired or isn't valid yet, since swapping one of those in would
+// break every new connection.
+func loadKeyPair(certfile, keyfile string) (*tls.Certificate, error) {
+	cert, err := keypair.Load(certfile, keyfile, keyPass)
+	if err != nil {
+		if keyfile == certfile {
+			return nil, fmt.Errorf("cannot load the certificate and key %s - %v", certfile, err)
+		}
+		return nil, fmt.Errorf("cannot load the certificate %s and key %s - %v",
+			certfile, keyfile, err)
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no certificate found in " + certfile)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse the certificate in %s - %v", certfile, err)
+		}
+	}
+	now := time.Now()
+	if now.After(cert.Leaf.NotAfter) {
+		return nil, fmt.Errorf("the certificate in %s expired at %s",
+			certfile, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(cert.Leaf.NotBefore) {
+		return nil, fmt.Errorf("the certificate in %s is not valid until %s",
+			certfile, cert.Leaf.NotBefore.Format(time.RFC3339))
+	}
+	return &cert, nil
+}
+
+// certNames returns the names that a certificate is valid for - the DNS and
+// IP subject alternative names, or the common name if there are none.
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	names = append(names, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && len(cert.Subject.CommonName) > 0 {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned creates a self-signed certificate for name that expires
+// after validFor and writes it and its key to certfile and keyfile.
+func writeSelfSigned(t *testing.T, name string, validFor time.Duration, certfile, keyfile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certfile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyfile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertWatcherReload(t *testing.T) {
+	dir := t.TempDir()
+	certfile := filepath.Join(dir, "server.crt")
+	keyfile := filepath.Join(dir, "server.key")
+
+	writeSelfSigned(t, "old.example.com", time.Hour, certfile, keyfile)
+	w, err := newCertWatcher(certfile, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := w.GetCertificate(nil)
+	if cert.Leaf.Subject.CommonName != "old.example.com" {
+		t.Errorf("expected old.example.com, got %s", cert.Leaf.Subject.CommonName)
+	}
+
+	// A good new pair replaces the old one.
+	writeSelfSigned(t, "new.example.com", 2*time.Hour, certfile, keyfile)
+	if err := w.reload(); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ = w.GetCertificate(nil)
+	if cert.Leaf.Subject.CommonName != "new.example.com" {
+		t.Errorf("expected new.example.com, got %s", cert.Leaf.Subject.CommonName)
+	}
+	notAfter := w.NotAfter()
+
+	// A broken cert file is refused and the active pair stays as it was.
+	if err := os.WriteFile(certfile, []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.reload(); err == nil {
+		t.Error("expected an error reloading a broken cert file")
+	}
+	cert, _ = w.GetCertificate(nil)
+	if cert.Leaf.Subject.CommonName != "new.example.com" {
+		t.Errorf("broken reload replaced the certificate with %s", cert.Leaf.Subject.CommonName)
+	}
+	if !w.NotAfter().Equal(notAfter) {
+		t.Errorf("broken reload changed the expiry to %v", w.NotAfter())
+	}
+
+	// So is a certificate that has already expired.
+	writeSelfSigned(t, "expired.example.com", -time.Minute, certfile, keyfile)
+	if err := w.reload(); err == nil {
+		t.Error("expected an error reloading an expired certificate")
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goblimey/grpc/keypair"
+	"github.com/goblimey/grpc/settings"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// Certificate expiry monitoring.  An expired certificate stops every client
+// connecting, and it always seems to happen on a weekend.  The expiry monitor
+// keeps track of when each certificate that the server depends on expires:
+//
+//   - the server's own certificates,
+//   - the CA certificates that it trusts to sign client certificates
+//     (-clientca), and
+//   - the client certificates that it has seen.
+//
+// It publishes the number of days left for each as the metric
+// greeter_certificate_expiry_days, and logs a warning as each threshold given
+// by -expirywarn passes, so the warnings get more frequent as the day
+// approaches.  A renewed certificate starts again from the top.  The
+// warnings are counted by greeter_certificate_expiry_warnings_total, so an
+// alert can fire on them.
+//
+// Only an expired server certificate makes the health checks fail.  A -clientca
+// bundle often holds old CA certificates alongside the current one, and an
+// expired one only stops the clients whose certificates it signed, so it's
+// reported as a warning instead.
+
+const (
+	kindServer = "server"
+	kindCA     = "ca"
+	kindClient = "client"
+)
+
+// maxClientCerts is the number of client certificates that the expiry monitor
+// remembers.  A client certificate that hasn't been seen for
+// clientCertMemory is forgotten.
+const (
+	maxClientCerts   = 1000
+	clientCertMemory = 30 * 24 * time.Hour
+)
+
+// expiryCheckInterval is how often the monitor checks the certificates.
+const expiryCheckInterval = time.Hour
+
+// expiryEntry is one certificate that the monitor is tracking.
+type expiryEntry struct {
+	kind     string
+	name     string
+	notAfter time.Time
+	lastSeen time.Time
+	warned   int // the number of thresholds that we've warned about
+}
+
+// expiryMonitor tracks certificate expiry times.
+type expiryMonitor struct {
+	gauge    *prometheus.GaugeVec
+	warnings *prometheus.CounterVec
+
+	// leaves returns the server's current certificates.  It's called on
+	// every check, so renewed certificates are picked up.
+	leaves func() []*x509.Certificate
+
+	mu         sync.Mutex
+	thresholds []time.Duration         // longest first
+	entries    map[string]*expiryEntry // keyed by kind and name
+}
+
+// newExpiryMonitor creates an expiryMonitor.  thresholds are the times
+// before expiry at which to warn, and reg is where the metrics are
+// registered.
+func newExpiryMonitor(thresholds []time.Duration, leaves func() []*x509.Certificate,
+	reg prometheus.Registerer) *expiryMonitor {
+
+	m := &expiryMonitor{
+		leaves:  leaves,
+		entries: make(map[string]*expiryEntry),
+		gauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "greeter_certificate_expiry_days",
+			Help: "Days until the certificate expires (negative once it has expired).",
+		}, []string{"kind", "name"}),
+		warnings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greeter_certificate_expiry_warnings_total",
+			Help: "Certificate expiry warnings logged, by kind of certificate and urgency.",
+		}, []string{"kind", "urgency"}),
+	}
+	m.setThresholds(thresholds)
+	reg.MustRegister(m.gauge, m.warnings)
+	return m
+}
+
+// setThresholds changes the thresholds, for a configuration reload.  The
+// warnings start again.
+func (m *expiryMonitor) setThresholds(thresholds []time.Duration) {
+	sorted := append([]time.Duration(nil), thresholds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.thresholds = sorted
+	for _, e := range m.entries {
+		e.warned = 0
+	}
+}
+
+// parseThresholds parses a comma-separated list of numbers of days.
+func parseThresholds(list string) ([]time.Duration, error) {
+	var thresholds []time.Duration
+	for _, item := range settings.SplitList(list) {
+		days, err := strconv.Atoi(item)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("-expirywarn should be a list of numbers of days, not %q", list)
+		}
+		thresholds = append(thresholds, time.Duration(days)*24*time.Hour)
+	}
+	return thresholds, nil
+}
+
+// track records a certificate.  If it replaces one with the same kind and
+// name, the warnings start again.
+func (m *expiryMonitor) track(kind string, cert *x509.Certificate, now time.Time) {
+	name := strings.Join(certNames(cert), ",")
+	key := kind + "/" + name
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		if kind == kindClient && m.countLocked(kindClient) >= maxClientCerts {
+			return
+		}
+		e = &expiryEntry{kind: kind, name: name}
+		m.entries[key] = e
+	}
+	if !cert.NotAfter.Equal(e.notAfter) {
+		e.notAfter = cert.NotAfter
+		e.warned = 0
+	}
+	e.lastSeen = now
+	m.gauge.WithLabelValues(kind, name).Set(daysLeft(e.notAfter, now))
+}
+
+func (m *expiryMonitor) countLocked(kind string) int {
+	n := 0
+	for _, e := range m.entries {
+		if e.kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// trackCAs records the CA certificates in a file, replacing any recorded
+// before.
+func (m *expiryMonitor) trackCAs(filename string) error {
+	certs, err := keypair.ReadCertificates(filename)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	for key, e := range m.entries {
+		if e.kind == kindCA {
+			delete(m.entries, key)
+			m.gauge.DeleteLabelValues(e.kind, e.name)
+		}
+	}
+	m.mu.Unlock()
+	for _, cert := range certs {
+		m.track(kindCA, cert, time.Now())
+	}
+	return nil
+}
+
+// VerifyConnection records the client certificate, if there is one.  It has
+// the signature of tls.Config.VerifyConnection and never fails.
+func (m *expiryMonitor) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) > 0 {
+		m.track(kindClient, cs.PeerCertificates[0], time.Now())
+	}
+	return nil
+}
+
+// check updates the metric and logs a warning for each certificate that has
+// passed another threshold.
+func (m *expiryMonitor) check(now time.Time) {
+	current := make(map[string]bool)
+	if m.leaves != nil {
+		for _, leaf := range m.leaves() {
+			m.track(kindServer, leaf, now)
+			current[kindServer+"/"+strings.Join(certNames(leaf), ",")] = true
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, e := range m.entries {
+		// Forget server certificates that are no longer in use and client
+		// certificates that haven't been seen for a while.
+		if (e.kind == kindServer && m.leaves != nil && !current[key]) ||
+			(e.kind == kindClient && now.Sub(e.lastSeen) > clientCertMemory) {
+			delete(m.entries, key)
+			m.gauge.DeleteLabelValues(e.kind, e.name)
+			continue
+		}
+		m.gauge.WithLabelValues(e.kind, e.name).Set(daysLeft(e.notAfter, now))
+
+		left := e.notAfter.Sub(now)
+		passed := 0
+		for _, t := range m.thresholds {
+			if left <= t {
+				passed++
+			}
+		}
+		expired := left <= 0
+		if expired {
+			passed = len(m.thresholds) + 1
+		}
+		if passed <= e.warned {
+			continue
+		}
+		e.warned = passed
+		if expired && e.kind == kindCA {
+			m.warnings.WithLabelValues(e.kind, "expired").Inc()
+			slog.Warn(fmt.Sprintf("the CA certificate for %s has expired - "+
+				"client certificates that it signed will be refused", e.name),
+				"kind", e.kind, "name", e.name, "expires", e.notAfter)
+		} else if expired {
+			m.warnings.WithLabelValues(e.kind, "expired").Inc()
+			slog.Error(fmt.Sprintf("CERTIFICATE EXPIRED: the %s certificate for %s has expired", e.kind, e.name),
+				"kind", e.kind, "name", e.name, "expires", e.notAfter)
+		} else {
+			urgency := expiryLevel(passed, len(m.thresholds))
+			m.warnings.WithLabelValues(e.kind, strings.ToLower(urgency)).Inc()
+			level := slog.LevelWarn
+			if urgency == "notice" {
+				level = slog.LevelInfo
+			}
+			slog.Log(context.Background(), level,
+				fmt.Sprintf("%s: the %s certificate for %s expires in %s", urgency, e.kind, e.name, formatDays(left)),
+				"kind", e.kind, "name", e.name, "expires", e.notAfter)
+		}
+	}
+}
+
+// expiryLevel names how urgent a warning is.
+func expiryLevel(passed, thresholds int) string {
+	switch {
+	case passed == thresholds && thresholds > 1:
+		return "URGENT"
+	case passed > 1:
+		return "WARNING"
+	default:
+		return "notice"
+	}
+}
+
+// watch checks the certificates straight away and then every
+// expiryCheckInterval, until stop is closed.  It should be started as a
+// goroutine.
+func (m *expiryMonitor) watch(stop <-chan struct{}) {
+	m.check(time.Now())
+	slog.Info("certificate expiry", "status", m.Status())
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.check(time.Now())
+		}
+	}
+}
+
+// Status describes the certificate that expires soonest, for the log and
+// for health checks.  Expired CA certificates are left out - see Warnings.
+func (m *expiryMonitor) Status() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var soonest *expiryEntry
+	for _, e := range m.entries {
+		if e.kind == kindCA && !now.Before(e.notAfter) {
+			continue
+		}
+		if soonest == nil || e.notAfter.Before(soonest.notAfter) {
+			soonest = e
+		}
+	}
+	if soonest == nil {
+		return "no certificates"
+	}
+	left := time.Until(soonest.notAfter)
+	if left <= 0 {
+		return fmt.Sprintf("the %s certificate for %s has EXPIRED", soonest.kind, soonest.name)
+	}
+	return fmt.Sprintf("the first certificate to expire is the %s certificate for %s, in %s",
+		soonest.kind, soonest.name, formatDays(left))
+}
+
+// Expired returns true if any of the server's own certificates has expired.
+func (m *expiryMonitor) Expired() bool {
+	return len(m.expired(kindServer, time.Now())) > 0
+}
+
+// Warnings describes the trusted CA certificates that have expired, for
+// health checks.
+func (m *expiryMonitor) Warnings() []string {
+	var warnings []string
+	for _, name := range m.expired(kindCA, time.Now()) {
+		warnings = append(warnings, "the CA certificate for "+name+" has expired")
+	}
+	return warnings
+}
+
+// expired returns the names of the certificates of the given kind that have
+// expired by now, sorted.
+func (m *expiryMonitor) expired(kind string, now time.Time) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for _, e := range m.entries {
+		if e.kind == kind && !now.Before(e.notAfter) {
+			names = append(names, e.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// daysLeft returns the number of days until t, as a fraction.
+func daysLeft(t, now time.Time) float64 {
+	return t.Sub(now).Hours() / 24
+}
+
+// formatDays formats a duration as a number of days, or hours if it's less
+// than two days.
+func formatDays(d time.Duration) string {
+	if d < 48*time.Hour {
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	}
+	return fmt.Sprintf("%d days", int(d.Hours()/24))
+}
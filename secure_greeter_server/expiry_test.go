@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExpiryMonitor(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	now := time.Now()
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "localhost"},
+		DNSNames: []string{"localhost"},
+		NotAfter: now.Add(20 * 24 * time.Hour),
+	}
+	thresholds, err := parseThresholds("7,30,14")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	m := newExpiryMonitor(thresholds, func() []*x509.Certificate { return []*x509.Certificate{cert} }, reg)
+
+	// 20 days left - past the 30 day threshold only.
+	m.check(now)
+	if !strings.Contains(logged.String(), "notice: the server certificate for localhost expires in 20 days") {
+		t.Errorf("at 20 days, want a notice, got %q", logged.String())
+	}
+	days := testutil.ToFloat64(m.gauge.WithLabelValues(kindServer, "localhost"))
+	if days < 19.9 || days > 20.1 {
+		t.Errorf("want the metric to say 20 days, got %v", days)
+	}
+
+	// The same threshold isn't reported twice.
+	logged.Reset()
+	m.check(now.Add(time.Hour))
+	if logged.Len() > 0 {
+		t.Errorf("want no repeat warning, got %q", logged.String())
+	}
+
+	// 10 days left - the 14 day threshold has passed too.
+	m.check(now.Add(10 * 24 * time.Hour))
+	if !strings.Contains(logged.String(), "WARNING: the server certificate for localhost expires in 10 days") {
+		t.Errorf("at 10 days, want a warning, got %q", logged.String())
+	}
+
+	// 3 days left - the last threshold.
+	logged.Reset()
+	m.check(now.Add(17 * 24 * time.Hour))
+	if !strings.Contains(logged.String(), "URGENT") {
+		t.Errorf("at 3 days, want an urgent warning, got %q", logged.String())
+	}
+
+	// Expired.
+	logged.Reset()
+	m.check(now.Add(21 * 24 * time.Hour))
+	if !strings.Contains(logged.String(), "CERTIFICATE EXPIRED") {
+		t.Errorf("after expiry, want an expired message, got %q", logged.String())
+	}
+	if len(m.expired(kindServer, now.Add(21*24*time.Hour))) != 1 {
+		t.Error("want Expired to be true")
+	}
+	for _, urgency := range []string{"notice", "warning", "urgent", "expired"} {
+		if n := testutil.ToFloat64(m.warnings.WithLabelValues(kindServer, urgency)); n != 1 {
+			t.Errorf("want one %s counted, got %v", urgency, n)
+		}
+	}
+
+	// A renewed certificate starts again.
+	cert = &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "localhost"},
+		DNSNames: []string{"localhost"},
+		NotAfter: now.Add(100 * 24 * time.Hour),
+	}
+	logged.Reset()
+	m.check(now.Add(21 * 24 * time.Hour))
+	if logged.Len() > 0 {
+		t.Errorf("renewed certificate, want no warning, got %q", logged.String())
+	}
+	if len(m.expired(kindServer, now.Add(21*24*time.Hour))) != 0 {
+		t.Error("renewed certificate, want Expired to be false")
+	}
+}
+
+// TestExpiredCA checks that an expired CA certificate is only a warning.
+func TestExpiredCA(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	now := time.Now()
+	server := &x509.Certificate{DNSNames: []string{"localhost"}, NotAfter: now.Add(100 * 24 * time.Hour)}
+	m := newExpiryMonitor(nil, func() []*x509.Certificate { return []*x509.Certificate{server} },
+		prometheus.NewRegistry())
+	m.track(kindCA, &x509.Certificate{Subject: pkix.Name{CommonName: "old CA"}, NotAfter: now.Add(-time.Hour)}, now)
+	m.track(kindCA, &x509.Certificate{Subject: pkix.Name{CommonName: "new CA"}, NotAfter: now.Add(time.Hour)}, now)
+	m.check(now)
+
+	if m.Expired() {
+		t.Error("an expired CA certificate made Expired true")
+	}
+	if w := m.Warnings(); len(w) != 1 || !strings.Contains(w[0], "old CA") {
+		t.Errorf("want a warning about the old CA, got %q", w)
+	}
+	if !strings.Contains(logged.String(), "WARN the CA certificate for old CA has expired") || strings.Contains(logged.String(), "CERTIFICATE EXPIRED") {
+		t.Errorf("want the expired CA logged as a warning, got %q", logged.String())
+	}
+	if status := m.Status(); !strings.Contains(status, "new CA") {
+		t.Errorf("want the status to name the CA that expires next, got %q", status)
+	}
+}
+
+func TestParseThresholds(t *testing.T) {
+	for _, bad := range []string{"30,x", "0", "-1"} {
+		if _, err := parseThresholds(bad); err == nil {
+			t.Errorf("%q: want an error", bad)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// Health checking.  The server offers the standard gRPC health service
+// (grpc.health.v1.Health), which load balancers and orchestration systems
+// use to decide whether to send it work.  The status reflects whether the
+// server can actually do its job, not just whether the process is running:
+//
+//   - the listener must still be open and accepting connections,
+//   - there must be a server certificate and it, and the client CA
+//     certificates, must be valid, and
+//   - the authentication backend must be reachable.
+//
+// The checks are run every -healthinterval.  The status is reported for the
+// server as a whole (the service name "") and for the Greeter service.  When
+// the server shuts down, every service is reported as not serving.
+//
+// The listener is checked from inside the process, by watching what its
+// Accept returns, rather than by connecting to it.  A connection that hung
+// up without a TLS handshake would be counted and logged as a failed
+// handshake.
+//
+// With -healthdetail each Check response carries a description of the
+// problems, or of the state of the certificates if there are none, in the
+// x-health-detail header.  It's off by default, since anyone can ask for a
+// health check and the detail says a lot about the server.
+
+// healthDetailHeader is the response header that carries the detail.
+const healthDetailHeader = "x-health-detail"
+
+// greeterService is the name of the Greeter service for health checks.
+const greeterService = "helloworld.Greeter"
+
+// statuser is something that can describe its state for health checks, such
+// as the expiry monitor or the OCSP stapler.
+type statuser interface {
+	Status() string
+}
+
+// readiness runs the health checks and serves the results.
+type readiness struct {
+	*health.Server
+
+	lis       *checkedListener
+	certs     certSource
+	expiry    *expiryMonitor
+	authCheck func(ctx context.Context) error
+	statusers []statuser
+
+	// sendDetail says whether to send the detail header.  Set it before
+	// the health service is registered.
+	sendDetail bool
+
+	mu      sync.Mutex
+	checked bool
+	serving bool
+	detail  string
+}
+
+// newReadiness creates a readiness checker.  Everything is reported as not
+// serving until the first check has passed.
+func newReadiness(lis *checkedListener, certs certSource, expiry *expiryMonitor,
+	authCheck func(ctx context.Context) error, statusers ...statuser) *readiness {
+
+	r := &readiness{
+		Server:    health.NewServer(),
+		lis:       lis,
+		certs:     certs,
+		expiry:    expiry,
+		authCheck: authCheck,
+		statusers: statusers,
+		detail:    "not checked yet",
+	}
+	r.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	r.SetServingStatus(greeterService, healthpb.HealthCheckResponse_NOT_SERVING)
+	return r
+}
+
+// problems runs the checks and returns a description of each failure.
+func (r *readiness) problems(ctx context.Context) []string {
+	var problems []string
+
+	if err := r.lis.failure(); err != nil {
+		problems = append(problems, "the listener is not accepting connections - "+err.Error())
+	}
+
+	leaves := r.certs.Leaves()
+	if len(leaves) == 0 {
+		problems = append(problems, "no server certificate has been loaded")
+	}
+	now := time.Now()
+	for _, leaf := range leaves {
+		if now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+			problems = append(problems, "the server certificate for "+
+				strings.Join(certNames(leaf), ",")+" is not valid now")
+		}
+	}
+	if r.expiry != nil && r.expiry.Expired() {
+		problems = append(problems, r.expiry.Status())
+	}
+
+	if err := r.authCheck(ctx); err != nil {
+		problems = append(problems, "the authentication backend is not reachable - "+err.Error())
+	}
+	return problems
+}
+
+// update runs the checks and sets the status accordingly.  Changes are
+// logged.
+func (r *readiness) update() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	problems := r.problems(ctx)
+
+	var details []string
+	if len(problems) > 0 {
+		details = problems
+	} else {
+		for _, s := range r.statusers {
+			details = append(details, s.Status())
+		}
+	}
+	if r.expiry != nil {
+		details = append(details, r.expiry.Warnings()...)
+	}
+	serving := len(problems) == 0
+	detail := strings.Join(details, "; ")
+
+	r.mu.Lock()
+	changed := !r.checked || serving != r.serving || (!serving && detail != r.detail)
+	r.checked = true
+	r.serving = serving
+	r.detail = detail
+	r.mu.Unlock()
+
+	status := healthpb.HealthCheckResponse_SERVING
+	if !serving {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	if changed {
+		level := slog.LevelInfo
+		if !serving {
+			level = slog.LevelWarn
+		}
+		slog.Log(ctx, level, "health", "status", status.String(), "detail", detail)
+	}
+	// After a shutdown these are ignored, so we stay not serving.
+	r.SetServingStatus("", status)
+	r.SetServingStatus(greeterService, status)
+}
+
+// watch runs the checks straight away and then every interval, until stop
+// is closed.  It should be started as a goroutine.
+func (r *readiness) watch(interval time.Duration, stop <-chan struct{}) {
+	r.update()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.update()
+		}
+	}
+}
+
+// Check answers a health check, adding the detail header to the response if
+// -healthdetail is set.
+func (r *readiness) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if r.sendDetail {
+		r.mu.Lock()
+		detail := r.detail
+		r.mu.Unlock()
+		grpc.SetHeader(ctx, metadata.Pairs(healthDetailHeader, detail))
+	}
+	return r.Server.Check(ctx, req)
+}
+
+// checkedListener is a net.Listener that remembers why it stopped accepting
+// connections, for the health checks.
+type checkedListener struct {
+	net.Listener
+
+	mu     sync.Mutex
+	failed error
+}
+
+// errListenerClosed is the failure of a listener that has been closed.
+var errListenerClosed = errors.New("the listener has been closed")
+
+func (l *checkedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	// gRPC carries on after a temporary error, such as running out of file
+	// descriptors, so that isn't a failure.
+	if temp, ok := err.(interface{ Temporary() bool }); err != nil && !(ok && temp.Temporary()) {
+		l.mu.Lock()
+		if l.failed == nil {
+			l.failed = err
+		}
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (l *checkedListener) Close() error {
+	l.mu.Lock()
+	if l.failed == nil {
+		l.failed = errListenerClosed
+	}
+	l.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// failure returns the error that stopped the listener, or nil if it's still
+// accepting connections.
+func (l *checkedListener) failure() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failed
+}
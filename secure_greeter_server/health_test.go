@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestReadiness(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := &checkedListener{Listener: listener}
+	defer lis.Close()
+
+	leaf := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "localhost"},
+		DNSNames:  []string{"localhost"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	source := &fixedCertSource{cert: &tls.Certificate{Leaf: leaf}}
+	var authErr error
+	authCheck := func(ctx context.Context) error { return authErr }
+	r := newReadiness(lis, source, nil, authCheck)
+
+	status := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := r.Server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status
+	}
+
+	if got := status(""); got != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("before the first check: want NOT_SERVING, got %v", got)
+	}
+
+	r.update()
+	for _, service := range []string{"", greeterService} {
+		if got := status(service); got != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("%q when healthy: want SERVING, got %v", service, got)
+		}
+	}
+
+	authErr = errors.New("connection refused")
+	r.update()
+	if got := status(greeterService); got != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("auth backend down: want NOT_SERVING, got %v", got)
+	}
+	// The detail is only sent with -healthdetail, whatever the log level.
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(ioutil.Discard, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	if got := detailHeader(t, r); got != "" {
+		t.Errorf("want no detail without -healthdetail, got %q", got)
+	}
+	slog.SetDefault(old)
+	r.sendDetail = true
+	if got := detailHeader(t, r); !strings.Contains(got, "connection refused") {
+		t.Errorf("want the detail with -healthdetail, got %q", got)
+	}
+	authErr = nil
+
+	leaf.NotAfter = time.Now().Add(-time.Minute)
+	r.update()
+	if got := status(""); got != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("expired certificate: want NOT_SERVING, got %v", got)
+	}
+
+	leaf.NotAfter = time.Now().Add(time.Hour)
+	lis.Close()
+	if _, err := lis.Accept(); err == nil {
+		t.Fatal("a closed listener accepted a connection")
+	}
+	r.update()
+	if got := status(""); got != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("listener closed: want NOT_SERVING, got %v", got)
+	}
+}
+
+// headerStream is a grpc.ServerTransportStream that keeps the header that a
+// handler sets.
+type headerStream struct {
+	header metadata.MD
+}
+
+func (s *headerStream) Method() string { return healthpb.Health_Check_FullMethodName }
+func (s *headerStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+func (s *headerStream) SendHeader(md metadata.MD) error { return s.SetHeader(md) }
+func (s *headerStream) SetTrailer(md metadata.MD) error { return nil }
+
+// detailHeader calls r.Check and returns the x-health-detail header that it
+// sets, if any.
+func detailHeader(t *testing.T, r *readiness) string {
+	stream := &headerStream{}
+	ctx := grpc.NewContextWithServerTransportStream(context.Background(), stream)
+	if _, err := r.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(stream.header.Get(healthDetailHeader), "")
+}
+
+// TestReadinessExpiredCA checks that an expired CA certificate in the
+// -clientca bundle is reported but doesn't stop the server serving.
+func TestReadinessExpiredCA(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := &checkedListener{Listener: listener}
+	defer lis.Close()
+
+	now := time.Now()
+	leaf := &x509.Certificate{DNSNames: []string{"localhost"}, NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)}
+	source := &fixedCertSource{cert: &tls.Certificate{Leaf: leaf}}
+	expiry := newExpiryMonitor(nil, source.Leaves, prometheus.NewRegistry())
+	expiry.track(kindCA, &x509.Certificate{Subject: pkix.Name{CommonName: "old CA"}, NotAfter: now.Add(-time.Hour)}, now)
+	r := newReadiness(lis, source, expiry, func(ctx context.Context) error { return nil }, expiry)
+
+	r.update()
+	resp, err := r.Server.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("want SERVING, got %v", resp.Status)
+	}
+	if !strings.Contains(r.detail, "the CA certificate for old CA has expired") {
+		t.Errorf("want the expired CA in the detail, got %q", r.detail)
+	}
+}
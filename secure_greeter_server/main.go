@@ -18,9 +18,10 @@
  *
  * Simple usage:
  *
+ *     $ secure_greeter_server certs -dir=/home/simon/certs
  *     $ secure_greeter_server \
- *         --certfile=/home/simon/ca.certificate/selfsigned.crt \
- *         --keyfile=/home/simon/ca.certificate/selfsigned.key
+ *         --certfile=/home/simon/certs/server.crt \
+ *         --keyfile=/home/simon/certs/server.key
  *
  * This software is Copyright 2015 Google and 2017 Simon Ritchie.  It's distributed
  * under the same licence conditions as the original from Google:
@@ -60,29 +61,142 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/goblimey/grpc/deadlines"
 	pb "github.com/goblimey/grpc/helloworld"
+	"github.com/goblimey/grpc/keepalivepolicy"
+	"github.com/goblimey/grpc/keypair"
+	"github.com/goblimey/grpc/logging"
+	"github.com/goblimey/grpc/settings"
+	"github.com/goblimey/grpc/tlspolicy"
+	"github.com/goblimey/grpc/tracing"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	grpccred "google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 )
 
 var (
-	verbose  = flag.Bool("v", false, "verbose mode")
 	port     = flag.Int("p", 50061, "port")
-	certfile = flag.String("certfile", "", "certificate file")
+	certfile = flag.String("certfile", "", "certificate file, or PKCS#12 bundle")
 	keyfile  = flag.String("keyfile", "", "private key file")
+	clientca = flag.String("clientca", "",
+		"CA certificate file used to verify client certificates (enables mutual TLS)")
+	certdir = flag.String("certdir", "",
+		"directory of extra cert and key file pairs (name.crt and name.key)")
+	acmedomains = flag.String("acmedomains", "",
+		"comma-separated domains to get certificates for using ACME (enables ACME mode)")
+	acmedir   = flag.String("acmedir", acme.LetsEncryptURL, "ACME directory URL")
+	acmecache = flag.String("acmecache", "acme-cache",
+		"directory for the ACME account key and certificates")
+	acmeemail = flag.String("acmeemail", "", "contact email address for the ACME account")
+	acmehttp  = flag.String("acmehttp", "",
+		"address to answer ACME HTTP-01 challenges on, for example :80")
+	acmeca = flag.String("acmeca", "",
+		"CA certificate file for the ACME directory's HTTPS certificate, for testing with Pebble")
+	crlfile = flag.String("crlfile", "",
+		"comma-separated CRL files used to check client certificates for revocation")
+	crlpoll   = flag.Duration("crlpoll", 5*time.Minute, "how often to reload the CRL files")
+	useOCSP   = flag.Bool("ocsp", false, "check client certificates with their OCSP responders")
+	revpolicy = flag.String("revpolicy", "fail-closed",
+		"what to do when a client certificate's revocation status is unknown - fail-open or fail-closed")
+	revcache   = flag.Duration("revcache", 10*time.Minute, "how long to cache revocation results")
+	ocspstaple = flag.Bool("ocspstaple", false,
+		"fetch OCSP responses for the server certificate and staple them to the handshake")
+	ocspissuer = flag.String("ocspissuer", "",
+		"issuer certificate file for OCSP stapling, if the cert file doesn't hold the chain")
+	certpoll = flag.Duration("certpoll", time.Minute,
+		"how often to check the cert and key files for changes")
+	expirywarn = flag.String("expirywarn", "30,14,7,1",
+		"warn when a certificate is this many days from expiry (comma-separated list)")
+	metricsaddr = flag.String("metricsaddr", "",
+		"serve Prometheus metrics at /metrics on this address, for example localhost:9090")
+	drainwait = flag.Duration("drainwait", 0,
+		"on shutdown, how long to fail health checks before draining, so load balancers notice")
+	draintimeout = flag.Duration("draintimeout", 30*time.Second,
+		"on shutdown, how long to wait for running RPCs to finish before aborting them")
+	healthinterval = flag.Duration("healthinterval", 10*time.Second,
+		"how often to run the health checks")
+	healthdetail = flag.Bool("healthdetail", false,
+		"describe any problems in health check responses, in the x-health-detail header")
+	configpoll = flag.Duration("configpoll", time.Minute,
+		"how often to check the configuration file for changes (0 to only reload on SIGHUP)")
+	adminaddr = flag.String("adminaddr", "",
+		"serve the admin pages (pprof, channelz, configuration, build info) on this address, for example localhost:9092")
+	adminclientca = flag.String("adminclientca", "",
+		"CA file for the admin pages' client certificates - the pages then need mutual TLS and can be on any address")
+	adminallow = flag.String("adminallow", "",
+		"comma-separated client certificate names allowed to see the admin pages (default: any signed by -adminclientca)")
+	panicfile = flag.String("panicfile", "",
+		"append a report of each panic in an RPC handler to this file, one line of JSON each")
 )
 
+// tlsOptions holds the TLS security policy flags (-tlsprofile and so on).
+var tlsOptions = tlspolicy.Flags(flag.CommandLine)
+
+// keepaliveOptions holds the keepalive and connection age flags
+// (-keepaliveprofile and so on).  See the keepalivepolicy package.
+var keepaliveOptions = keepalivepolicy.ServerFlags(flag.CommandLine)
+
+// deadlineOptions holds the handler time limit flags (-handlertimeout and so
+// on).  See the deadlines package.
+var deadlineOptions = deadlines.ServerFlags(flag.CommandLine)
+
+// logOptions holds the logging flags (-loglevel, -logformat and -v).  See
+// the logging package.
+var logOptions = logging.Flags(flag.CommandLine)
+
+// traceOptions holds the tracing flags (-trace and so on).  See the tracing
+// package.
+var traceOptions = tracing.Flags(flag.CommandLine)
+
+// keyPass holds the flags that give the passphrase of an encrypted key
+// (-keypassfile and so on).
+var keyPass = keypair.Flags(flag.CommandLine, "key")
+
+// conf fills in the flags that aren't on the command line from the
+// configuration file and GREETER_SERVER_ environment variables.  See the
+// settings package.
+var conf = settings.New(flag.CommandLine, "GREETER_SERVER_")
+
+// certSource supplies the server's certificates.  certStore reads them from
+// files and acmeCertSource gets them using ACME.
+type certSource interface {
+	// GetCertificate has the signature of tls.Config.GetCertificate.
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// NotAfter returns the time that the earliest certificate expires.
+	NotAfter() time.Time
+
+	// Leaves returns the certificates currently in use, for the expiry
+	// monitor.
+	Leaves() []*x509.Certificate
+}
+
+// certpairs holds the -certpair options.
+var certpairs pairList
+
+func init() {
+	flag.Var(&certpairs, "certpair",
+		"extra certificate as certfile:keyfile, or a PKCS#12 bundle (can be given more than once)")
+}
+
 // server is used to implement helloworld.GreeterServer.
 type server struct{}
 
@@ -93,20 +207,94 @@ func (s *server) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloRe
 }
 
 func main() {
-	flag.Parse()
+	if err := conf.Parse(os.Args[1:]); err != nil {
+		log.Fatalf("%v", err)
+	}
+	logLevel, err := logging.Setup(logOptions, os.Stderr)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	stopTracing, err := tracing.Setup(traceOptions, "secure_greeter_server")
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+
+	// "secure_greeter_server config print" shows the settings from the
+	// configuration file, the environment and the command line combined.
+	if flag.Arg(0) == "config" {
+		if flag.Arg(1) != "print" {
+			logging.Fatalf("usage: secure_greeter_server [flags] config print")
+		}
+		conf.Print(os.Stdout)
+		return
+	}
+
+	// "secure_greeter_server certs" creates certificates rather than running
+	// the server.
+	if flag.Arg(0) == "certs" {
+		if err := runCerts(flag.Args()[1:]); err != nil {
+			logging.Fatalf("%v", err)
+		}
+		return
+	}
 
 	portStr := ":" + strconv.Itoa(*port) // ":50061"
-	lis, err := net.Listen("tcp", portStr)
+	listener, err := net.Listen("tcp", portStr)
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		logging.Fatalf("failed to listen: %v", err)
 	}
+	// The health checks watch the listener to see that it's still accepting
+	// connections.
+	lis := &checkedListener{Listener: listener}
 
 	// The server options control the style of the gRPC connection, for example
 	// encrypted (https) or plain text (http).
 	var opts []grpc.ServerOption
 
-	// Create a server option from the OAUTH interceptor.
-	opts = append(opts, grpc.UnaryInterceptor(OAuthUnaryInterceptor))
+	// Create a server option from the OAUTH interceptor.  The tracker counts
+	// the RPCs in flight so that a shutdown can wait for them - see
+	// shutdown.go - and publishes the count.  serverMetrics counts and times
+	// them for -metricsaddr - see metrics.go.  The tracing interceptor gives
+	// each one a span, which continues the client's trace - see the tracing
+	// package.  The request logger gives each RPC a request ID and logs it -
+	// see requestlog.go.
+	// The recovery interceptor turns a panic in a handler into an INTERNAL
+	// error rather than a crash - see recovery.go.  It comes after the
+	// request logger so that the panic is logged with the request ID.  The
+	// deadline interceptor refuses requests that don't leave enough time and
+	// limits how long the handler runs - see the deadlines package.
+	limits, err := deadlines.New(deadlineOptions)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	slog.Info(limits.ServerString())
+	recovery := &panicRecovery{metrics: serverMetrics}
+	if len(*panicfile) > 0 {
+		recovery.report, err = panicFile(*panicfile)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+	}
+	tracker := &rpcTracker{gauge: serverMetrics.inFlight}
+	opts = append(opts, grpc.ChainUnaryInterceptor(tracker.unary, serverMetrics.unary,
+		tracing.UnaryServerInterceptor, logUnary, recovery.unary, limits.UnaryServerInterceptor,
+		OAuthUnaryInterceptor))
+	opts = append(opts, grpc.ChainStreamInterceptor(tracker.stream, serverMetrics.stream,
+		tracing.StreamServerInterceptor, logStream, recovery.stream))
+
+	// Keep the connections alive, and close them when they've been idle or
+	// open for too long, as the keepalive policy says.  See the
+	// keepalivepolicy package.
+	keepalive, err := keepalivepolicy.New(keepaliveOptions)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	opts = append(opts, keepalive.ServerOptions()...)
+	slog.Info(keepalive.ServerString())
+
+	// Closing stop stops the goroutines that watch the certificates and so
+	// on.  It's closed when the server shuts down.
+	stop := make(chan struct{})
 
 	// Creating a server option for the TLS connaction is more complicated.  The
 	// setup uses wisdom from:
@@ -115,48 +303,181 @@ func main() {
 	// and
 	//    http://www.bite-code.com/2015/06/25/tls-mutual-auth-in-golang/
 	//
-	// To make the connection work you need a self-signed certificate and a
-	// matching private key.  Create these using lc-tlscert:
+	// To make the connection work you need a certificate and a matching private
+	// key.  The certs command creates them, along with a local certificate
+	// authority (CA) to sign them:
 	//
-	//    go get github.com/driskell/log-courier
-	//    go install github.com/driskell/log-courier/lc-tlscert
-	//    lc-tlscert
-	//    (Give your server name as the common name)
+	//    secure_greeter_server certs -hosts=mydomain.com,localhost
 	//
-	// The common name must match the server name that the client will use to
-	// connect.  If the client and server are on the same machine you can use
-	// "localhost".
+	// The certificate must carry the name that the client will use to connect
+	// to the server as one of its subject alternative names.  -hosts sets those
+	// and can include IP addresses as well as DNS names.
 	//
-	// lc-tlscert produces a .key file containing your server's private key and a
-	// .cert file containing a certificate.  The client needs to be able to see the
-	// certificate data.  If the client is on another machine, you need to provide
-	// it with a copy of the .crt file.
+	// The command produces server.key containing your server's private key,
+	// server.crt containing its certificate and ca.crt containing the CA's
+	// certificate.  The client needs a copy of ca.crt so that it can check the
+	// server's certificate.  If you have a certificate from a public CA you can
+	// use that instead, and the client can use the system's trusted roots.
 	//
-	// Danger Will Robinson:  I found instructions on the web showing other ways to
-	// generate a self-signed certificate but the result didn't work for gRPC.
+	// The server can hold more than one certificate - give the extra ones with
+	// -certpair or put them in a directory and give that with -certdir.  It
+	// chooses between them using the server name that the client asks for
+	// (SNI).  The -certfile and -keyfile pair is the default, used when the
+	// client asks for a name that we don't have a certificate for.
 	//
-	// Load509KeyPair doesn't return an error if the files don't exist(!) so we
-	// check that they do before trying to use them.
+	// The certificates are reloaded when their files change or when we get
+	// SIGHUP, so a renewed certificate can be installed without restarting the
+	// server.  SIGHUP reloads the configuration, which loads the whole set
+	// again - see reload.go.
+	//
+	// The key can be encrypted (PKCS#8) if you give its passphrase with
+	// -keypassfile, -keypassenv or -keypassprompt, and -certfile can be a
+	// PKCS#12 bundle holding both the certificate and the key, in which case
+	// -keyfile isn't needed.  See the keypair package.
+	//
+	// Alternatively, in ACME mode (-acmedomains) the server gets its certificate
+	// from a CA such as Let's Encrypt and renews it automatically.  See acme.go.
+	var certs certSource
+	var swappable *swappableCerts // nil in ACME mode
+	config := tls.Config{}
+	if len(*acmedomains) > 0 {
+		if len(*certfile) > 0 || len(certpairs) > 0 || len(*certdir) > 0 {
+			logging.Fatalf("give either -acmedomains or certificate files, not both")
+		}
+		acmeCerts, err := newACMECertSource(settings.SplitList(*acmedomains), *acmedir, *acmecache,
+			*acmeemail, *acmeca)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		if len(*acmehttp) > 0 {
+			go acmeCerts.serveHTTPChallenges(*acmehttp)
+		}
+		config.NextProtos = acmeCerts.nextProtos()
+		go acmeCerts.prefetch()
+		certs = acmeCerts
+	} else {
+		if err := keyPass.Check(); err != nil {
+			logging.Fatalf("%v", err)
+		}
+		store, err := newCertStore(*certfile, *keyfile, certpairs, *certdir)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		swappable = newSwappableCerts(store, *certpoll, stop)
+		certs = swappable
+	}
+
+	// Staple OCSP responses to the certificate, so that clients can check that
+	// it hasn't been revoked without asking the CA.  See ocspstaple.go.
+	var statusers []statuser // for the health check detail
+	if *ocspstaple {
+		st, err := newStapler(certs, *ocspissuer)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		go st.watch(stop)
+		certs = st
+		statusers = append(statusers, st)
+	}
+	config.GetCertificate = certs.GetCertificate
+
+	// Apply the TLS security policy - allowed versions, cipher suites and so
+	// on.  See the tlspolicy package.
+	policy, err := tlspolicy.New(tlsOptions)
+	if err != nil {
+		logging.Fatalf("%v", err)
+	}
+	policy.Apply(&config)
+	slog.Info(policy.String())
+
+	// If we have a client CA, every client must present a certificate signed
+	// by it (mutual TLS).
+	//
+	// The checks on the client's certificate go in verifiers, which are run
+	// by tls.Config.VerifyConnection on every handshake, including resumed
+	// sessions.
+	var verifiers []func(tls.ConnectionState) error
+	if len(*clientca) > 0 {
+		pool, err := loadCertPool(*clientca)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
 
-	if len(*certfile) == 0 || len(*keyfile) == 0 {
-		log.Fatalf("you must specify the cert file and the key file")
+		// Refuse client certificates that have been revoked.  See
+		// revocation.go.
+		if len(*crlfile) > 0 || *useOCSP {
+			checker, err := newRevocationChecker(settings.SplitList(*crlfile), *useOCSP, *revpolicy, *revcache)
+			if err != nil {
+				logging.Fatalf("%v", err)
+			}
+			go checker.watch(*crlpoll, stop)
+			verifiers = append(verifiers, checker.VerifyConnection)
+		}
+	} else if len(*crlfile) > 0 || *useOCSP {
+		logging.Fatalf("revocation checking (-crlfile or -ocsp) needs mutual TLS (-clientca)")
 	}
 
-	if _, err := os.Stat(*keyfile); os.IsNotExist(err) {
-		log.Fatalf("cannot open the key file %s", *keyfile)
+	// Keep an eye on when the certificates expire - ours, the client CA's
+	// and the clients'.  See expiry.go.
+	thresholds, err := parseThresholds(*expirywarn)
+	if err != nil {
+		logging.Fatalf("%v", err)
 	}
+	expiry := newExpiryMonitor(thresholds, certs.Leaves, metricsRegistry)
+	if len(*clientca) > 0 {
+		if err := expiry.trackCAs(*clientca); err != nil {
+			logging.Fatalf("%v", err)
+		}
+		verifiers = append(verifiers, expiry.VerifyConnection)
+	}
+	if len(verifiers) > 0 {
+		config.VerifyConnection = verifyAll(verifiers)
+	}
+	go expiry.watch(stop)
 
-	if _, err := os.Stat(*certfile); os.IsNotExist(err) {
-		log.Fatalf("cannot open the cert file %s", *certfile)
+	if len(*metricsaddr) > 0 {
+		go serveMetrics(*metricsaddr)
 	}
 
-	// Load the public certificate and the private key files.
-	cert, err := tls.LoadX509KeyPair(*certfile, *keyfile)
+	// A configuration reload can change the TLS policy and the client CAs,
+	// so each handshake gets its config from dynamicTLS.  See reload.go.
+	dynamic := newDynamicTLS(&config, policy, config.ClientCAs)
+	reload := newServerReloader(swappable, dynamic, expiry, logLevel, len(*clientca) > 0)
+	go reload.watch(*configpoll, stop)
 
-	config := tls.Config{Certificates: []tls.Certificate{cert}}
+	// The admin pages - pprof, channelz and so on.  They're on localhost, or
+	// they need a client certificate signed by -adminclientca.  With a client
+	// certificate they can also reload the configuration.  See adminhttp.go.
+	if len(*adminaddr) > 0 {
+		var adminTLS *tls.Config
+		if len(*adminclientca) > 0 {
+			pool, err := loadCertPool(*adminclientca)
+			if err != nil {
+				logging.Fatalf("%v", err)
+			}
+			adminTLS = &tls.Config{
+				GetCertificate: certs.GetCertificate,
+				ClientCAs:      pool,
+				ClientAuth:     tls.RequireAndVerifyClientCert,
+			}
+			policy.Apply(adminTLS)
+		} else if len(*adminallow) > 0 {
+			logging.Fatalf("-adminallow needs -adminclientca")
+		}
+		if err := checkAdminAddr(*adminaddr, adminTLS != nil); err != nil {
+			logging.Fatalf("%v", err)
+		}
+		pages := newAdminPages(conf, settings.SplitList(*adminallow))
+		if adminTLS != nil {
+			pages.reload = reload
+		}
+		go serveAdmin(*adminaddr, pages.handler(), adminTLS)
+	}
 
-	// Create the TLS server option.
-	serverOption := grpc.Creds(grpccred.NewTLS(&config))
+	// Create the TLS server option.  Failed handshakes are counted.
+	serverOption := grpc.Creds(serverMetrics.countHandshakes(grpccred.NewTLS(&config)))
 
 	// Create the gRPC server.
 	opts = append(opts, serverOption)
@@ -168,8 +489,137 @@ func main() {
 
 	// Register the reflection service on gRPC server.
 	reflection.Register(s)
+
+	// Register the standard health service, which load balancers use to
+	// decide whether to send us work.  See health.go.
+	ready := newReadiness(lis, certs, expiry, checkAuthBackend,
+		append([]statuser{expiry}, statusers...)...)
+	ready.sendDetail = *healthdetail
+	healthpb.RegisterHealthServer(s, ready)
+	go ready.watch(*healthinterval, stop)
+
+	// Shut down gracefully on SIGINT or SIGTERM.
+	stopped := shutdownOnSignal(s, ready.Server, tracker, *drainwait, *draintimeout, stop)
+
 	if err := s.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+		logging.Fatalf("failed to serve: %v", err)
+	}
+	<-stopped
+
+	// Send the spans that are still waiting.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := stopTracing(ctx); err != nil {
+		slog.Error("cannot send the last trace spans", "error", err)
+	}
+}
+
+// newServerReloader creates the reloader for the server's configuration and
+// adds the settings that can be reloaded.  swappable holds the certificates
+// (nil in ACME mode, when they can't be reloaded), dynamic holds the TLS
+// config, logLevel is the log level and mutualTLS says whether we started
+// with -clientca.
+func newServerReloader(swappable *swappableCerts, dynamic *dynamicTLS, expiry *expiryMonitor,
+	logLevel *slog.LevelVar, mutualTLS bool) *reloader {
+
+	r := &reloader{conf: conf}
+
+	r.add(func(snap *settings.Snapshot) (func(), error) {
+		fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+		opts := logging.Flags(fs)
+		if err := snap.Fill(fs); err != nil {
+			return nil, err
+		}
+		level, err := opts.LevelOf()
+		if err != nil {
+			return nil, err
+		}
+		return func() { logLevel.Set(level) }, nil
+	}, "loglevel", "v")
+
+	r.add(func(snap *settings.Snapshot) (func(), error) {
+		thresholds, err := parseThresholds(snap.String("expirywarn"))
+		if err != nil {
+			return nil, err
+		}
+		return func() { expiry.setThresholds(thresholds) }, nil
+	}, "expirywarn")
+
+	// The certificate files are read again on every reload, so that SIGHUP
+	// picks up a renewed certificate.
+	if swappable != nil {
+		r.addAlways(func(snap *settings.Snapshot) (func(), error) {
+			store, err := newCertStore(snap.String("certfile"), snap.String("keyfile"),
+				snap.Items("certpair"), snap.String("certdir"))
+			if err != nil {
+				return nil, err
+			}
+			return func() { swappable.swap(store) }, nil
+		}, "certfile", "keyfile", "certpair", "certdir")
+	}
+
+	r.add(func(snap *settings.Snapshot) (func(), error) {
+		fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+		opts := tlspolicy.Flags(fs)
+		if err := snap.Fill(fs); err != nil {
+			return nil, err
+		}
+		policy, err := tlspolicy.New(opts)
+		if err != nil {
+			return nil, err
+		}
+		caFile := snap.String("clientca")
+		var pool *x509.CertPool
+		if mutualTLS {
+			if pool, err = loadCertPool(caFile); err != nil {
+				return nil, err
+			}
+		}
+		return func() {
+			dynamic.set(dynamic.build(policy, pool))
+			slog.Info(policy.String())
+			if mutualTLS {
+				if err := expiry.trackCAs(caFile); err != nil {
+					slog.Error("cannot track the client CA certificates' expiry", "error", err)
+				}
+			}
+		}, nil
+	}, "tlsprofile", "tlsmin", "tlsmax", "tlsciphers", "tlscurves", "tlstickets", "clientca")
+
+	// Turning mutual TLS on or off changes too much - the revocation checks
+	// and so on - so only a change of CA file can be reloaded.
+	r.needsRestartIf("clientca", func(c settings.Change) bool {
+		return len(c.Old) == 0 || len(c.New) == 0
+	})
+
+	return r
+}
+
+// loadCertPool reads a file of PEM certificates and returns them as a pool.  It
+// returns an error if the file doesn't contain any.
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	pemData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+	return pool, nil
+}
+
+// verifyAll returns a tls.Config.VerifyConnection function that runs each of
+// the verifiers in turn and stops at the first one that refuses the
+// connection.
+func verifyAll(verifiers []func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		for _, verify := range verifiers {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 }
 
@@ -186,18 +636,22 @@ func OAuthUnaryInterceptor(
 	handler grpc.UnaryHandler,
 ) (interface{}, error) {
 
-	// retrieve metadata from context
-	md, ok := metadata.FromContext(ctx)
-	if !ok {
-		return nil, grpc.Errorf(codes.Unauthenticated, "no metadata in context")
+	// Health checks come from load balancers, which don't have a token.
+	if strings.HasPrefix(info.FullMethod, "/grpc.health.v1.Health/") {
+		return handler(ctx, req)
 	}
 
-	// validate the 'authorization' metadata
-	// like headers, the value is an slice []string
-	uid, err := validateOAUTHToken(md["authorization"])
+	// The check gets its own span in the trace.
+	_, span := tracing.Start(ctx, "auth check")
+	uid, err := checkToken(ctx)
+	tracing.End(span, err)
 	if err != nil {
-		return nil, grpc.Errorf(codes.Unauthenticated, "authentication failed - %s",
-			err.Error())
+		return nil, err
+	}
+
+	// Say who the caller is in the request log.
+	if info := requestInfoFrom(ctx); info != nil {
+		info.principal = fmt.Sprintf("user-%d", uid)
 	}
 
 	// add the user ID to the context
@@ -208,6 +662,44 @@ func OAuthUnaryInterceptor(
 	return handler(newCtx, req)
 }
 
+// checkToken finds the OAUTH token in the request's metadata and validates
+// it.  It returns the user ID, or an Unauthenticated error.
+func checkToken(ctx context.Context) (uint64, error) {
+	// retrieve metadata from context
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		serverMetrics.authFailure(authNoMetadata)
+		return 0, grpc.Errorf(codes.Unauthenticated, "no metadata in context")
+	}
+
+	// validate the 'authorization' metadata
+	// like headers, the value is an slice []string
+	uid, err := validateOAUTHToken(md["authorization"])
+	if err != nil {
+		if err == errNoToken {
+			serverMetrics.authFailure(authNoToken)
+		} else {
+			serverMetrics.authFailure(authInvalidToken)
+		}
+		return 0, grpc.Errorf(codes.Unauthenticated, "authentication failed - %s",
+			err.Error())
+	}
+	return uid, nil
+}
+
+// checkAuthBackend checks that the service that validates OAUTH tokens is
+// reachable, for the health checks.  validateOAUTHToken is a fake with no
+// backend, so it always is.  A real one would ask its OAUTH server here.
+func checkAuthBackend(ctx context.Context) error {
+	return nil
+}
+
+// The errors returned by validateOAUTHToken.
+var (
+	errNoToken      = errors.New("no authorization header")
+	errInvalidToken = errors.New("no valid authorization header")
+)
+
 // validateOAUTHToken searches through a slice of authorization headers.  If it
 // finds any containing an OAUTH token it validates them.  It reurns the ID of the
 // user that owns the first valid token that it finds.
@@ -215,28 +707,18 @@ func OAuthUnaryInterceptor(
 // This version is a fake.  It has a hard-wired OAUTH token.  It accepts only that
 // and if it finds it, return userID 2.  In a real application it would use an
 // OAUTH server to validate and fetch the user ID.
+//
+// The headers hold bearer tokens, so they must never be logged.
 func validateOAUTHToken(authHeaders []string) (uint64, error) {
-	if *verbose {
-		log.Printf("%d authorization headers", len(authHeaders))
+	if len(authHeaders) == 0 {
+		return 0, errNoToken
 	}
 	for i := range authHeaders {
-		if *verbose {
-			if *verbose {
-				log.Printf("authorization header %s", authHeaders[i])
-			}
-			if authHeaders[i] == "Bearer rTO69tZATgSqamjQn7v9HA" {
-				if *verbose {
-					log.Printf("authorised")
-				}
-				return 2, nil
-			}
+		if authHeaders[i] == "Bearer rTO69tZATgSqamjQn7v9HA" {
+			return 2, nil
 		}
 	}
 
 	// no valid auth header found
-	if *verbose {
-		log.Printf("authorisation failed")
-	}
-	return 0, errors.New("no valid authorization header")
-
+	return 0, errInvalidToken
 }
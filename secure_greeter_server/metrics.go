@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics.  With -metricsaddr the server publishes Prometheus metrics at
+// /metrics on a separate, plain HTTP, port:
+//
+//   - greeter_rpcs_total - RPCs finished, by method and status code,
+//   - greeter_rpc_duration_seconds - a histogram of RPC latency, by method,
+//   - greeter_rpcs_in_flight - RPCs running now, by method, from the
+//     rpcTracker that the shutdown uses (see shutdown.go),
+//   - greeter_auth_failures_total - refused tokens, by reason,
+//   - greeter_tls_handshake_failures_total - failed handshakes, by reason,
+//   - greeter_panics_total - handlers that panicked, by method (see
+//     recovery.go),
+//   - greeter_certificate_expiry_days and
+//     greeter_certificate_expiry_warnings_total - see expiry.go.
+
+// metricsRegistry holds the server's Prometheus metrics.  We use our own
+// registry rather than the global default one so that only the metrics we
+// choose are published.
+var metricsRegistry = prometheus.NewRegistry()
+
+// serverMetrics holds the RPC, authentication and handshake metrics.
+var serverMetrics = newRPCMetrics(metricsRegistry)
+
+// Reasons for refusing a token, for greeter_auth_failures_total.
+const (
+	authNoMetadata   = "no_metadata"
+	authNoToken      = "no_token"
+	authInvalidToken = "invalid_token"
+)
+
+// rpcMetrics counts RPCs, refused tokens and failed TLS handshakes.
+type rpcMetrics struct {
+	rpcs              *prometheus.CounterVec
+	latency           *prometheus.HistogramVec
+	inFlight          *prometheus.GaugeVec
+	authFailures      *prometheus.CounterVec
+	handshakeFailures *prometheus.CounterVec
+	panics            *prometheus.CounterVec
+}
+
+// newRPCMetrics creates the metrics and registers them with reg.
+func newRPCMetrics(reg prometheus.Registerer) *rpcMetrics {
+	m := &rpcMetrics{
+		rpcs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greeter_rpcs_total",
+			Help: "RPCs finished, by method and status code.",
+		}, []string{"method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "greeter_rpc_duration_seconds",
+			Help:    "How long RPCs took, by method.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"method"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "greeter_rpcs_in_flight",
+			Help: "RPCs running now, by method.",
+		}, []string{"method"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greeter_auth_failures_total",
+			Help: "Requests refused because of their OAUTH token, by reason.",
+		}, []string{"reason"}),
+		handshakeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greeter_tls_handshake_failures_total",
+			Help: "TLS handshakes that failed, by reason.",
+		}, []string{"reason"}),
+		panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greeter_panics_total",
+			Help: "RPC handlers that panicked, by method.",
+		}, []string{"method"}),
+	}
+	reg.MustRegister(m.rpcs, m.latency, m.inFlight, m.authFailures, m.handshakeFailures, m.panics)
+	return m
+}
+
+// unary is a grpc.UnaryServerInterceptor that counts and times unary RPCs.
+func (m *rpcMetrics) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	defer m.start(info.FullMethod)()
+	resp, err := handler(ctx, req)
+	m.rpcs.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+// stream is a grpc.StreamServerInterceptor that counts and times streaming
+// RPCs.
+func (m *rpcMetrics) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	defer m.start(info.FullMethod)()
+	err := handler(srv, ss)
+	m.rpcs.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return err
+}
+
+// start records the start of an RPC and returns a function that records how
+// long it took.
+func (m *rpcMetrics) start(method string) func() {
+	began := time.Now()
+	return func() {
+		m.latency.WithLabelValues(method).Observe(time.Since(began).Seconds())
+	}
+}
+
+// authFailure counts a refused token.
+func (m *rpcMetrics) authFailure(reason string) {
+	m.authFailures.WithLabelValues(reason).Inc()
+}
+
+// panicked counts a handler that panicked.
+func (m *rpcMetrics) panicked(method string) {
+	m.panics.WithLabelValues(method).Inc()
+}
+
+// countHandshakes wraps the server's transport credentials so that failed
+// handshakes are counted.
+func (m *rpcMetrics) countHandshakes(creds credentials.TransportCredentials) credentials.TransportCredentials {
+	return &countingCreds{TransportCredentials: creds, failures: m.handshakeFailures}
+}
+
+// countingCreds is a credentials.TransportCredentials that counts failed
+// server handshakes.
+type countingCreds struct {
+	credentials.TransportCredentials
+	failures *prometheus.CounterVec
+}
+
+func (c *countingCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	out, info, err := c.TransportCredentials.ServerHandshake(conn)
+	if err != nil {
+		c.failures.WithLabelValues(handshakeFailureReason(err)).Inc()
+	}
+	return out, info, err
+}
+
+func (c *countingCreds) Clone() credentials.TransportCredentials {
+	return &countingCreds{TransportCredentials: c.TransportCredentials.Clone(), failures: c.failures}
+}
+
+// handshakeFailureReason sorts handshake errors into a few reasons, to keep
+// the number of label values down.  It goes only by the type of the error,
+// since the text of the TLS package's errors can change from one Go release
+// to the next.  The errors that the package doesn't give a type, such as a
+// client not sending a certificate or not sharing a cipher suite with us,
+// count as "other".
+func handshakeFailureReason(err error) string {
+	var netErr net.Error
+	var opErr *net.OpError
+	var alert tls.AlertError
+	var recordHeader tls.RecordHeaderError
+	var revoked revocationError
+	var invalid x509.CertificateInvalidError
+	var unknownCA x509.UnknownAuthorityError
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET):
+		return "client_hung_up"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &alert) || errors.As(err, &opErr) && opErr.Op == "remote error":
+		// The client sent an alert, usually because it didn't like our
+		// certificate.  Over TCP the TLS package reports it as an OpError
+		// with this op, wrapping a value of its own unexported alert type.
+		return "client_refused"
+	case errors.As(err, &recordHeader):
+		return "not_tls"
+	case errors.As(err, &revoked):
+		return "client_certificate_revoked"
+	case errors.As(err, &invalid) || errors.As(err, &unknownCA):
+		return "bad_client_certificate"
+	default:
+		return "other"
+	}
+}
+
+// serveMetrics publishes the metrics at /metrics on addr, for Prometheus to
+// scrape.  It's plain HTTP, so addr should normally be on a private network
+// or localhost.  It runs until the listener fails, so it should be started as
+// a goroutine.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	slog.Info("serving metrics", "url", "http://"+addr+"/metrics")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("metrics listener failed", "addr", addr, "error", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+func TestRPCMetrics(t *testing.T) {
+	m := newRPCMetrics(prometheus.NewRegistry())
+	info := &grpc.UnaryServerInfo{FullMethod: "/helloworld.Greeter/SayHello"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "no such greeting")
+	}
+	m.unary(context.Background(), nil, info, handler)
+	m.unary(context.Background(), nil, info, handler)
+
+	if n := testutil.ToFloat64(m.rpcs.WithLabelValues(info.FullMethod, "NotFound")); n != 2 {
+		t.Errorf("want 2 NotFound RPCs counted, got %v", n)
+	}
+	if n := testutil.CollectAndCount(m.latency); n != 1 {
+		t.Errorf("want one latency histogram, got %d", n)
+	}
+}
+
+// TestHandshakeFailures makes handshakes fail in different ways and checks
+// that they're counted under the right reasons.
+func TestHandshakeFailures(t *testing.T) {
+	dir := t.TempDir()
+	certfile, keyfile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeSelfSigned(t, "localhost", time.Hour, certfile, keyfile)
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newRPCMetrics(prometheus.NewRegistry())
+	creds := m.countHandshakes(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	var tests = []struct {
+		reason string
+		client func(conn net.Conn)
+	}{
+		{"client_hung_up", func(conn net.Conn) {}},
+		{"not_tls", func(conn net.Conn) {
+			conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		}},
+		{"client_refused", func(conn net.Conn) {
+			// The client doesn't trust our self-signed certificate.
+			tls.Client(conn, &tls.Config{ServerName: "localhost"}).Handshake()
+		}},
+		{"other", func(conn net.Conn) {
+			// The TLS package doesn't give a missing client certificate a
+			// type of its own.
+			tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+		}},
+	}
+	for _, test := range tests {
+		go func() {
+			conn, err := net.Dial("tcp", lis.Addr().String())
+			if err != nil {
+				return
+			}
+			test.client(conn)
+			conn.Close()
+		}()
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := creds.ServerHandshake(conn); err == nil {
+			t.Errorf("%s: the handshake worked", test.reason)
+		}
+		if n := testutil.ToFloat64(m.handshakeFailures.WithLabelValues(test.reason)); n != 1 {
+			t.Errorf("%s: want 1 failure counted, got %v (other: %v)", test.reason, n,
+				testutil.ToFloat64(m.handshakeFailures.WithLabelValues("other")))
+		}
+	}
+}
+
+func TestHandshakeFailureReason(t *testing.T) {
+	var tests = []struct {
+		err  error
+		want string
+	}{
+		{&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, "bad_client_certificate"},
+		{&tls.CertificateVerificationError{Err: x509.CertificateInvalidError{Reason: x509.Expired}}, "bad_client_certificate"},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, "not_tls"},
+		{revocationError{errors.New("client certificate alice was revoked")}, "client_certificate_revoked"},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "client_hung_up"},
+		{&net.OpError{Op: "remote error", Err: tls.AlertError(42)}, "client_refused"},
+		// A problem with our own certificate isn't the client's fault.
+		{errors.New("tls: no certificates configured"), "other"},
+		// Errors without a type of their own aren't sorted by their text.
+		{errors.New("tls: client didn't provide a certificate"), "other"},
+		{errors.New("tls: no cipher suite supported by both client and server"), "other"},
+		{&net.OpError{Op: "read", Err: errors.New("remote error: tls: bad certificate")}, "other"},
+	}
+	for _, test := range tests {
+		if got := handshakeFailureReason(test.err); got != test.want {
+			t.Errorf("%v: want %s, got %s", test.err, test.want, got)
+		}
+	}
+}
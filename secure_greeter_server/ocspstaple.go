@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goblimey/grpc/keypair"
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSP stapling.  A client can check whether our certificate has been revoked
+// by asking the CA's OCSP responder, but that's slow, it tells the CA who is
+// talking to us, and it fails if the responder is down.  Instead, the server
+// asks the responder itself, every so often, and sends ("staples") the signed
+// response along with its certificate during the handshake.  The client can
+// check the response's signature, so it doesn't have to trust us.
+//
+// The certificate must name an OCSP responder, which certificates from public
+// CAs do, and the server needs the certificate of the CA that issued it.  That
+// normally comes from the cert file, which should hold the full chain, or it
+// can be given with -ocspissuer.
+//
+// Responses are fetched when a certificate is first used and refreshed when
+// half of their validity period has passed, so there's plenty of time to try
+// again before nextUpdate if the responder is down.
+
+// ocspRetryInterval is how long the stapler waits before trying a failed
+// fetch again.
+const ocspRetryInterval = time.Minute
+
+// stapler wraps a certSource and staples OCSP responses to its certificates.
+type stapler struct {
+	source certSource
+	issuer *x509.Certificate // from -ocspissuer, or nil
+	client *http.Client
+
+	mu      sync.Mutex
+	staples map[string]*staple // keyed by the SHA-256 of the certificate
+}
+
+// staple holds what we know about the OCSP status of one certificate.
+type staple struct {
+	leaf     *x509.Certificate
+	issuer   *x509.Certificate
+	raw      []byte         // the response to staple, or nil
+	resp     *ocsp.Response // raw, parsed
+	lastErr  error
+	lastTry  time.Time
+	fetching bool
+}
+
+// newStapler creates a stapler.  If issuerFile is not empty, the issuer
+// certificate is read from it.
+func newStapler(source certSource, issuerFile string) (*stapler, error) {
+	s := &stapler{
+		source:  source,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		staples: make(map[string]*staple),
+	}
+	if len(issuerFile) > 0 {
+		certs, err := keypair.ReadCertificates(issuerFile)
+		if err != nil {
+			return nil, err
+		}
+		s.issuer = certs[0]
+	}
+	return s, nil
+}
+
+// GetCertificate gets a certificate from the source and staples the OCSP
+// response to it, if we have a valid one.  It has the signature of
+// tls.Config.GetCertificate.
+func (s *stapler) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := s.source.GetCertificate(hello)
+	if err != nil || cert == nil || len(cert.Certificate) == 0 {
+		return cert, err
+	}
+
+	key := fingerprint(cert.Certificate[0])
+	s.mu.Lock()
+	st, ok := s.staples[key]
+	if !ok {
+		st = s.newStaple(cert)
+		s.staples[key] = st
+	}
+	var raw []byte
+	if st.valid(time.Now()) {
+		raw = st.raw
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		// A certificate we haven't seen before, perhaps just renewed.  Fetch
+		// its response in the background rather than holding up the handshake.
+		go s.refresh(key)
+	}
+	if raw == nil {
+		return cert, nil
+	}
+	stapled := *cert
+	stapled.OCSPStaple = raw
+	return &stapled, nil
+}
+
+// NotAfter returns the source's NotAfter.
+func (s *stapler) NotAfter() time.Time {
+	return s.source.NotAfter()
+}
+
+// Leaves returns the source's Leaves.
+func (s *stapler) Leaves() []*x509.Certificate {
+	return s.source.Leaves()
+}
+
+// newStaple creates the staple record for a certificate.  If we can't staple
+// it the reason is recorded in lastErr.
+func (s *stapler) newStaple(cert *tls.Certificate) *staple {
+	st := &staple{}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		st.lastErr = err
+		return st
+	}
+	st.leaf = leaf
+	if len(leaf.OCSPServer) == 0 {
+		st.lastErr = errors.New("the certificate names no OCSP responder")
+		return st
+	}
+	st.issuer = s.issuer
+	if st.issuer == nil && len(cert.Certificate) > 1 {
+		st.issuer, err = x509.ParseCertificate(cert.Certificate[1])
+		if err != nil {
+			st.lastErr = err
+			return st
+		}
+	}
+	if st.issuer == nil {
+		st.lastErr = errors.New("no issuer certificate - put the chain in the cert file or use -ocspissuer")
+		return st
+	}
+	if err := leaf.CheckSignatureFrom(st.issuer); err != nil {
+		st.issuer = nil
+		st.lastErr = fmt.Errorf("the issuer certificate did not sign the certificate - %v", err)
+	}
+	return st
+}
+
+// valid returns true if we have a response that can be stapled at time now.
+// A response without a nextUpdate never goes out of date.
+func (st *staple) valid(now time.Time) bool {
+	return st.resp != nil && (st.resp.NextUpdate.IsZero() || now.Before(st.resp.NextUpdate))
+}
+
+// needsRefresh returns true if it's time to fetch a new response.
+func (st *staple) needsRefresh(now time.Time) bool {
+	if st.issuer == nil || st.fetching {
+		return false
+	}
+	if st.resp == nil {
+		return now.Sub(st.lastTry) >= ocspRetryInterval
+	}
+	if st.resp.NextUpdate.IsZero() {
+		// The responder says it always has fresh information, so there's no
+		// deadline.  Refresh every hour.
+		return now.Sub(st.lastTry) >= time.Hour
+	}
+	halfway := st.resp.ThisUpdate.Add(st.resp.NextUpdate.Sub(st.resp.ThisUpdate) / 2)
+	return now.After(halfway) && now.Sub(st.lastTry) >= ocspRetryInterval
+}
+
+// refresh fetches a new response for the certificate with the given key.  If
+// the fetch fails, the old response is kept until its nextUpdate.
+func (s *stapler) refresh(key string) {
+	s.mu.Lock()
+	st := s.staples[key]
+	if st == nil || !st.needsRefresh(time.Now()) {
+		s.mu.Unlock()
+		return
+	}
+	st.fetching = true
+	st.lastTry = time.Now()
+	leaf, issuer := st.leaf, st.issuer
+	s.mu.Unlock()
+
+	resp, raw, err := s.fetch(leaf, issuer)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st.fetching = false
+	if err != nil {
+		if st.lastErr == nil || st.lastErr.Error() != err.Error() {
+			slog.Warn("cannot get an OCSP staple", "names", certNames(leaf), "error", err)
+		}
+		st.lastErr = err
+		return
+	}
+	if st.resp == nil || st.resp.Status != resp.Status || st.lastErr != nil {
+		slog.Info("OCSP staple", "names", certNames(leaf), "status", describeStaple(resp))
+	}
+	st.resp = resp
+	st.raw = raw
+	st.lastErr = nil
+}
+
+// fetch asks the OCSP responder for the status of leaf.
+func (s *stapler) fetch(leaf, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	resp, err := queryOCSP(s.client, leaf.OCSPServer[0], leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Status == ocsp.Revoked {
+		// Stapling this would only make every client refuse us.  Log it
+		// loudly - the certificate needs replacing.
+		return nil, nil, fmt.Errorf("the certificate has been REVOKED (reason %s) - replace it",
+			reasonName(resp.RevocationReason))
+	}
+	if resp.Status != ocsp.Good {
+		return nil, nil, errors.New("the OCSP responder doesn't know the certificate")
+	}
+	return resp, resp.Raw, nil
+}
+
+// watch refreshes the responses as they become due, until stop is closed.
+// It should be started as a goroutine.
+func (s *stapler) watch(stop <-chan struct{}) {
+	// Get the default certificate's response straight away.
+	s.GetCertificate(&tls.ClientHelloInfo{})
+
+	ticker := time.NewTicker(ocspRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.prune()
+			s.mu.Lock()
+			var keys []string
+			for key := range s.staples {
+				keys = append(keys, key)
+			}
+			s.mu.Unlock()
+			for _, key := range keys {
+				s.refresh(key)
+			}
+		}
+	}
+}
+
+// prune forgets the staples of certificates that the source no longer has,
+// such as the ones that renewed certificates replaced.
+func (s *stapler) prune() {
+	current := make(map[string]bool)
+	for _, leaf := range s.source.Leaves() {
+		current[fingerprint(leaf.Raw)] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.staples {
+		if !current[key] {
+			delete(s.staples, key)
+		}
+	}
+}
+
+// Status describes the staple of each certificate, for the log and for
+// health checks.
+func (s *stapler) Status() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines []string
+	now := time.Now()
+	for _, st := range s.staples {
+		name := "unknown certificate"
+		if st.leaf != nil {
+			name = strings.Join(certNames(st.leaf), ",")
+		}
+		switch {
+		case st.valid(now):
+			lines = append(lines, name+": "+describeStaple(st.resp))
+		case st.lastErr != nil:
+			lines = append(lines, name+": no staple - "+st.lastErr.Error())
+		default:
+			lines = append(lines, name+": no staple yet")
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "; ")
+}
+
+// describeStaple describes an OCSP response.
+func describeStaple(resp *ocsp.Response) string {
+	if resp.NextUpdate.IsZero() {
+		return fmt.Sprintf("good, produced %s", resp.ProducedAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("good until %s", resp.NextUpdate.Format(time.RFC3339))
+}
+
+// fingerprint returns the SHA-256 hash of a DER certificate as a map key.
+func fingerprint(der []byte) string {
+	hash := sha256.Sum256(der)
+	return string(hash[:])
+}
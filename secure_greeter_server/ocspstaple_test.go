@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// fixedCertSource is a certSource that always returns the same certificate.
+type fixedCertSource struct {
+	cert *tls.Certificate
+}
+
+func (f *fixedCertSource) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return f.cert, nil
+}
+
+func (f *fixedCertSource) NotAfter() time.Time {
+	return f.cert.Leaf.NotAfter
+}
+
+func (f *fixedCertSource) Leaves() []*x509.Certificate {
+	return []*x509.Certificate{f.cert.Leaf}
+}
+
+func TestStapler(t *testing.T) {
+	dir := t.TempDir()
+	newKey := func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	caCert, caKey, err := createCA(dir, "test CA", time.Hour, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fake OCSP responder that says every certificate is good.
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		resp, err := ocsp.CreateResponse(caCert, caCert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now,
+			NextUpdate:   now.Add(time.Hour),
+		}, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:  []string{responder.URL},
+	}
+	if err := createLeaf(dir, "server.crt", "server.key", template, time.Hour,
+		caCert, caKey, newKey, false); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := loadKeyPair(dir+"/server.crt", dir+"/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The chain, as it would be in a cert file from a public CA.
+	cert.Certificate = append(cert.Certificate, caCert.Raw)
+
+	s, err := newStapler(&fixedCertSource{cert}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first handshake has no staple, but starts the fetch.
+	got, _ := s.GetCertificate(&tls.ClientHelloInfo{})
+	if got.OCSPStaple != nil {
+		t.Error("didn't expect a staple on the first handshake")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for got.OCSPStaple == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		got, _ = s.GetCertificate(&tls.ClientHelloInfo{})
+	}
+	if got.OCSPStaple == nil {
+		t.Fatalf("no staple after 5 seconds - %s", s.Status())
+	}
+	resp, err := ocsp.ParseResponseForCert(got.OCSPStaple, cert.Leaf, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != ocsp.Good {
+		t.Errorf("expected a good status, got %d", resp.Status)
+	}
+
+	// The source's certificate isn't changed.
+	if cert.OCSPStaple != nil {
+		t.Error("the stapler changed the source's certificate")
+	}
+}
+
+// TestStaplerNoNextUpdate checks that a response without a nextUpdate, which
+// never goes out of date, is stapled, and that the staples of certificates
+// that have been replaced are dropped.
+func TestStaplerNoNextUpdate(t *testing.T) {
+	dir := t.TempDir()
+	load := func(name string) *tls.Certificate {
+		certfile, keyfile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+		writeSelfSigned(t, name, time.Hour, certfile, keyfile)
+		cert, err := loadKeyPair(certfile, keyfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	old := load("old.example.com")
+	source := &fixedCertSource{old}
+	s, err := newStapler(source, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A response that we already have, with no issuer so that it isn't
+	// fetched again.
+	s.staples[fingerprint(old.Certificate[0])] = &staple{
+		leaf: old.Leaf,
+		resp: &ocsp.Response{Status: ocsp.Good, ThisUpdate: time.Now()},
+		raw:  []byte("response"),
+	}
+	got, _ := s.GetCertificate(&tls.ClientHelloInfo{})
+	if string(got.OCSPStaple) != "response" {
+		t.Errorf("a response without a nextUpdate wasn't stapled - %s", s.Status())
+	}
+
+	source.cert = load("new.example.com")
+	s.GetCertificate(&tls.ClientHelloInfo{})
+	s.prune()
+	s.mu.Lock()
+	_, kept := s.staples[fingerprint(old.Certificate[0])]
+	_, added := s.staples[fingerprint(source.cert.Certificate[0])]
+	s.mu.Unlock()
+	if kept || !added {
+		t.Errorf("want only the new certificate's staple, got old %v and new %v", kept, added)
+	}
+}
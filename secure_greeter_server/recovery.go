@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Panic recovery.  A panic in a handler would normally crash the whole
+// server, taking every other client's RPCs with it.  Instead the recovery
+// interceptors catch it, log it at level ERROR with the stack trace and the
+// request ID, count it in greeter_panics_total and send the client an
+// INTERNAL error.  The client isn't told what went wrong, since the panic
+// message might give away something about the server, but it gets the request
+// ID as usual, which leads to the log.
+//
+// With -panicfile each panic is also appended to a file, as one line of JSON,
+// so that panics can be collected without searching the log.
+//
+// Only panics in the RPC's own goroutine can be caught.  A panic in a
+// goroutine that a handler starts still crashes the server.
+
+// internalErrorMessage is what the client is told when a handler panics.
+const internalErrorMessage = "internal server error"
+
+// panicReport describes a panic, for the -panicfile file.
+type panicReport struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Method    string    `json:"method"`
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+}
+
+// panicRecovery holds the recovery interceptors' settings.
+type panicRecovery struct {
+	metrics *rpcMetrics
+
+	// report, if it's set, is called with each panic after it's logged.
+	report func(panicReport)
+}
+
+// unary is a grpc.UnaryServerInterceptor that recovers from panics in unary
+// handlers.
+func (r *panicRecovery) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (resp interface{}, err error) {
+
+	defer func() {
+		if v := recover(); v != nil {
+			resp, err = nil, r.recovered(ctx, info.FullMethod, v)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// stream is a grpc.StreamServerInterceptor that recovers from panics in
+// streaming handlers.
+func (r *panicRecovery) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) (err error) {
+
+	defer func() {
+		if v := recover(); v != nil {
+			err = r.recovered(ss.Context(), info.FullMethod, v)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// recovered logs, counts and reports a panic with value v, and returns the
+// error for the client.  It must be called from the deferred function, so
+// that the stack trace shows where the panic happened.
+func (r *panicRecovery) recovered(ctx context.Context, method string, v interface{}) error {
+	report := panicReport{
+		Time:   time.Now(),
+		Method: method,
+		Panic:  fmt.Sprint(v),
+		Stack:  string(debug.Stack()),
+	}
+	if info := requestInfoFrom(ctx); info != nil {
+		report.RequestID = info.id
+	}
+	requestLogger(ctx).Error("panic in RPC handler", "method", method, "panic", report.Panic, "stack", report.Stack)
+	if r.metrics != nil {
+		r.metrics.panicked(method)
+	}
+	if r.report != nil {
+		r.report(report)
+	}
+	return status.Error(codes.Internal, internalErrorMessage)
+}
+
+// panicFile returns a report function that appends each report to a file as
+// a line of JSON.  The file is opened at once, so that a bad name is found
+// at startup rather than at the first panic.
+func panicFile(name string) (func(panicReport), error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open panic file - %v", err)
+	}
+	var mu sync.Mutex
+	return func(report panicReport) {
+		line, _ := json.Marshal(report)
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			slog.Error("cannot write to the panic file", "file", name, "error", err)
+		}
+	}, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRecovery(t *testing.T) {
+	var logged bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, nil)))
+	defer slog.SetDefault(old)
+
+	var reports []panicReport
+	r := &panicRecovery{
+		metrics: newRPCMetrics(prometheus.NewRegistry()),
+		report:  func(report panicReport) { reports = append(reports, report) },
+	}
+	ctx := context.WithValue(context.Background(), requestInfoKey{}, &requestInfo{id: "req-1"})
+	const method = "/helloworld.Greeter/SayHello"
+
+	unary := func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("the database password is hunter2")
+	}
+	resp, err := r.unary(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, unary)
+	if resp != nil || status.Code(err) != codes.Internal {
+		t.Errorf("want an INTERNAL error, got %v %v", resp, err)
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("the error gives away the panic: %v", err)
+	}
+
+	stream := func(srv interface{}, ss grpc.ServerStream) error {
+		var m map[string]int
+		m["oops"]++ // assignment to a nil map
+		return nil
+	}
+	err = r.stream(nil, &contextStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: method}, stream)
+	if status.Code(err) != codes.Internal {
+		t.Errorf("stream: want an INTERNAL error, got %v", err)
+	}
+
+	// A handler that doesn't panic is left alone.
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return "done", nil }
+	if resp, err := r.unary(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, ok); resp != "done" || err != nil {
+		t.Errorf("want done, got %v %v", resp, err)
+	}
+
+	if n := testutil.ToFloat64(r.metrics.panics.WithLabelValues(method)); n != 2 {
+		t.Errorf("want 2 panics counted, got %v", n)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("want 2 reports, got %d", len(reports))
+	}
+	if reports[0].RequestID != "req-1" || reports[0].Method != method ||
+		!strings.Contains(reports[0].Panic, "hunter2") || !strings.Contains(reports[0].Stack, "recovery_test.go") {
+		t.Errorf("unexpected report %+v", reports[0])
+	}
+	if !strings.Contains(reports[1].Panic, "nil map") {
+		t.Errorf("stream: unexpected report %+v", reports[1])
+	}
+
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 log records, got %s", logged.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["level"] != "ERROR" || record["request_id"] != "req-1" ||
+		!strings.Contains(record["stack"].(string), "recovery_test.go") {
+		t.Errorf("unexpected log record %v", record)
+	}
+}
+
+func TestPanicFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "panics.json")
+	report, err := panicFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report(panicReport{RequestID: "req-1", Method: "/a.B/C", Panic: "one", Stack: "line 1\nline 2"})
+	report(panicReport{RequestID: "req-2", Method: "/a.B/C", Panic: "two"})
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want one line per panic, got %q", data)
+	}
+	var got panicReport
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.RequestID != "req-1" || got.Stack != "line 1\nline 2" {
+		t.Errorf("unexpected report %+v", got)
+	}
+
+	if _, err := panicFile(filepath.Join(t.TempDir(), "no", "such", "dir", "panics.json")); err == nil {
+		t.Error("expected an error for a file that can't be created")
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/goblimey/grpc/settings"
+	"github.com/goblimey/grpc/tlspolicy"
+	"golang.org/x/net/context"
+)
+
+// Configuration reload.  Some settings can be changed while the server runs,
+// without dropping the clients' connections:
+//
+//   - the certificates and keys (-certfile, -keyfile, -certpair and -certdir),
+//   - the TLS security policy (-tlsprofile and so on),
+//   - the client CA file (-clientca), as long as mutual TLS stays on,
+//   - the expiry warning thresholds (-expirywarn) and
+//   - the log level (-loglevel and -v).
+//
+// There are no auth settings, scopes or rate limits to reload yet - the
+// OAUTH token is hard-wired (see validateOAUTHToken).
+//
+// A reload is triggered by SIGHUP, by a change to the configuration file
+// (checked every -configpoll) or by a POST to /reload on the admin listener,
+// which is only offered when the admin pages need a client certificate (see
+// adminhttp.go).  The configuration file and the environment are read again
+// and the new values are checked before any of them is used.  Only the
+// reloadable settings are changed, and only in the settings' current snapshot
+// - the flag variables keep the values that the server started with, so the
+// code that reads a reloadable setting after startup must read it from
+// conf.Current().  If anything is wrong, nothing changes and the server
+// carries on as it was.  Changes to other settings are reported as
+// needing a restart and are ignored until then.  Settings given on the
+// command line can't be changed by a reload.
+//
+// Every reload also reads the certificate and key files again, whether or not
+// their settings changed, so SIGHUP installs a renewed certificate straight
+// away.  (The certificate watchers only poll the files - the reloader is the
+// only thing that handles SIGHUP, so that one signal means one reload.)
+
+// reloadGroup is a set of settings that can be changed while the server
+// runs.
+type reloadGroup struct {
+	names []string
+
+	// prepare checks the new values of the settings, in snap, and returns a
+	// function that puts them into effect.  It mustn't change anything
+	// itself, so that if another group fails, nothing has changed.
+	prepare func(snap *settings.Snapshot) (func(), error)
+
+	// always says that prepare is called on every reload, even if none of
+	// the settings changed, because the group reads files that may have.
+	always bool
+}
+
+// reloader reloads the configuration.
+type reloader struct {
+	conf   *settings.Settings
+	groups []reloadGroup
+
+	// restartIf holds conditions under which a reloadable setting needs a
+	// restart after all.
+	restartIf map[string]func(c settings.Change) bool
+
+	mu sync.Mutex // one reload at a time
+}
+
+// reloadReport says what a reload did.
+type reloadReport struct {
+	applied []settings.Change
+	restart []settings.Change
+}
+
+func (r reloadReport) String() string {
+	if len(r.applied) == 0 && len(r.restart) == 0 {
+		return "nothing changed"
+	}
+	var parts []string
+	if len(r.applied) > 0 {
+		parts = append(parts, "applied "+joinChanges(r.applied))
+	}
+	if len(r.restart) > 0 {
+		parts = append(parts, "needs a restart, ignored until then: "+joinChanges(r.restart))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func joinChanges(changes []settings.Change) string {
+	var s []string
+	for _, c := range changes {
+		s = append(s, c.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// add adds a group of reloadable settings.
+func (r *reloader) add(prepare func(snap *settings.Snapshot) (func(), error), names ...string) {
+	r.groups = append(r.groups, reloadGroup{names: names, prepare: prepare})
+}
+
+// addAlways adds a group of reloadable settings whose prepare function is
+// called on every reload, changed or not.
+func (r *reloader) addAlways(prepare func(snap *settings.Snapshot) (func(), error), names ...string) {
+	r.groups = append(r.groups, reloadGroup{names: names, prepare: prepare, always: true})
+}
+
+// needsRestartIf says that a change to a reloadable setting needs a restart
+// if cond is true.
+func (r *reloader) needsRestartIf(name string, cond func(c settings.Change) bool) {
+	if r.restartIf == nil {
+		r.restartIf = make(map[string]func(c settings.Change) bool)
+	}
+	r.restartIf[name] = cond
+}
+
+// reload reads the configuration again and puts the reloadable changes into
+// effect.  If anything is wrong it changes nothing and returns an error.
+func (r *reloader) reload() (reloadReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var report reloadReport
+	changes, err := r.conf.Reload()
+	if err != nil {
+		return report, err
+	}
+
+	// Only the settings that we can change go into the new snapshot.  The
+	// others keep their old values until a restart.
+	changed := make(map[string]bool)
+	for _, c := range changes {
+		if r.reloadable(c) {
+			report.applied = append(report.applied, c)
+			changed[c.Name] = true
+		} else {
+			report.restart = append(report.restart, c)
+		}
+	}
+	next := r.conf.Next(report.applied)
+
+	var applies []func()
+	for _, g := range r.groups {
+		if !g.always && !g.changed(changed) {
+			continue
+		}
+		apply, err := g.prepare(next)
+		if err != nil {
+			return reloadReport{}, err
+		}
+		applies = append(applies, apply)
+	}
+	r.conf.Publish(next)
+	for _, apply := range applies {
+		apply()
+	}
+	return report, nil
+}
+
+func (r *reloader) reloadable(c settings.Change) bool {
+	if cond, ok := r.restartIf[c.Name]; ok && cond(c) {
+		return false
+	}
+	for _, g := range r.groups {
+		for _, name := range g.names {
+			if name == c.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (g reloadGroup) changed(changed map[string]bool) bool {
+	for _, name := range g.names {
+		if changed[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadAndLog reloads the configuration and logs the result.
+func (r *reloader) reloadAndLog(why string) (reloadReport, error) {
+	report, err := r.reload()
+	if err != nil {
+		slog.Error("configuration not reloaded, carrying on as before", "trigger", why, "error", err)
+		return report, err
+	}
+	slog.Info("configuration reloaded", "trigger", why, "changes", report.String())
+	return report, nil
+}
+
+// watch reloads the configuration when the process receives SIGHUP or, if
+// pollInterval isn't zero, when the configuration file's modification time
+// changes.  It runs until stop is closed and should be started as a
+// goroutine.
+func (r *reloader) watch(pollInterval time.Duration, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	file := r.conf.File()
+	var tick <-chan time.Time
+	if pollInterval > 0 && len(file) > 0 {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	lastMod := modTime(file)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			r.reloadAndLog("SIGHUP")
+		case <-tick:
+			if mod := modTime(file); !mod.Equal(lastMod) {
+				lastMod = mod
+				r.reloadAndLog(file + " changed")
+			}
+		}
+	}
+}
+
+// modTime returns the modification time of a file, or the zero time if it
+// can't be read.
+func modTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// swappableCerts is a certSource holding a certStore that a reload can
+// replace.  The old store's file watchers are stopped.
+type swappableCerts struct {
+	pollInterval time.Duration
+	serverDone   context.Context // cancelled when the server stops
+
+	mu        sync.RWMutex
+	store     *certStore
+	stopWatch context.CancelFunc // stops the store's watchers
+}
+
+// newSwappableCerts creates a swappableCerts holding store and starts
+// watching its files until stop is closed.
+func newSwappableCerts(store *certStore, pollInterval time.Duration, stop <-chan struct{}) *swappableCerts {
+	serverDone, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	c := &swappableCerts{pollInterval: pollInterval, serverDone: serverDone}
+	c.swap(store)
+	return c
+}
+
+// swap replaces the store.
+func (c *swappableCerts) swap(store *certStore) {
+	watching, stopWatch := context.WithCancel(c.serverDone)
+	store.watch(c.pollInterval, watching.Done())
+
+	c.mu.Lock()
+	old := c.stopWatch
+	c.store, c.stopWatch = store, stopWatch
+	c.mu.Unlock()
+	if old != nil {
+		old()
+	}
+}
+
+func (c *swappableCerts) current() *certStore {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.store
+}
+
+func (c *swappableCerts) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current().GetCertificate(hello)
+}
+
+func (c *swappableCerts) NotAfter() time.Time {
+	return c.current().NotAfter()
+}
+
+func (c *swappableCerts) Leaves() []*x509.Certificate {
+	return c.current().Leaves()
+}
+
+// dynamicTLS holds the TLS config that a reload can change - the security
+// policy and the client CAs.  Each handshake gets the current one through
+// GetConfigForClient.
+type dynamicTLS struct {
+	base    *tls.Config
+	current atomic.Pointer[tls.Config]
+}
+
+// newDynamicTLS creates a dynamicTLS from base, which holds everything else
+// (the certificates, the verification callbacks and so on), and sets base's
+// GetConfigForClient to use it.
+func newDynamicTLS(base *tls.Config, policy *tlspolicy.Policy, clientCAs *x509.CertPool) *dynamicTLS {
+	d := &dynamicTLS{base: base.Clone()}
+	d.current.Store(d.build(policy, clientCAs))
+	base.GetConfigForClient = d.GetConfigForClient
+	return d
+}
+
+// build makes a config from the base config, policy and clientCAs.
+func (d *dynamicTLS) build(policy *tlspolicy.Policy, clientCAs *x509.CertPool) *tls.Config {
+	config := d.base.Clone()
+	policy.Apply(config)
+	config.ClientCAs = clientCAs
+
+	// gRPC insists on HTTP/2, which the credentials normally add.
+	if !contains(config.NextProtos, "h2") {
+		config.NextProtos = append(config.NextProtos, "h2")
+	}
+	return config
+}
+
+func (d *dynamicTLS) set(config *tls.Config) {
+	d.current.Store(config)
+}
+
+// GetConfigForClient has the signature of tls.Config.GetConfigForClient.
+func (d *dynamicTLS) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	return d.current.Load(), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/goblimey/grpc/settings"
+	"github.com/goblimey/grpc/tlspolicy"
+)
+
+// TestReload reloads a configuration with a reloadable setting, a setting
+// that needs a restart and a setting that needs a restart only sometimes.
+func TestReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "greeter.yaml")
+	write := func(text string) {
+		if err := ioutil.WriteFile(file, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("level: 1\nport: 1000\nca: a.crt\n")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	level := fs.Int("level", 0, "")
+	port := fs.Int("port", 0, "")
+	ca := fs.String("ca", "", "")
+	conf := settings.New(fs, "TEST_RELOAD_")
+	if err := conf.Parse([]string{"-config", file}); err != nil {
+		t.Fatal(err)
+	}
+
+	var applied, caApplied, portSeen int
+	var failNext bool
+	r := &reloader{conf: conf}
+	r.add(func(snap *settings.Snapshot) (func(), error) {
+		// The port needs a restart, so it never changes, even in the
+		// snapshot that the reloadable settings are checked in.
+		portSeen, _ = strconv.Atoi(snap.String("port"))
+		if failNext {
+			return nil, errors.New("bad level")
+		}
+		newLevel, _ := strconv.Atoi(snap.String("level"))
+		return func() { applied = newLevel }, nil
+	}, "level")
+	r.add(func(snap *settings.Snapshot) (func(), error) {
+		return func() { caApplied++ }, nil
+	}, "ca")
+	var reread int
+	r.addAlways(func(snap *settings.Snapshot) (func(), error) {
+		return func() { reread++ }, nil
+	}, "certfile")
+	r.needsRestartIf("ca", func(c settings.Change) bool { return len(c.New) == 0 })
+
+	write("level: 2\nport: 2000\nca: b.crt\n")
+	report, err := r.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "applied ca (a.crt -> b.crt), level (1 -> 2); " +
+		"needs a restart, ignored until then: port (1000 -> 2000)"
+	if report.String() != want {
+		t.Errorf("want report %q, got %q", want, report.String())
+	}
+	if applied != 2 || caApplied != 1 || conf.Current().String("port") != "1000" || portSeen != 1000 {
+		t.Errorf("want level 2 applied, ca applied once and port 1000, got %d, %d, %s and %d",
+			applied, caApplied, conf.Current().String("port"), portSeen)
+	}
+	// The flags keep the values that we started with.
+	if *level != 1 || *port != 1000 || *ca != "a.crt" {
+		t.Errorf("the reload changed the flags: level %d, port %d and ca %q", *level, *port, *ca)
+	}
+
+	// A group that fails stops the whole reload.
+	failNext = true
+	write("level: 3\nport: 2000\nca: c.crt\n")
+	if _, err := r.reload(); err == nil {
+		t.Fatal("the reload didn't fail")
+	}
+	current := conf.Current()
+	if current.String("level") != "2" || current.String("ca") != "b.crt" || applied != 2 || caApplied != 1 {
+		t.Errorf("the failed reload changed something: level %s ca %q, applied %d and %d",
+			current.String("level"), current.String("ca"), applied, caApplied)
+	}
+
+	// Removing the CA needs a restart.
+	failNext = false
+	write("level: 2\nport: 1000\n")
+	report, err = r.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "needs a restart, ignored until then: ca (b.crt -> )"
+	if ca := conf.Current().String("ca"); report.String() != want || ca != "b.crt" {
+		t.Errorf("want report %q and ca b.crt, got %q and %q", want, report.String(), ca)
+	}
+
+	// The group that reads files ran on both of the reloads that worked,
+	// although its setting never changed.
+	if reread != 2 {
+		t.Errorf("want the files read again twice, got %d", reread)
+	}
+}
+
+func TestDynamicTLS(t *testing.T) {
+	opts := tlspolicy.Flags(flag.NewFlagSet("test", flag.ContinueOnError))
+	policy, err := tlspolicy.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &tls.Config{}
+	d := newDynamicTLS(base, policy, nil)
+	if base.GetConfigForClient == nil {
+		t.Fatal("GetConfigForClient isn't set")
+	}
+
+	opts.Profile = "modern"
+	modern, err := tlspolicy.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.set(d.build(modern, nil))
+	config, _ := base.GetConfigForClient(&tls.ClientHelloInfo{})
+	if config.MinVersion != tls.VersionTLS13 {
+		t.Errorf("want the modern policy's minimum version, got %x", config.MinVersion)
+	}
+	if !contains(config.NextProtos, "h2") {
+		t.Errorf("want h2 in NextProtos, got %v", config.NextProtos)
+	}
+}
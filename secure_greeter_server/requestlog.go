@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/goblimey/grpc/tracing"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Request logging.  Every RPC gets a request ID.  If the client sent one in
+// the x-request-id header we use that, so a request can be followed from the
+// client through to us, otherwise we make one up.  The ID is sent back in the
+// x-request-id response header and each RPC is logged when it finishes with
+// its ID, method, principal (the authenticated user), peer address, status
+// code and latency, and the trace ID if the RPC is part of a trace:
+//
+//	level=INFO msg=rpc request_id=4f1c... method=/helloworld.Greeter/SayHello
+//	    principal=user-2 peer=127.0.0.1:53712 code=OK latency_ms=0.41
+//
+// Health checks are logged at level DEBUG, since load balancers make a lot of
+// them.  Credentials are never logged.
+
+// requestIDHeader is the request and response header holding the request ID.
+const requestIDHeader = "x-request-id"
+
+// maxRequestIDLength is the longest request ID that we accept from a client.
+// A longer one, or one with odd characters, is replaced.
+const maxRequestIDLength = 128
+
+// requestInfo describes an RPC, for the log.  The interceptors further down
+// the chain fill it in.
+type requestInfo struct {
+	id        string
+	principal string // who the client authenticated as
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the requestInfo for an RPC, or nil if the context
+// didn't come through the request logger.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// requestLogger returns a logger that adds the RPC's request ID to each
+// message, for handlers that log.
+func requestLogger(ctx context.Context) *slog.Logger {
+	if info := requestInfoFrom(ctx); info != nil {
+		return slog.Default().With("request_id", info.id)
+	}
+	return slog.Default()
+}
+
+// newRequestID makes up a request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the request ID sent by the client, or a new one if it
+// didn't send one or the one that it sent isn't acceptable.
+func requestID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, id := range md.Get(requestIDHeader) {
+		if validRequestID(id) {
+			return id
+		}
+	}
+	return newRequestID()
+}
+
+// validRequestID returns true if a client's request ID is short and contains
+// only letters, digits and punctuation that are safe in a log.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// startRequest sets up the request ID for an RPC, sends it back to the
+// client and returns the context for the rest of the chain.
+func startRequest(ctx context.Context) (context.Context, *requestInfo) {
+	info := &requestInfo{id: requestID(ctx)}
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, info.id))
+	return context.WithValue(ctx, requestInfoKey{}, info), info
+}
+
+// logUnary is a grpc.UnaryServerInterceptor that logs unary RPCs.
+func logUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	start := time.Now()
+	ctx, ri := startRequest(ctx)
+	resp, err := handler(ctx, req)
+	logRPC(ctx, ri, info.FullMethod, start, err)
+	return resp, err
+}
+
+// logStream is a grpc.StreamServerInterceptor that logs streaming RPCs.
+func logStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	start := time.Now()
+	ctx, ri := startRequest(ss.Context())
+	err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	logRPC(ctx, ri, info.FullMethod, start, err)
+	return err
+}
+
+// contextStream is a grpc.ServerStream with a different context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// logRPC logs a finished RPC.  Server errors are logged at level ERROR and
+// refused credentials at level WARN.
+func logRPC(ctx context.Context, ri *requestInfo, method string, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	switch {
+	case strings.HasPrefix(method, "/grpc.health.v1.Health/"):
+		level = slog.LevelDebug
+	case code == codes.Internal || code == codes.Unknown || code == codes.DataLoss:
+		level = slog.LevelError
+	case code == codes.Unauthenticated || code == codes.PermissionDenied:
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("request_id", ri.id),
+		slog.String("method", method),
+	}
+	if traceID := tracing.TraceID(ctx); len(traceID) > 0 {
+		attrs = append(attrs, slog.String("trace_id", traceID))
+	}
+	if len(ri.principal) > 0 {
+		attrs = append(attrs, slog.String("principal", ri.principal))
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		attrs = append(attrs, slog.String("peer", p.Addr.String()))
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+			attrs = append(attrs, slog.String("client_cert", tlsInfo.State.PeerCertificates[0].Subject.CommonName))
+		}
+	}
+	attrs = append(attrs,
+		slog.String("code", code.String()),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+	)
+	if err != nil {
+		attrs = append(attrs, slog.String("error", status.Convert(err).Message()))
+	}
+	slog.LogAttrs(ctx, level, "rpc", attrs...)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	pb "github.com/goblimey/grpc/helloworld"
+	"github.com/goblimey/grpc/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testToken = "rTO69tZATgSqamjQn7v9HA"
+
+func TestRequestLog(t *testing.T) {
+	var logged bytes.Buffer
+	old := slog.Default()
+	if _, err := logging.Setup(&logging.Options{Level: "debug", Format: "json"}, &logged); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		slog.SetDefault(old)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(logUnary, OAuthUnaryInterceptor))
+	pb.RegisterGreeterServer(s, &server{})
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewGreeterClient(conn)
+
+	// greet sends a request and returns the request ID that came back and the
+	// record that was logged.
+	greet := func(token, id string) (string, error, map[string]interface{}) {
+		logged.Reset()
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+		if len(id) > 0 {
+			ctx = metadata.AppendToOutgoingContext(ctx, requestIDHeader, id)
+		}
+		var header metadata.MD
+		_, rpcErr := client.SayHello(ctx, &pb.HelloRequest{Name: "test"}, grpc.Header(&header))
+		if strings.Contains(logged.String(), token) {
+			t.Errorf("the token was logged: %s", logged.String())
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal(logged.Bytes(), &record); err != nil {
+			t.Fatalf("%v in %q (rpc error %v)", err, logged.String(), rpcErr)
+		}
+		var echoed string
+		if ids := header.Get(requestIDHeader); len(ids) == 1 {
+			echoed = ids[0]
+		}
+		return echoed, rpcErr, record
+	}
+
+	echoed, err, record := greet(testToken, "abc-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if echoed != "abc-123" {
+		t.Errorf("want the request ID echoed, got %q", echoed)
+	}
+	want := map[string]interface{}{
+		"level":      "INFO",
+		"msg":        "rpc",
+		"request_id": "abc-123",
+		"method":     "/helloworld.Greeter/SayHello",
+		"principal":  "user-2",
+		"code":       "OK",
+	}
+	for k, v := range want {
+		if record[k] != v {
+			t.Errorf("%s: want %v, got %v", k, v, record[k])
+		}
+	}
+	for _, k := range []string{"peer", "latency_ms"} {
+		if _, ok := record[k]; !ok {
+			t.Errorf("no %s in %v", k, record)
+		}
+	}
+
+	// No request ID, or an unacceptable one, gets a new one.
+	for _, id := range []string{"", "bad id=\"x\"", strings.Repeat("x", 200)} {
+		echoed, _, record = greet(testToken, id)
+		if len(echoed) != 32 || echoed == id || record["request_id"] != echoed {
+			t.Errorf("request ID %q: want a new ID, echoed %q and logged %v", id, echoed, record["request_id"])
+		}
+	}
+
+	// A bad token is refused and logged as a warning, without the token.
+	_, err, record = greet("not-the-token", "refused")
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("want Unauthenticated, got %v", err)
+	}
+	if record["level"] != "WARN" || record["code"] != "Unauthenticated" || record["principal"] != nil {
+		t.Errorf("want an Unauthenticated warning with no principal, got %v", record)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Revocation checking for client certificates.  With mutual TLS, a client
+// whose certificate has been compromised can be locked out by revoking the
+// certificate.  The server finds out about revocations from certificate
+// revocation lists (CRLs) - files published by the CA, which are reloaded
+// every -crlpoll - and, optionally, by asking the CA's OCSP responder.  The
+// certs command can revoke the certificates that it created and write a CRL:
+//
+//     secure_greeter_server certs -revoke=alice -reason=keyCompromise
+//
+// Sometimes we can't find out whether a certificate is revoked - there's no
+// CRL for its issuer, the CRL is out of date or the OCSP responder can't be
+// reached.  With the fail-closed policy the client is refused; with fail-open
+// it's let in and a warning is logged.
+//
+// The check runs on every handshake, including one that resumes an earlier
+// TLS session, so a client can't get round a revocation by resuming a
+// session that it started before its certificate was revoked.
+//
+// Results are cached for -revcache, so a busy client doesn't cause an OCSP
+// request on every connection.  The cache is cleared when the CRLs change, and
+// entries that have expired are dropped every -crlpoll.
+
+// revocation statuses.
+const (
+	statusGood = iota
+	statusRevoked
+	statusUnknown
+)
+
+// revocationResult is the result of checking one certificate.
+type revocationResult struct {
+	status    int
+	reason    int       // for statusRevoked - an RFC 5280 reason code
+	revokedAt time.Time // for statusRevoked
+	source    string    // "CRL file.crl", "OCSP http://..." and so on
+	detail    string    // for statusUnknown - why we don't know
+	expires   time.Time // when the cache entry expires
+}
+
+// revocationChecker checks client certificates for revocation.
+type revocationChecker struct {
+	crlFiles []string
+	useOCSP  bool
+	failOpen bool
+	cacheTTL time.Duration
+	client   *http.Client
+
+	mu    sync.RWMutex
+	crls  []*loadedCRL
+	cache map[string]revocationResult
+	// generation goes up each time the CRLs are reloaded, so that a check
+	// that started before a reload doesn't put its result into the new
+	// cache.
+	generation uint64
+}
+
+// loadedCRL is a CRL and the file it came from, with its entries indexed by
+// serial number.
+type loadedCRL struct {
+	file    string
+	crl     *x509.RevocationList
+	revoked map[string]x509.RevocationListEntry
+}
+
+// newRevocationChecker creates a revocationChecker and loads the CRL files.
+// policy is "fail-open" or "fail-closed".
+func newRevocationChecker(crlFiles []string, useOCSP bool, policy string,
+	cacheTTL time.Duration) (*revocationChecker, error) {
+
+	if len(crlFiles) == 0 && !useOCSP {
+		return nil, errors.New("revocation checking needs CRL files or OCSP")
+	}
+	r := &revocationChecker{
+		crlFiles: crlFiles,
+		useOCSP:  useOCSP,
+		cacheTTL: cacheTTL,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		cache:    make(map[string]revocationResult),
+	}
+	switch policy {
+	case "fail-open":
+		r.failOpen = true
+	case "fail-closed":
+	default:
+		return nil, fmt.Errorf("revocation policy must be fail-open or fail-closed, not %q", policy)
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the CRL files.  If any of them can't be loaded it returns an
+// error and keeps the CRLs that it already had.
+func (r *revocationChecker) reload() error {
+	var crls []*loadedCRL
+	for _, file := range r.crlFiles {
+		crl, err := loadCRL(file)
+		if err != nil {
+			return err
+		}
+		crls = append(crls, crl)
+	}
+	r.mu.Lock()
+	r.crls = crls
+	r.cache = make(map[string]revocationResult)
+	r.generation++
+	r.mu.Unlock()
+	return nil
+}
+
+// watch reloads the CRL files, if there are any, and drops expired cache
+// entries every pollInterval until stop is closed.  It should be started as a
+// goroutine.
+func (r *revocationChecker) watch(pollInterval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if len(r.crlFiles) > 0 {
+				if err := r.reload(); err != nil {
+					slog.Error("CRL reload failed, keeping the old CRLs", "error", err)
+				}
+			}
+			r.prune(time.Now())
+		}
+	}
+}
+
+// prune drops the cache entries that have expired.  Without it, with OCSP
+// and no CRLs, the cache would hold every certificate ever seen.
+func (r *revocationChecker) prune(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, result := range r.cache {
+		if !now.Before(result.expires) {
+			delete(r.cache, key)
+		}
+	}
+}
+
+// loadCRL reads a CRL from a PEM or DER file.
+func loadCRL(file string) (*loadedCRL, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CRL %s - %v", file, err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("%s contains a %s, not an X509 CRL", file, block.Type)
+		}
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse CRL %s - %v", file, err)
+	}
+	loaded := &loadedCRL{
+		file:    file,
+		crl:     crl,
+		revoked: make(map[string]x509.RevocationListEntry),
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		loaded.revoked[entry.SerialNumber.String()] = entry
+	}
+	return loaded, nil
+}
+
+// VerifyConnection checks the client's certificate for revocation.  It has
+// the signature of tls.Config.VerifyConnection and is called after the
+// certificate chain has been verified against the client CA.  Unlike
+// VerifyPeerCertificate, it's also called when a session is resumed, with the
+// chains that were verified when the session began.
+func (r *revocationChecker) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) < 2 {
+		// There's no client certificate, or it's self-signed and so has no
+		// issuer to revoke it.
+		return nil
+	}
+	leaf := cs.VerifiedChains[0][0]
+	issuer := cs.VerifiedChains[0][1]
+
+	result := r.check(leaf, issuer)
+	switch result.status {
+	case statusGood:
+		return nil
+	case statusRevoked:
+		err := revocationError{fmt.Errorf("client certificate %s (serial %s) was revoked at %s, reason %s (from %s)",
+			leaf.Subject.CommonName, leaf.SerialNumber, result.revokedAt.Format(time.RFC3339),
+			reasonName(result.reason), result.source)}
+		slog.Warn("audit: refused connection", "error", err)
+		return err
+	default:
+		if r.failOpen {
+			slog.Warn("audit: allowed client certificate although its revocation status is unknown (fail-open)",
+				"client_cert", leaf.Subject.CommonName, "serial", leaf.SerialNumber.String(), "detail", result.detail)
+			return nil
+		}
+		err := revocationError{fmt.Errorf("revocation status of client certificate %s (serial %s) is unknown - %s",
+			leaf.Subject.CommonName, leaf.SerialNumber, result.detail)}
+		slog.Warn("audit: refused connection (fail-closed)", "error", err)
+		return err
+	}
+}
+
+// revocationError is the error for a connection refused because the client's
+// certificate is revoked or its status is unknown, so that the handshake
+// failure metric can tell it apart.
+type revocationError struct {
+	error
+}
+
+func (e revocationError) Unwrap() error {
+	return e.error
+}
+
+// check returns the revocation status of cert, using the cache if possible.
+func (r *revocationChecker) check(cert, issuer *x509.Certificate) revocationResult {
+	key := cacheKey(cert, issuer)
+	now := time.Now()
+
+	r.mu.RLock()
+	cached, ok := r.cache[key]
+	generation := r.generation
+	r.mu.RUnlock()
+	if ok && now.Before(cached.expires) {
+		return cached
+	}
+
+	result := r.checkCRLs(cert, issuer, now)
+	if result.status == statusUnknown && r.useOCSP {
+		crlDetail := result.detail
+		result = r.checkOCSP(cert, issuer)
+		if result.status == statusUnknown && len(crlDetail) > 0 {
+			result.detail = crlDetail + "; " + result.detail
+		}
+	}
+
+	ttl := r.cacheTTL
+	if result.status == statusUnknown && ttl > time.Minute {
+		// Don't hang on to "unknown" for long - the OCSP responder may only be
+		// down for a moment.
+		ttl = time.Minute
+	}
+	if result.expires.IsZero() || result.expires.After(now.Add(ttl)) {
+		result.expires = now.Add(ttl)
+	}
+	r.mu.Lock()
+	if r.generation == generation {
+		r.cache[key] = result
+	}
+	r.mu.Unlock()
+	return result
+}
+
+// checkCRLs looks for cert in the CRLs issued by issuer.
+func (r *revocationChecker) checkCRLs(cert, issuer *x509.Certificate, now time.Time) revocationResult {
+	r.mu.RLock()
+	crls := r.crls
+	r.mu.RUnlock()
+
+	detail := "no CRL for issuer " + issuer.Subject.CommonName
+	for _, loaded := range crls {
+		if !bytes.Equal(loaded.crl.RawIssuer, issuer.RawSubject) {
+			continue
+		}
+		if err := loaded.crl.CheckSignatureFrom(issuer); err != nil {
+			detail = fmt.Sprintf("CRL %s is not signed by %s", loaded.file, issuer.Subject.CommonName)
+			continue
+		}
+		if entry, ok := loaded.revoked[cert.SerialNumber.String()]; ok {
+			return revocationResult{
+				status:    statusRevoked,
+				reason:    entry.ReasonCode,
+				revokedAt: entry.RevocationTime,
+				source:    "CRL " + loaded.file,
+			}
+		}
+		if !loaded.crl.NextUpdate.IsZero() && now.After(loaded.crl.NextUpdate) {
+			detail = fmt.Sprintf("CRL %s is out of date - its next update was due at %s",
+				loaded.file, loaded.crl.NextUpdate.Format(time.RFC3339))
+			continue
+		}
+		return revocationResult{status: statusGood, source: "CRL " + loaded.file}
+	}
+	return revocationResult{status: statusUnknown, detail: detail}
+}
+
+// checkOCSP asks the certificate's OCSP responder for its status.
+func (r *revocationChecker) checkOCSP(cert, issuer *x509.Certificate) revocationResult {
+	if len(cert.OCSPServer) == 0 {
+		return revocationResult{status: statusUnknown, detail: "the certificate names no OCSP responder"}
+	}
+	responder := cert.OCSPServer[0]
+	resp, err := queryOCSP(r.client, responder, cert, issuer)
+	if err != nil {
+		return revocationResult{status: statusUnknown, detail: err.Error()}
+	}
+	result := revocationResult{source: "OCSP " + responder, expires: resp.NextUpdate}
+	switch resp.Status {
+	case ocsp.Good:
+		result.status = statusGood
+	case ocsp.Revoked:
+		result.status = statusRevoked
+		result.reason = resp.RevocationReason
+		result.revokedAt = resp.RevokedAt
+	default:
+		result.status = statusUnknown
+		result.detail = "OCSP responder " + responder + " doesn't know the certificate"
+	}
+	return result
+}
+
+// queryOCSP sends an OCSP request for cert to responder and returns the
+// checked response.  A response that is out of date - its next update was
+// due in the past - or that claims to come from the future is refused, so an
+// old "good" response can't be replayed after the certificate is revoked.
+func queryOCSP(client *http.Client, responder string, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create OCSP request - %v", err)
+	}
+	httpResp, err := client.Post(responder, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, fmt.Errorf("OCSP responder %s - %v", responder, err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned %s", responder, httpResp.Status)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("OCSP responder %s - %v", responder, err)
+	}
+	resp, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("bad response from OCSP responder %s - %v", responder, err)
+	}
+	now := time.Now()
+	if resp.ThisUpdate.After(now) {
+		return nil, fmt.Errorf("OCSP responder %s sent a response from the future (%s)",
+			responder, resp.ThisUpdate.Format(time.RFC3339))
+	}
+	if !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate) {
+		return nil, fmt.Errorf("OCSP responder %s sent an out of date response - its next update was due at %s",
+			responder, resp.NextUpdate.Format(time.RFC3339))
+	}
+	return resp, nil
+}
+
+// cacheKey identifies a certificate by its issuer's key and its serial number.
+func cacheKey(cert, issuer *x509.Certificate) string {
+	hash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(hash[:]) + "/" + cert.SerialNumber.String()
+}
+
+// reasonNames are the RFC 5280 revocation reason codes.
+var reasonNames = map[int]string{
+	ocsp.Unspecified:          "unspecified",
+	ocsp.KeyCompromise:        "keyCompromise",
+	ocsp.CACompromise:         "cACompromise",
+	ocsp.AffiliationChanged:   "affiliationChanged",
+	ocsp.Superseded:           "superseded",
+	ocsp.CessationOfOperation: "cessationOfOperation",
+	ocsp.CertificateHold:      "certificateHold",
+	ocsp.RemoveFromCRL:        "removeFromCRL",
+	ocsp.PrivilegeWithdrawn:   "privilegeWithdrawn",
+	ocsp.AACompromise:         "aACompromise",
+}
+
+// reasonName returns the name of a revocation reason code.
+func reasonName(code int) string {
+	if name, ok := reasonNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("reason %d", code)
+}
+
+// reasonCode returns the code for a revocation reason name.
+func reasonCode(name string) (int, error) {
+	for code, n := range reasonNames {
+		if n == name {
+			return code, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown revocation reason %q", name)
+}
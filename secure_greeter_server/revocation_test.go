@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goblimey/grpc/keypair"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestRevocationCRL(t *testing.T) {
+	dir := t.TempDir()
+	newKey := func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	caCert, caKey, err := createCA(dir, "test CA", time.Hour, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		template := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		err := createLeaf(dir, name+".crt", name+".key", template, time.Hour,
+			caCert, caKey, newKey, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeCRL(dir, []string{"alice"}, 1, time.Hour, caCert, caKey); err != nil {
+		t.Fatal(err)
+	}
+
+	checker, err := newRevocationChecker([]string{filepath.Join(dir, caCRLFile)}, false,
+		"fail-closed", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chainFor := func(name string) [][]*x509.Certificate {
+		certs, err := keypair.ReadCertificates(filepath.Join(dir, name+".crt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return [][]*x509.Certificate{{certs[0], caCert}}
+	}
+
+	if err := checker.VerifyConnection(tls.ConnectionState{VerifiedChains: chainFor("alice")}); err == nil {
+		t.Error("expected alice's revoked certificate to be refused")
+	}
+	if err := checker.VerifyConnection(tls.ConnectionState{VerifiedChains: chainFor("bob")}); err != nil {
+		t.Errorf("bob's certificate was refused - %v", err)
+	}
+
+	// A certificate from a CA that we have no CRL for is refused when the
+	// policy is fail-closed and let in when it's fail-open.
+	otherDir := t.TempDir()
+	otherCA, otherKey, err := createCA(otherDir, "other CA", time.Hour, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{Subject: pkix.Name{CommonName: "carol"}}
+	if err := createLeaf(otherDir, "carol.crt", "carol.key", template, time.Hour,
+		otherCA, otherKey, newKey, false); err != nil {
+		t.Fatal(err)
+	}
+	carol, err := keypair.ReadCertificates(filepath.Join(otherDir, "carol.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := [][]*x509.Certificate{{carol[0], otherCA}}
+	if err := checker.VerifyConnection(tls.ConnectionState{VerifiedChains: chain}); err == nil {
+		t.Error("fail-closed: expected an unknown certificate to be refused")
+	}
+	checker.failOpen = true
+	if err := checker.VerifyConnection(tls.ConnectionState{VerifiedChains: chain}); err != nil {
+		t.Errorf("fail-open: unknown certificate was refused - %v", err)
+	}
+}
+
+// TestRevocationResumedSession checks that a client whose certificate is
+// revoked can't carry on by resuming a TLS session that it started before.
+func TestRevocationResumedSession(t *testing.T) {
+	dir := t.TempDir()
+	newKey := func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	caCert, caKey, err := createCA(dir, "test CA", time.Hour, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := []struct {
+		name  string
+		usage x509.ExtKeyUsage
+	}{{"localhost", x509.ExtKeyUsageServerAuth}, {"alice", x509.ExtKeyUsageClientAuth}}
+	for _, leaf := range leaves {
+		template := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: leaf.name},
+			DNSNames:    []string{leaf.name},
+			ExtKeyUsage: []x509.ExtKeyUsage{leaf.usage},
+		}
+		if err := createLeaf(dir, leaf.name+".crt", leaf.name+".key", template, time.Hour,
+			caCert, caKey, newKey, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeCRL(dir, nil, 1, time.Hour, caCert, caKey); err != nil {
+		t.Fatal(err)
+	}
+	checker, err := newRevocationChecker([]string{filepath.Join(dir, caCRLFile)}, false,
+		"fail-closed", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "localhost.crt"), filepath.Join(dir, "localhost.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "alice.crt"), filepath.Join(dir, "alice.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates:     []tls.Certificate{serverCert},
+		ClientCAs:        roots,
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		VerifyConnection: checker.VerifyConnection,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	serverErrs := make(chan error)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			err = conn.(*tls.Conn).Handshake()
+			if err == nil {
+				// Send a byte, so that the client reads the session ticket
+				// that comes before it.
+				_, err = conn.Write([]byte{1})
+			}
+			conn.Close()
+			serverErrs <- err
+		}
+	}()
+
+	clientConfig := &tls.Config{
+		Certificates:       []tls.Certificate{clientCert},
+		RootCAs:            roots,
+		ServerName:         "localhost",
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	connect := func() (resumed bool, err error) {
+		conn, err := tls.Dial("tcp", lis.Addr().String(), clientConfig)
+		if err == nil {
+			conn.Read(make([]byte, 1))
+			resumed = conn.ConnectionState().DidResume
+			conn.Close()
+		}
+		return resumed, <-serverErrs
+	}
+
+	if _, err := connect(); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed {
+		t.Fatal("the second connection didn't resume the session")
+	}
+
+	if err := writeCRL(dir, []string{"alice"}, 1, time.Hour, caCert, caKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connect(); err == nil {
+		t.Error("a revoked client resumed its session")
+	}
+}
+
+func TestQueryOCSPFreshness(t *testing.T) {
+	dir := t.TempDir()
+	newKey := func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	caCert, caKey, err := createCA(dir, "test CA", time.Hour, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}
+	if err := createLeaf(dir, "alice.crt", "alice.key", template, time.Hour,
+		caCert, caKey, newKey, false); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := keypair.ReadCertificates(filepath.Join(dir, "alice.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fake OCSP responder that says every certificate is good, with the
+	// update times given by thisUpdate and nextUpdate.
+	var thisUpdate, nextUpdate time.Time
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(caCert, caCert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   thisUpdate,
+			NextUpdate:   nextUpdate,
+		}, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	now := time.Now()
+	var tests = []struct {
+		name                   string
+		thisUpdate, nextUpdate time.Time
+		ok                     bool
+	}{
+		{"fresh", now.Add(-time.Minute), now.Add(time.Hour), true},
+		{"no next update", now.Add(-time.Minute), time.Time{}, true},
+		{"out of date", now.Add(-2 * time.Hour), now.Add(-time.Hour), false},
+		{"from the future", now.Add(time.Hour), now.Add(2 * time.Hour), false},
+	}
+	for _, test := range tests {
+		thisUpdate, nextUpdate = test.thisUpdate, test.nextUpdate
+		_, err := queryOCSP(http.DefaultClient, responder.URL, alice[0], caCert)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected the response to be refused", test.name)
+		}
+	}
+}
+
+// TestRevocationReloadDuringCheck checks that the result of a check that
+// was running when the CRLs were reloaded isn't cached, since it may come
+// from the old CRLs.
+func TestRevocationReloadDuringCheck(t *testing.T) {
+	dir := t.TempDir()
+	newKey := func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	caCert, caKey, err := createCA(dir, "test CA", time.Hour, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fake OCSP responder that reloads the checker while it answers.
+	var checker *revocationChecker
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checker.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp, err := ocsp.CreateResponse(caCert, caCert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	template := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, OCSPServer: []string{responder.URL}}
+	if err := createLeaf(dir, "alice.crt", "alice.key", template, time.Hour,
+		caCert, caKey, newKey, false); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := keypair.ReadCertificates(filepath.Join(dir, "alice.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker, err = newRevocationChecker(nil, true, "fail-closed", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result := checker.check(alice[0], caCert); result.status != statusGood {
+		t.Fatalf("want a good status, got %+v", result)
+	}
+	if n := len(checker.cache); n != 0 {
+		t.Errorf("a result from before the reload was cached - %d entries", n)
+	}
+}
+
+func TestRevocationPrune(t *testing.T) {
+	checker, err := newRevocationChecker(nil, true, "fail-closed", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	checker.cache["old"] = revocationResult{expires: now.Add(-time.Second)}
+	checker.cache["new"] = revocationResult{expires: now.Add(time.Minute)}
+	checker.prune(now)
+	if _, ok := checker.cache["old"]; ok {
+		t.Error("an expired entry was kept")
+	}
+	if _, ok := checker.cache["new"]; !ok {
+		t.Error("an entry that hasn't expired was dropped")
+	}
+}
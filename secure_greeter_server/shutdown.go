@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+)
+
+// Graceful shutdown.  When the server gets SIGINT or SIGTERM (which is what a
+// deployment tool sends), it
+//
+//   - marks itself as not serving in the health service, so that load
+//     balancers stop sending it new work,
+//   - waits -drainwait for them to notice,
+//   - stops accepting connections and waits up to -draintimeout for the RPCs
+//     that are in flight to finish, and
+//   - if they haven't finished by then, closes the connections, which aborts
+//     them.
+//
+// A second signal skips the wait and stops straight away.
+
+// rpcTracker counts the RPCs that are running.  Its interceptors go first in
+// the chain so that every RPC is counted, including ones that fail
+// authentication.  It's the only thing that counts them - the
+// greeter_rpcs_in_flight metric is kept up to date from here too.
+type rpcTracker struct {
+	inFlight  int64
+	completed int64
+
+	// gauge, if it's set, is given the number of RPCs in flight by method.
+	gauge *prometheus.GaugeVec
+}
+
+// unary is a grpc.UnaryServerInterceptor that counts unary RPCs.
+func (t *rpcTracker) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	defer t.start(info.FullMethod)()
+	return handler(ctx, req)
+}
+
+// stream is a grpc.StreamServerInterceptor that counts streaming RPCs.
+func (t *rpcTracker) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	defer t.start(info.FullMethod)()
+	return handler(srv, ss)
+}
+
+// start counts the start of an RPC and returns a function that counts its
+// end.
+func (t *rpcTracker) start(method string) func() {
+	atomic.AddInt64(&t.inFlight, 1)
+	var gauge prometheus.Gauge
+	if t.gauge != nil {
+		gauge = t.gauge.WithLabelValues(method)
+		gauge.Inc()
+	}
+	return func() {
+		atomic.AddInt64(&t.inFlight, -1)
+		atomic.AddInt64(&t.completed, 1)
+		if gauge != nil {
+			gauge.Dec()
+		}
+	}
+}
+
+// counts returns the number of RPCs in flight and the number completed so
+// far.
+func (t *rpcTracker) counts() (int64, int64) {
+	return atomic.LoadInt64(&t.inFlight), atomic.LoadInt64(&t.completed)
+}
+
+// shutdownOnSignal waits for SIGINT or SIGTERM and then shuts the server
+// down gracefully as described above.  It closes stop once the server has
+// stopped, which stops the background goroutines, and then closes the
+// returned channel.  main should wait for that before exiting, so that the
+// shutdown is logged.
+func shutdownOnSignal(s *grpc.Server, healthServer *health.Server, tracker *rpcTracker,
+	drainWait, drainTimeout time.Duration, stop chan struct{}) <-chan struct{} {
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		shutdown(signals, s, healthServer, tracker, drainWait, drainTimeout, stop)
+	}()
+	return done
+}
+
+// shutdown waits for a signal on signals and then shuts the server down.
+func shutdown(signals <-chan os.Signal, s *grpc.Server, healthServer *health.Server,
+	tracker *rpcTracker, drainWait, drainTimeout time.Duration, stop chan struct{}) {
+
+	sig := <-signals
+	inFlight, completedBefore := tracker.counts()
+	slog.Info("shutting down", "signal", sig.String(), "in_flight", inFlight)
+
+	// Fail the health checks first.
+	healthServer.Shutdown()
+	if drainWait > 0 {
+		slog.Info("waiting for load balancers to notice", "drain_wait", drainWait)
+		select {
+		case <-time.After(drainWait):
+		case sig = <-signals:
+			slog.Info("not waiting", "signal", sig.String())
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+
+	var aborted, completedAtStop int64
+	select {
+	case <-stopped:
+	case <-time.After(drainTimeout):
+		aborted, completedAtStop = tracker.counts()
+		slog.Warn("RPCs still running - stopping anyway", "drain_timeout", drainTimeout)
+		s.Stop()
+	case sig = <-signals:
+		aborted, completedAtStop = tracker.counts()
+		slog.Warn("stopping straight away", "signal", sig.String())
+		s.Stop()
+	}
+	<-stopped
+	close(stop)
+
+	// Aborted handlers may still return after Stop, so if we had to stop
+	// count the RPCs completed up to that point.
+	if aborted == 0 {
+		_, completedAtStop = tracker.counts()
+	}
+	completed := completedAtStop - completedBefore
+	slog.Info("server stopped", "in_flight", inFlight, "completed", completed, "aborted", aborted)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	pb "github.com/goblimey/grpc/helloworld"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// slowGreeter answers when release is closed or the RPC is cancelled.
+type slowGreeter struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *slowGreeter) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	g.started <- struct{}{}
+	select {
+	case <-g.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &pb.HelloReply{Message: "Hello " + in.Name}, nil
+}
+
+// startShutdownTest starts a plain text server with a slow greeter and one
+// RPC in flight.  It returns the shutdown's done channel, the signal channel
+// and the greeter.
+func startShutdownTest(t *testing.T, drainTimeout time.Duration) (chan os.Signal, <-chan struct{},
+	*slowGreeter, *health.Server) {
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := &rpcTracker{}
+	s := grpc.NewServer(grpc.UnaryInterceptor(tracker.unary), grpc.StreamInterceptor(tracker.stream))
+	greeter := &slowGreeter{started: make(chan struct{}, 1), release: make(chan struct{})}
+	pb.RegisterGreeterServer(s, greeter)
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(s, healthServer)
+	go s.Serve(lis)
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	go func() {
+		defer close(done)
+		shutdown(signals, s, healthServer, tracker, 0, drainTimeout, stop)
+	}()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go pb.NewGreeterClient(conn).SayHello(context.Background(), &pb.HelloRequest{Name: "test"})
+	<-greeter.started
+	return signals, done, greeter, healthServer
+}
+
+func TestShutdownDrains(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	signals, done, greeter, healthServer := startShutdownTest(t, time.Minute)
+	signals <- syscall.SIGTERM
+
+	// The health check fails straight away, while the RPC is still running.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, _ := healthServer.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		if resp.GetStatus() == healthpb.HealthCheckResponse_NOT_SERVING {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the health check didn't fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(greeter.release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server didn't stop")
+	}
+	if !strings.Contains(logged.String(), "server stopped in_flight=1 completed=1 aborted=0") {
+		t.Errorf("unexpected log %q", logged.String())
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	signals, done, _, _ := startShutdownTest(t, 100*time.Millisecond)
+	signals <- syscall.SIGTERM
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server didn't stop")
+	}
+	if !strings.Contains(logged.String(), "server stopped in_flight=1 completed=0 aborted=1") {
+		t.Errorf("unexpected log %q", logged.String())
+	}
+}
+
+// TestRPCTracker checks the tracker's counts and that the in flight metric
+// follows them.
+func TestRPCTracker(t *testing.T) {
+	m := newRPCMetrics(prometheus.NewRegistry())
+	tracker := &rpcTracker{gauge: m.inFlight}
+	info := &grpc.UnaryServerInfo{FullMethod: "/helloworld.Greeter/SayHello"}
+	var inFlight, gauge float64
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		n, _ := tracker.counts()
+		inFlight = float64(n)
+		gauge = testutil.ToFloat64(m.inFlight.WithLabelValues(info.FullMethod))
+		return nil, nil
+	}
+	tracker.unary(context.Background(), nil, info, handler)
+	tracker.unary(context.Background(), nil, info, handler)
+
+	if inFlight != 1 || gauge != 1 {
+		t.Errorf("want 1 RPC in flight during the call, got %v and metric %v", inFlight, gauge)
+	}
+	if n, completed := tracker.counts(); n != 0 || completed != 2 {
+		t.Errorf("want none in flight and 2 completed afterwards, got %d and %d", n, completed)
+	}
+	if n := testutil.ToFloat64(m.inFlight.WithLabelValues(info.FullMethod)); n != 0 {
+		t.Errorf("want no RPCs in flight in the metric afterwards, got %v", n)
+	}
+}
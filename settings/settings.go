@@ -0,0 +1,754 @@
+/*
+Package settings gives secure_greeter_client and secure_greeter_server their
+configuration in layers.  Each setting can come from
+
+  - a configuration file in YAML or TOML, named by the -config flag or the
+    PREFIX_CONFIG environment variable,
+  - an environment variable, PREFIX_NAME, or
+  - the command line, as before.
+
+Later layers win, so an environment variable overrides the file and a flag
+overrides both.  The settings are the program's command line flags - the file
+and the environment use the same names and the same syntax for values - so
+everything that can be given as a flag can be given in the file too.  For
+example, for the server (prefix GREETER_SERVER_):
+
+	# greeter.yaml
+	p: 50061
+	certfile: /etc/greeter/server.crt
+	keyfile: /etc/greeter/server.key
+	certpair:
+	  - /etc/greeter/other.crt:/etc/greeter/other.key
+	expirywarn: [30, 14, 7, 1]
+
+	$ GREETER_SERVER_P=50062 secure_greeter_server -config=greeter.yaml
+
+In the file a list sets a flag that can be given more than once (such as
+-certpair) once for each item, and gives any other flag a comma-separated
+list.  In the environment the value of a repeatable flag is split at commas.
+
+Everything is checked before the program starts: unknown names (in the file
+or with the prefix in the environment), values of the wrong type and values
+that the flag rejects are reported with the file, line and column or the
+name of the variable.
+
+A long-running program can call Reload to read the file and the environment
+again and find out what has changed.  It's up to the program to decide which
+of the changes it can put into effect.  Next gives it a Snapshot of the
+settings with those changes made, for it to check, and Publish makes that
+the current snapshot.  The flags themselves are only set by Parse and never
+change after that, so other goroutines can go on reading them while a reload
+happens, but they don't see the reloaded values.  A program that reloads
+should read the reloadable settings from Current instead.  A snapshot never
+changes once it's made, so it can be read from any goroutine without
+locking.
+*/
+package settings
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Repeatable is implemented by flag values that can be given more than once,
+// such as a list of pins.  Items returns the values given so far and Reset
+// removes them, so that Reload can replace the list.
+type Repeatable interface {
+	flag.Value
+	Items() []string
+	Reset()
+}
+
+// Settings loads the layers into a flag set.
+type Settings struct {
+	fs        *flag.FlagSet
+	envPrefix string
+	file      string // set by the -config flag
+	secrets   map[string]bool
+
+	// current holds the values in use, which Publish replaces.
+	current atomic.Pointer[Snapshot]
+}
+
+// Snapshot holds the values of the settings at one time.
+type Snapshot struct {
+	fs      *flag.FlagSet
+	values  map[string]flag.Value // the settings that have changed since Parse
+	sources map[string]string     // where each setting that isn't at its default came from
+}
+
+// value is a setting read from the file or the environment.
+type value struct {
+	items []string
+	where string // for error messages, for example "greeter.yaml:3:11"
+}
+
+// New creates a Settings for the flags in fs, defining the -config flag in
+// fs.  envPrefix is the prefix of the environment variables, for example
+// "GREETER_SERVER_".
+func New(fs *flag.FlagSet, envPrefix string) *Settings {
+	s := &Settings{
+		fs:        fs,
+		envPrefix: envPrefix,
+		secrets:   make(map[string]bool),
+	}
+	s.current.Store(&Snapshot{fs: fs})
+	fs.StringVar(&s.file, "config", "",
+		"configuration file, YAML or TOML (default: $"+envPrefix+"CONFIG)")
+	return s
+}
+
+// Secret marks settings whose values must not be shown by Print.
+func (s *Settings) Secret(names ...string) {
+	for _, name := range names {
+		s.secrets[name] = true
+	}
+}
+
+// EnvName returns the name of the environment variable for a setting.
+func (s *Settings) EnvName(name string) string {
+	name = strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	return s.envPrefix + strings.ToUpper(name)
+}
+
+// Parse parses the command line arguments, which shouldn't include the
+// program name, and then fills in the settings that weren't given there
+// from the environment and the file.
+func (s *Settings) Parse(args []string) error {
+	if err := s.fs.Parse(args); err != nil {
+		return err
+	}
+	sources := make(map[string]string)
+	s.fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "command line"
+	})
+
+	values, err := s.read()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := sources[name]; ok {
+			continue // the command line wins
+		}
+		v := values[name]
+		if err := set(s.fs.Lookup(name), v.items); err != nil {
+			return fmt.Errorf("%s: bad value for %s - %v", v.where, name, err)
+		}
+		sources[name] = v.where
+	}
+	s.current.Store(&Snapshot{fs: s.fs, sources: sources})
+	return nil
+}
+
+// Current returns the snapshot of the settings in use.
+func (s *Settings) Current() *Snapshot {
+	return s.current.Load()
+}
+
+// Lookup returns the value of a setting, or nil if there's no such setting.
+// It has the same type as the flag's value unless the setting has been
+// reloaded and the type couldn't be copied (see Reload), in which case only
+// its String method and, for a list, its Items method, are any use.  Don't
+// set it.
+func (snap *Snapshot) Lookup(name string) flag.Value {
+	if v, ok := snap.values[name]; ok {
+		return v
+	}
+	if f := snap.fs.Lookup(name); f != nil {
+		return f.Value
+	}
+	return nil
+}
+
+// String returns the value of a setting as the flag shows it, or "" if
+// there's no such setting.
+func (snap *Snapshot) String(name string) string {
+	v := snap.Lookup(name)
+	if v == nil {
+		return ""
+	}
+	return v.String()
+}
+
+// Items returns the values given for a setting that can be given more than
+// once, such as -certpair, or the value of any other setting as a list of
+// one.
+func (snap *Snapshot) Items(name string) []string {
+	v := snap.Lookup(name)
+	if v == nil {
+		return nil
+	}
+	return items(&flag.Flag{Name: name, Value: v})
+}
+
+// Fill sets each flag in fs to the value of the setting with the same name.
+// It gives a program an options struct made by a package's Flags function
+// from a snapshot, by calling that function with a new flag set:
+//
+//	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+//	opts := tlspolicy.Flags(fs)
+//	err := snap.Fill(fs)
+func (snap *Snapshot) Fill(fs *flag.FlagSet) error {
+	var failed error
+	fs.VisitAll(func(f *flag.Flag) {
+		if failed != nil {
+			return
+		}
+		if v := snap.Lookup(f.Name); v != nil {
+			if err := replace(f, items(&flag.Flag{Name: f.Name, Value: v})); err != nil {
+				failed = fmt.Errorf("bad value for %s - %v", f.Name, err)
+			}
+		}
+	})
+	return failed
+}
+
+// Change is a setting that Reload found a new value for.  Old and New are
+// the values as the flag shows them, or "<redacted>" for a secret.
+type Change struct {
+	Name string
+	Old  string
+	New  string
+
+	value  flag.Value
+	source string // "" if the setting goes back to its default
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s (%s -> %s)", c.Name, c.Old, c.New)
+}
+
+// Reload reads the file and the environment again and works out which of
+// the settings that weren't given on the command line have values that
+// differ from the current snapshot.  A setting that's no longer given goes
+// back to its default.  Each new value is checked by setting it in a new
+// value of the flag's type, leaving the flag alone.  If the type can't be
+// copied, the value is kept as it's given, unchecked.  If anything is wrong
+// the error says where the mistake is.
+func (s *Settings) Reload() ([]Change, error) {
+	values, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	current := s.Current()
+	var changes []Change
+	var failed error
+	s.fs.VisitAll(func(f *flag.Flag) {
+		if failed != nil || f.Name == "config" || current.sources[f.Name] == "command line" {
+			return
+		}
+		v, given := values[f.Name]
+		newItems := defaultItems(f)
+		if given {
+			newItems = v.items
+		}
+		parsed, err := parse(f, newItems)
+		if err != nil {
+			failed = fmt.Errorf("%s: bad value for %s - %v", v.where, f.Name, err)
+			return
+		}
+		old := &flag.Flag{Name: f.Name, Value: current.Lookup(f.Name)}
+		if strings.Join(items(&flag.Flag{Value: parsed}), ",") == strings.Join(items(old), ",") {
+			return
+		}
+		changes = append(changes, Change{
+			Name:   f.Name,
+			Old:    s.show(old),
+			New:    s.show(&flag.Flag{Name: f.Name, Value: parsed}),
+			value:  parsed,
+			source: v.where,
+		})
+	})
+	if failed != nil {
+		return nil, failed
+	}
+	return changes, nil
+}
+
+// Next returns a copy of the current snapshot with the changes found by
+// Reload made.  Nothing uses it until it's passed to Publish, so the program
+// can check the new values first and drop the snapshot if they don't work.
+func (s *Settings) Next(changes []Change) *Snapshot {
+	current := s.Current()
+	next := &Snapshot{
+		fs:      s.fs,
+		values:  make(map[string]flag.Value),
+		sources: make(map[string]string),
+	}
+	for name, v := range current.values {
+		next.values[name] = v
+	}
+	for name, source := range current.sources {
+		next.sources[name] = source
+	}
+	for _, c := range changes {
+		next.values[c.Name] = c.value
+		if len(c.source) > 0 {
+			next.sources[c.Name] = c.source
+		} else {
+			delete(next.sources, c.Name)
+		}
+	}
+	return next
+}
+
+// Publish makes snap, from Next, the current snapshot.
+func (s *Settings) Publish(snap *Snapshot) {
+	s.current.Store(snap)
+}
+
+// parse checks the items given for a flag by setting them in a new value of
+// the same type, which it returns, leaving the flag alone.  If the flag's
+// type can't be copied, the items are taken as they are, unchecked.
+func parse(f *flag.Flag, items []string) (flag.Value, error) {
+	value := scratch(f.Value)
+	if value == nil {
+		return &unchecked{items: items, repeatable: isRepeatable(f.Value)}, nil
+	}
+	if err := set(&flag.Flag{Name: f.Name, Value: value}, items); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// scratch returns a new, empty value of the same type as v, or nil if it
+// can't make one.  That works for the standard flag types and for lists
+// such as -certpair, which are pointers to simple types.
+func scratch(v flag.Value) flag.Value {
+	t := reflect.TypeOf(v)
+	if t.Kind() != reflect.Ptr {
+		return nil
+	}
+	switch t.Elem().Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64,
+		reflect.Float64, reflect.String, reflect.Slice:
+		value, _ := reflect.New(t.Elem()).Interface().(flag.Value)
+		return value
+	}
+	return nil
+}
+
+// unchecked holds the new value of a flag whose type can't be copied.
+type unchecked struct {
+	items      []string
+	repeatable bool
+}
+
+func (u *unchecked) String() string     { return strings.Join(u.items, ",") }
+func (u *unchecked) Set(v string) error { return errors.New("unchecked values can't be set") }
+func (u *unchecked) Items() []string {
+	if u.repeatable {
+		return u.items
+	}
+	return []string{u.String()}
+}
+func (u *unchecked) Reset() {}
+
+// show returns a flag's value for display, hiding secrets.
+func (s *Settings) show(f *flag.Flag) string {
+	if s.secrets[f.Name] && len(f.Value.String()) > 0 {
+		return "<redacted>"
+	}
+	return f.Value.String()
+}
+
+// items returns a flag's current value in a form that replace can put back.
+func items(f *flag.Flag) []string {
+	if r, ok := f.Value.(Repeatable); ok {
+		return append([]string(nil), r.Items()...)
+	}
+	return []string{f.Value.String()}
+}
+
+// defaultItems returns a flag's default value in a form that replace can
+// use.
+func defaultItems(f *flag.Flag) []string {
+	if _, ok := f.Value.(Repeatable); ok {
+		return SplitList(f.DefValue)
+	}
+	return []string{f.DefValue}
+}
+
+// replace sets a flag to a new value, emptying a repeatable flag first.
+func replace(f *flag.Flag, items []string) error {
+	if r, ok := f.Value.(Repeatable); ok {
+		r.Reset()
+	}
+	return set(f, items)
+}
+
+// File returns the name of the configuration file, or "" if there isn't
+// one.
+func (s *Settings) File() string {
+	if len(s.file) > 0 {
+		return s.file
+	}
+	return os.Getenv(s.EnvName("config"))
+}
+
+// read reads the file and the environment and returns the settings that they
+// give, with the environment overriding the file.  It doesn't change the
+// flags.
+func (s *Settings) read() (map[string]value, error) {
+	values := make(map[string]value)
+	if file := s.File(); len(file) > 0 {
+		fromFile, err := s.readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for name, v := range fromFile {
+			values[name] = v
+		}
+	}
+
+	fromEnv, err := s.readEnv(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range fromEnv {
+		values[name] = v
+	}
+	return values, nil
+}
+
+// readEnv returns the settings given by the environment variables in env,
+// each "NAME=value".
+func (s *Settings) readEnv(env []string) (map[string]value, error) {
+	byEnvName := make(map[string]*flag.Flag)
+	s.fs.VisitAll(func(f *flag.Flag) {
+		byEnvName[s.EnvName(f.Name)] = f
+	})
+
+	values := make(map[string]value)
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], s.envPrefix) {
+			continue
+		}
+		envName, text := kv[:i], kv[i+1:]
+		if envName == s.EnvName("config") {
+			continue
+		}
+		where := "environment variable " + envName
+		f, ok := byEnvName[envName]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown setting%s", where, s.suggest(
+				strings.ToLower(strings.TrimPrefix(envName, s.envPrefix))))
+		}
+		items := []string{text}
+		if _, ok := f.Value.(Repeatable); ok {
+			items = SplitList(text)
+		}
+		values[f.Name] = value{items: items, where: where}
+	}
+	return values, nil
+}
+
+// readFile reads a YAML or TOML file, depending on its extension.
+func (s *Settings) readFile(file string) (map[string]value, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the configuration file - %v", err)
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return s.readYAML(file, data)
+	case ".toml":
+		return s.readTOML(file, data)
+	}
+	return nil, fmt.Errorf("%s: the configuration file should be .yaml, .yml or .toml", file)
+}
+
+func (s *Settings) readYAML(file string, data []byte) (map[string]value, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		// The message includes the line number.
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	values := make(map[string]value)
+	if len(doc.Content) == 0 {
+		return values, nil // an empty file
+	}
+	top := doc.Content[0]
+	if top.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d:%d: expected a mapping of setting names to values",
+			file, top.Line, top.Column)
+	}
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		key, node := top.Content[i], top.Content[i+1]
+		where := fmt.Sprintf("%s:%d:%d", file, key.Line, key.Column)
+		if err := s.checkName(key.Value, values, where); err != nil {
+			return nil, err
+		}
+		valueWhere := fmt.Sprintf("%s:%d:%d", file, node.Line, node.Column)
+		var items []string
+		switch node.Kind {
+		case yaml.ScalarNode:
+			items = []string{node.Value}
+		case yaml.SequenceNode:
+			for _, item := range node.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("%s:%d:%d: %s: list items should be single values",
+						file, item.Line, item.Column, key.Value)
+				}
+				items = append(items, item.Value)
+			}
+		default:
+			return nil, fmt.Errorf("%s: %s: expected a value or a list of values", valueWhere, key.Value)
+		}
+		values[key.Value] = value{items: items, where: valueWhere}
+	}
+	return values, nil
+}
+
+func (s *Settings) readTOML(file string, data []byte) (map[string]value, error) {
+	var doc map[string]interface{}
+	if _, err := toml.Decode(string(data), &doc); err != nil {
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			return nil, fmt.Errorf("%s:%d:%d: %s", file, perr.Position.Line, perr.Position.Col, perr.Message)
+		}
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	// The TOML decoder doesn't say where each key is, so find the lines
+	// ourselves, in order, for the error messages.
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	lines := keyLines(data)
+	sort.Slice(keys, func(i, j int) bool { return lines[keys[i]][0] < lines[keys[j]][0] })
+
+	values := make(map[string]value)
+	for _, key := range keys {
+		where := fmt.Sprintf("%s:%d:%d", file, lines[key][0], lines[key][1])
+		if _, ok := doc[key].(map[string]interface{}); ok {
+			return nil, fmt.Errorf("%s: [%s]: the settings aren't grouped into tables - "+
+				"put them at the top level", where, key)
+		}
+		if err := s.checkName(key, values, where); err != nil {
+			return nil, err
+		}
+		var items []string
+		switch v := doc[key].(type) {
+		case []interface{}:
+			for _, item := range v {
+				text, ok := tomlScalar(item)
+				if !ok {
+					return nil, fmt.Errorf("%s: %s: list items should be single values", where, key)
+				}
+				items = append(items, text)
+			}
+		default:
+			text, ok := tomlScalar(v)
+			if !ok {
+				return nil, fmt.Errorf("%s: %s: expected a value or a list of values", where, key)
+			}
+			items = []string{text}
+		}
+		values[key] = value{items: items, where: where}
+	}
+	return values, nil
+}
+
+// tomlScalar returns a TOML value as text, or false if it isn't a single
+// value.
+func tomlScalar(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case time.Time:
+		return v.Format(time.RFC3339), true
+	}
+	return "", false
+}
+
+// keyLines finds the line and column of each top level key in a TOML file.
+func keyLines(data []byte) map[string][2]int {
+	lines := make(map[string][2]int)
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		text := string(line)
+		trimmed := strings.TrimLeft(text, " \t")
+		col := len(text) - len(trimmed) + 1
+		if strings.HasPrefix(trimmed, "[") {
+			key := strings.Trim(trimmed, "[] \t\r")
+			if _, ok := lines[key]; !ok {
+				lines[key] = [2]int{n + 1, col}
+			}
+			continue
+		}
+		i := strings.Index(trimmed, "=")
+		if i <= 0 || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		key := strings.Trim(strings.TrimSpace(trimmed[:i]), `"'`)
+		if _, ok := lines[key]; !ok {
+			lines[key] = [2]int{n + 1, col}
+		}
+	}
+	return lines
+}
+
+// checkName checks that a name in the file is a setting that hasn't already
+// been given.
+func (s *Settings) checkName(name string, seen map[string]value, where string) error {
+	if name == "config" {
+		return fmt.Errorf("%s: the configuration file can't name another one", where)
+	}
+	if s.fs.Lookup(name) == nil {
+		return fmt.Errorf("%s: unknown setting %q%s", where, name, s.suggest(name))
+	}
+	if previous, ok := seen[name]; ok {
+		return fmt.Errorf("%s: %s is already set at %s", where, name, previous.where)
+	}
+	return nil
+}
+
+// suggest returns " - did you mean x?" if there's a setting with a name
+// close to name.
+func (s *Settings) suggest(name string) string {
+	best, bestDistance := "", 3
+	s.fs.VisitAll(func(f *flag.Flag) {
+		if d := distance(name, f.Name); d < bestDistance {
+			best, bestDistance = f.Name, d
+		}
+	})
+	if len(best) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" - did you mean %q?", best)
+}
+
+// distance returns the edit distance between a and b.
+func distance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// set sets a flag from the items given for it.
+func set(f *flag.Flag, items []string) error {
+	if _, ok := f.Value.(Repeatable); ok {
+		for _, item := range items {
+			if err := f.Value.Set(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return f.Value.Set(strings.Join(items, ","))
+}
+
+// Print writes the effective settings to w as YAML, which can be used as a
+// configuration file.  Each setting is followed by a comment saying where it
+// came from.  The values of secret settings are replaced by "<redacted>".
+func (s *Settings) Print(w io.Writer) {
+	current := s.Current()
+	fmt.Fprintf(w, "# the effective configuration - file %s, environment %s*, command line\n",
+		orNone(s.File()), s.envPrefix)
+	s.fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		source, ok := current.sources[f.Name]
+		if !ok {
+			source = "default"
+		}
+		f = &flag.Flag{Name: f.Name, Value: current.Lookup(f.Name)}
+		var text string
+		switch {
+		case s.secrets[f.Name] && len(f.Value.String()) > 0:
+			text = strconv.Quote(s.show(f))
+		case isRepeatable(f.Value):
+			items := f.Value.(Repeatable).Items()
+			quoted := make([]string, len(items))
+			for i, item := range items {
+				quoted[i] = strconv.Quote(item)
+			}
+			text = "[" + strings.Join(quoted, ", ") + "]"
+		default:
+			text = yamlValue(f.Value)
+		}
+		fmt.Fprintf(w, "%s: %s  # %s\n", f.Name, text, source)
+	})
+}
+
+func isRepeatable(v flag.Value) bool {
+	_, ok := v.(Repeatable)
+	return ok
+}
+
+// yamlValue returns a flag's value in YAML syntax.  Numbers and booleans are
+// written as they are and everything else is quoted.
+func yamlValue(v flag.Value) string {
+	if getter, ok := v.(flag.Getter); ok {
+		switch getter.Get().(type) {
+		case bool, int, int64, uint, uint64, float64:
+			return v.String()
+		}
+	}
+	return strconv.Quote(v.String())
+}
+
+func orNone(s string) string {
+	if len(s) == 0 {
+		return "(none)"
+	}
+	return s
+}
+
+// SplitList splits a comma-separated list, such as the value of a list flag,
+// and drops empty items.
+func SplitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
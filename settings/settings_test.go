@@ -0,0 +1,339 @@
+package settings
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// list is a repeatable flag.Value.
+type list []string
+
+func (l *list) String() string     { return strings.Join(*l, ",") }
+func (l *list) Set(v string) error { *l = append(*l, v); return nil }
+func (l *list) Items() []string    { return *l }
+func (l *list) Reset()             { *l = nil }
+
+// testFlags is a flag set with one of each kind of flag.
+type testFlags struct {
+	fs       *flag.FlagSet
+	settings *Settings
+	port     *int
+	certfile *string
+	domains  *string
+	poll     *time.Duration
+	verbose  *bool
+	token    *string
+	pins     list
+}
+
+func newTestFlags() *testFlags {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	f := &testFlags{
+		fs:       fs,
+		port:     fs.Int("p", 50061, "port"),
+		certfile: fs.String("certfile", "", "cert file"),
+		domains:  fs.String("domains", "", "comma-separated domains"),
+		poll:     fs.Duration("poll", time.Minute, "poll interval"),
+		verbose:  fs.Bool("v", false, "verbose"),
+		token:    fs.String("token", "", "token"),
+	}
+	fs.Var(&f.pins, "pin", "pin (repeatable)")
+	f.settings = New(fs, "TEST_")
+	f.settings.Secret("token")
+	return f
+}
+
+func writeFile(t *testing.T, name, text string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filename, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLayers(t *testing.T) {
+	files := map[string]string{
+		"greeter.yaml": `
+p: 1234
+certfile: file.crt
+domains: [a.com, b.com]
+pin:
+  - one
+  - two
+poll: 5m
+v: true
+`,
+		"greeter.toml": `
+p = 1234
+certfile = "file.crt"
+domains = ["a.com", "b.com"]
+pin = ["one", "two"]
+poll = "5m"
+v = true
+`,
+	}
+	for name, text := range files {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("TEST_CERTFILE", "env.crt")
+			t.Setenv("TEST_POLL", "10s")
+			f := newTestFlags()
+			file := writeFile(t, name, text)
+			if err := f.settings.Parse([]string{"-config", file, "-poll=1h", "hello"}); err != nil {
+				t.Fatal(err)
+			}
+			if *f.port != 1234 {
+				t.Errorf("p: want 1234 from the file, got %d", *f.port)
+			}
+			if *f.certfile != "env.crt" {
+				t.Errorf("certfile: want env.crt from the environment, got %q", *f.certfile)
+			}
+			if *f.poll != time.Hour {
+				t.Errorf("poll: want 1h from the command line, got %v", *f.poll)
+			}
+			if *f.domains != "a.com,b.com" {
+				t.Errorf("domains: want a.com,b.com, got %q", *f.domains)
+			}
+			if strings.Join(f.pins, " ") != "one two" {
+				t.Errorf("pin: want one two, got %v", f.pins)
+			}
+			if !*f.verbose {
+				t.Error("v: want true")
+			}
+			if f.fs.Arg(0) != "hello" {
+				t.Errorf("want the argument hello, got %q", f.fs.Arg(0))
+			}
+		})
+	}
+}
+
+func TestConfigFromEnvironment(t *testing.T) {
+	file := writeFile(t, "greeter.yaml", "p: 99\n")
+	t.Setenv("TEST_CONFIG", file)
+	t.Setenv("TEST_PIN", "one, two")
+	f := newTestFlags()
+	if err := f.settings.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if *f.port != 99 {
+		t.Errorf("want 99, got %d", *f.port)
+	}
+	if strings.Join(f.pins, " ") != "one two" {
+		t.Errorf("pin: want one two, got %v", f.pins)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var tests = []struct {
+		name string
+		file string
+		text string
+		env  string
+		want string
+	}{
+		{"unknown", "c.yaml", "p: 1\ncertfil: x\n", "", "c.yaml:2:1: unknown setting \"certfil\" - did you mean \"certfile\"?"},
+		{"duplicate", "c.yaml", "p: 1\n\n  \np: abc\n", "", "c.yaml:4:1: p is already set at c.yaml:1:4"},
+		{"bad value", "c.yaml", "certfile: x\np: abc\n", "", "c.yaml:2:4: bad value for p - parse error"},
+		{"bad duration", "c.yaml", "poll: 5\n", "", "c.yaml:1:7: bad value for poll - "},
+		{"mapping", "c.yaml", "certfile:\n  a: b\n", "", "c.yaml:2:3: certfile: expected a value or a list of values"},
+		{"not a mapping", "c.yaml", "- p\n", "", "c.yaml:1:1: expected a mapping"},
+		{"yaml syntax", "c.yaml", "p: [1\n", "", "c.yaml: yaml: line 1"},
+		{"toml unknown", "c.toml", "p = 1\n  porr = 2\n", "", "c.toml:2:3: unknown setting \"porr\""},
+		{"toml bad value", "c.toml", "p = 1\npoll = \"5\"\n", "", "c.toml:2:1: bad value for poll"},
+		{"toml table", "c.toml", "p = 1\n[tls]\nmin = 1\n", "", "c.toml:2:1: [tls]: the settings aren't grouped into tables"},
+		{"toml syntax", "c.toml", "p = 1\ncertfile = \n", "", "c.toml:2:"},
+		{"extension", "c.json", "{}", "", "should be .yaml, .yml or .toml"},
+		{"env unknown", "", "", "TEST_PORT=1", "environment variable TEST_PORT: unknown setting"},
+		{"env bad value", "", "", "TEST_P=x", "environment variable TEST_P: bad value for p"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newTestFlags()
+			var args []string
+			if len(test.file) > 0 {
+				args = []string{"-config=" + writeFile(t, test.file, test.text)}
+			}
+			if len(test.env) > 0 {
+				kv := strings.SplitN(test.env, "=", 2)
+				t.Setenv(kv[0], kv[1])
+			}
+			err := f.settings.Parse(args)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			// Drop the temporary directory from the message.
+			got := err.Error()
+			if len(test.file) > 0 {
+				got = strings.Replace(got, filepath.Dir(args[0][len("-config="):])+"/", "", -1)
+			}
+			if !strings.Contains(got, test.want) {
+				t.Errorf("want %q in %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	file := writeFile(t, "c.yaml", "p: 7\ntoken: s3cret\n")
+	t.Setenv("TEST_DOMAINS", "a.com")
+	f := newTestFlags()
+	if err := f.settings.Parse([]string{"-config", file, "-pin=one", "-pin=two"}); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	f.settings.Print(&out)
+	got := out.String()
+	if strings.Contains(got, "s3cret") {
+		t.Errorf("the token wasn't redacted:\n%s", got)
+	}
+	for _, want := range []string{
+		"p: 7  # " + file + ":1:4\n",
+		"token: \"<redacted>\"  # " + file + ":2:8\n",
+		"domains: \"a.com\"  # environment variable TEST_DOMAINS\n",
+		"pin: [\"one\", \"two\"]  # command line\n",
+		"poll: \"1m0s\"  # default\n",
+		"v: false  # default\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want %q in\n%s", want, got)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	file := writeFile(t, "c.yaml", "p: 7\npin: [one]\ntoken: old\n")
+	f := newTestFlags()
+	if err := f.settings.Parse([]string{"-config", file, "-v"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// v comes from the command line, so the file can't change it.  certfile
+	// is no longer given, so it goes back to its default.
+	ioutil.WriteFile(file, []byte("p: 8\npin: [two, three]\npoll: 1m\nv: false\ntoken: new\n"), 0600)
+	changes, err := f.settings.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := "p (7 -> 8), pin (one -> two,three), token (<redacted> -> <redacted>)"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("want changes %s, got %s", want, strings.Join(got, ", "))
+	}
+	// Nothing changes until the snapshot is published, and the flags never
+	// change.
+	unchanged := func() {
+		t.Helper()
+		if *f.port != 7 || strings.Join(f.pins, ",") != "one" || *f.token != "old" || !*f.verbose {
+			t.Errorf("the flags changed: p %d pin %v token %q v %v", *f.port, f.pins, *f.token, *f.verbose)
+		}
+	}
+	next := f.settings.Next(changes)
+	if p := f.settings.Current().String("p"); p != "7" {
+		t.Errorf("want p 7 before Publish, got %s", p)
+	}
+	f.settings.Publish(next)
+	current := f.settings.Current()
+	if current.String("p") != "8" || strings.Join(current.Items("pin"), ",") != "two,three" ||
+		current.String("v") != "true" || current.String("token") != "new" {
+		t.Errorf("wrong values after the reload: p %s pin %v v %s token %s", current.String("p"),
+			current.Items("pin"), current.String("v"), current.String("token"))
+	}
+	unchanged()
+
+	// A mistake changes nothing.
+	ioutil.WriteFile(file, []byte("p: 9\npin: [four]\npoll: 5\n"), 0600)
+	if _, err := f.settings.Reload(); err == nil || !strings.Contains(err.Error(), "c.yaml:3:7: bad value for poll") {
+		t.Errorf("want a bad value error, got %v", err)
+	}
+	if f.settings.Current() != current {
+		t.Error("the failed reload changed the snapshot")
+	}
+
+	// The changes are worked out from the current snapshot, not the flags,
+	// and settings that are no longer given go back to their defaults.
+	ioutil.WriteFile(file, []byte("p: 10\n"), 0600)
+	changes, err = f.settings.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want = "p (8 -> 10), pin (two,three -> ), token (<redacted> -> )"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("want changes %s, got %s", want, strings.Join(got, ", "))
+	}
+	f.settings.Publish(f.settings.Next(changes))
+	unchanged()
+	var out bytes.Buffer
+	f.settings.Print(&out)
+	for _, want := range []string{"p: 10  # " + file + ":1:4\n", "pin: []  # default\n", "token: \"\"  # default\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("want %q in\n%s", want, out.String())
+		}
+	}
+
+	// Fill gives a new flag set the current values.
+	fs := flag.NewFlagSet("fill", flag.ContinueOnError)
+	port := fs.Int("p", 0, "")
+	var pins list
+	fs.Var(&pins, "pin", "")
+	if err := f.settings.Current().Fill(fs); err != nil || *port != 10 || len(pins) != 0 {
+		t.Errorf("want p 10 and no pins, got %d, %v and %v", *port, pins, err)
+	}
+}
+
+// TestConcurrentReload reloads while other goroutines read the settings.
+// Run it with -race.
+func TestConcurrentReload(t *testing.T) {
+	file := writeFile(t, "c.yaml", "p: 1\npin: [one]\n")
+	f := newTestFlags()
+	if err := f.settings.Parse([]string{"-config", file}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				current := f.settings.Current()
+				current.String("p")
+				current.Items("pin")
+				f.settings.Print(ioutil.Discard)
+				_ = *f.port + len(f.pins)
+			}
+		}()
+	}
+	for i := 2; i < 50; i++ {
+		ioutil.WriteFile(file, []byte(fmt.Sprintf("p: %d\npin: [one, n%d]\n", i, i)), 0600)
+		changes, err := f.settings.Reload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.settings.Publish(f.settings.Next(changes))
+	}
+	close(done)
+	wg.Wait()
+	if p := f.settings.Current().String("p"); p != "49" || *f.port != 1 {
+		t.Errorf("want p 49 in the snapshot and 1 in the flag, got %s and %d", p, *f.port)
+	}
+}
@@ -0,0 +1,342 @@
+/*
+Package tlspolicy controls the security settings of the TLS connections made by
+secure_greeter_client and secure_greeter_server: which TLS versions are
+allowed, which cipher suites may be used with TLS 1.2, which key exchange
+curves are offered and whether session tickets are used.
+
+Rather than setting each of those separately, you can choose a named profile:
+
+	modern        TLS 1.3 only.  Use this when every client is recent.
+	intermediate  TLS 1.2 and 1.3 with forward-secret AEAD cipher suites only.
+	              This is the default.
+	fips-like     TLS 1.2 and 1.3 with AES-GCM suites and NIST curves only.
+
+The profiles follow Mozilla's server side TLS recommendations.  fips-like is
+only "like" FIPS 140 because Go doesn't let you choose the TLS 1.3 cipher
+suites, so a TLS 1.3 connection may still use ChaCha20-Poly1305 unless the
+program is built and run in Go's FIPS mode.
+
+Individual settings can then be overridden, for example to allow a cipher
+suite that an old client needs.  The result is checked at startup so that a
+mistake is reported straight away rather than as a handshake failure later.
+*/
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Policy is a set of TLS security settings.
+type Policy struct {
+	// Profile is the name of the profile that the policy started from.
+	Profile string
+
+	// MinVersion and MaxVersion are the lowest and highest TLS versions
+	// allowed, for example tls.VersionTLS12.
+	MinVersion uint16
+	MaxVersion uint16
+
+	// CipherSuites are the cipher suites allowed for TLS 1.2.  (The TLS 1.3
+	// suites can't be configured.)
+	CipherSuites []uint16
+
+	// CurvePreferences are the key exchange mechanisms offered, most preferred
+	// first.
+	CurvePreferences []tls.CurveID
+
+	// SessionTicketsDisabled turns off session resumption using tickets.
+	SessionTicketsDisabled bool
+}
+
+// Options holds the command line settings from which a Policy is built.  An
+// empty field means "use the profile's setting".
+type Options struct {
+	Profile        string
+	MinVersion     string
+	MaxVersion     string
+	CipherSuites   string // comma-separated suite names
+	Curves         string // comma-separated curve names
+	SessionTickets string // "on" or "off"
+}
+
+// DefaultProfile is the profile used if none is given.
+const DefaultProfile = "intermediate"
+
+// forwardSecretAEAD are the TLS 1.2 suites allowed by the intermediate profile.
+var forwardSecretAEAD = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// profiles are the named starting points.
+var profiles = map[string]Policy{
+	"modern": {
+		MinVersion:       tls.VersionTLS13,
+		MaxVersion:       tls.VersionTLS13,
+		CurvePreferences: []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+	"intermediate": {
+		MinVersion:       tls.VersionTLS12,
+		MaxVersion:       tls.VersionTLS13,
+		CipherSuites:     forwardSecretAEAD,
+		CurvePreferences: []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+	"fips-like": {
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+	},
+}
+
+var versions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"x25519mlkem768": tls.X25519MLKEM768,
+	"x25519":         tls.X25519,
+	"p256":           tls.CurveP256,
+	"p384":           tls.CurveP384,
+	"p521":           tls.CurveP521,
+}
+
+// Profiles returns the names of the profiles.
+func Profiles() []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Flags defines the TLS policy command line flags in fs and returns the
+// Options that they set.
+func Flags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	fs.StringVar(&o.Profile, "tlsprofile", DefaultProfile,
+		"TLS security profile - "+strings.Join(Profiles(), ", "))
+	fs.StringVar(&o.MinVersion, "tlsmin", "", "minimum TLS version, 1.2 or 1.3 (default: from the profile)")
+	fs.StringVar(&o.MaxVersion, "tlsmax", "", "maximum TLS version, 1.2 or 1.3 (default: from the profile)")
+	fs.StringVar(&o.CipherSuites, "tlsciphers", "",
+		"comma-separated TLS 1.2 cipher suites (default: from the profile)")
+	fs.StringVar(&o.Curves, "tlscurves", "",
+		"comma-separated key exchange curves, most preferred first (default: from the profile)")
+	fs.StringVar(&o.SessionTickets, "tlstickets", "", "TLS session tickets, on or off (default: on)")
+	return o
+}
+
+// New builds a Policy from the options and checks it.
+func New(o *Options) (*Policy, error) {
+	name := o.Profile
+	if len(name) == 0 {
+		name = DefaultProfile
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS profile %q - use one of %s",
+			name, strings.Join(Profiles(), ", "))
+	}
+
+	// Copy the profile so that changing the policy doesn't change it.
+	p := &Policy{
+		Profile:                name,
+		MinVersion:             profile.MinVersion,
+		MaxVersion:             profile.MaxVersion,
+		CipherSuites:           append([]uint16(nil), profile.CipherSuites...),
+		CurvePreferences:       append([]tls.CurveID(nil), profile.CurvePreferences...),
+		SessionTicketsDisabled: profile.SessionTicketsDisabled,
+	}
+
+	var err error
+	if len(o.MinVersion) > 0 {
+		if p.MinVersion, err = parseVersion(o.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+	if len(o.MaxVersion) > 0 {
+		if p.MaxVersion, err = parseVersion(o.MaxVersion); err != nil {
+			return nil, err
+		}
+	}
+	if len(o.CipherSuites) > 0 {
+		if p.CipherSuites, err = parseCipherSuites(o.CipherSuites); err != nil {
+			return nil, err
+		}
+	}
+	if len(o.Curves) > 0 {
+		if p.CurvePreferences, err = parseCurves(o.Curves); err != nil {
+			return nil, err
+		}
+	}
+	switch strings.ToLower(o.SessionTickets) {
+	case "":
+	case "on":
+		p.SessionTicketsDisabled = false
+	case "off":
+		p.SessionTicketsDisabled = true
+	default:
+		return nil, fmt.Errorf("TLS session tickets must be on or off, not %q", o.SessionTickets)
+	}
+
+	if err := p.Check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Check returns an error if the policy can't work.
+func (p *Policy) Check() error {
+	if p.MinVersion < tls.VersionTLS12 {
+		// gRPC runs over HTTP/2, which requires TLS 1.2 or later.
+		return errors.New("the minimum TLS version must be 1.2 or later - gRPC needs it")
+	}
+	if p.MaxVersion < p.MinVersion {
+		return fmt.Errorf("the maximum TLS version %s is lower than the minimum %s",
+			versionName(p.MaxVersion), versionName(p.MinVersion))
+	}
+	if p.MinVersion <= tls.VersionTLS12 && len(p.CipherSuites) == 0 {
+		return errors.New("TLS 1.2 is allowed but no TLS 1.2 cipher suites are")
+	}
+	if len(p.CurvePreferences) == 0 {
+		return errors.New("no key exchange curves are allowed")
+	}
+	return nil
+}
+
+// Apply copies the policy's settings into a TLS config.
+func (p *Policy) Apply(config *tls.Config) {
+	config.MinVersion = p.MinVersion
+	config.MaxVersion = p.MaxVersion
+	config.CipherSuites = p.CipherSuites
+	config.CurvePreferences = p.CurvePreferences
+	config.SessionTicketsDisabled = p.SessionTicketsDisabled
+}
+
+// String describes the effective settings, for the log.
+func (p *Policy) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "TLS profile %s: versions %s-%s", p.Profile,
+		versionName(p.MinVersion), versionName(p.MaxVersion))
+	if p.MinVersion <= tls.VersionTLS12 {
+		var names []string
+		for _, id := range p.CipherSuites {
+			names = append(names, tls.CipherSuiteName(id))
+		}
+		fmt.Fprintf(&b, ", TLS 1.2 cipher suites %s", strings.Join(names, ","))
+	}
+	var curveNames []string
+	for _, id := range p.CurvePreferences {
+		curveNames = append(curveNames, curveName(id))
+	}
+	fmt.Fprintf(&b, ", curves %s", strings.Join(curveNames, ","))
+	if p.SessionTicketsDisabled {
+		b.WriteString(", session tickets off")
+	} else {
+		b.WriteString(", session tickets on")
+	}
+	return b.String()
+}
+
+func parseVersion(s string) (uint16, error) {
+	v, ok := versions[strings.TrimPrefix(s, "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q - use 1.2 or 1.3", s)
+	}
+	return v, nil
+}
+
+func versionName(v uint16) string {
+	for name, id := range versions {
+		if id == v {
+			return name
+		}
+	}
+	return tls.VersionName(v)
+}
+
+// parseCipherSuites turns a list of suite names into IDs.  Only the TLS 1.2
+// suites that Go considers secure are accepted.  Go ignores the setting for
+// TLS 1.3, so naming a TLS 1.3 suite would look like it worked while
+// choosing nothing.
+func parseCipherSuites(list string) ([]uint16, error) {
+	secure := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if insecure[name] {
+			return nil, fmt.Errorf("cipher suite %s is not secure and can't be used", name)
+		}
+		suite, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if !supports(suite, tls.VersionTLS12) {
+			return nil, fmt.Errorf("cipher suite %s is a TLS 1.3 suite - TLS 1.3 suites can't be configured, so -tlsciphers only takes TLS 1.2 suites", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// supports returns true if the suite can be used with TLS version v.
+func supports(suite *tls.CipherSuite, v uint16) bool {
+	for _, version := range suite.SupportedVersions {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCurves(list string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if len(name) == 0 {
+			continue
+		}
+		id, ok := curves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q - use x25519mlkem768, x25519, p256, p384 or p521", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func curveName(id tls.CurveID) string {
+	for name, c := range curves {
+		if c == id {
+			return name
+		}
+	}
+	return id.String()
+}
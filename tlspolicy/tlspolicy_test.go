@@ -0,0 +1,84 @@
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	for _, name := range Profiles() {
+		p, err := New(&Options{Profile: name})
+		if err != nil {
+			t.Errorf("profile %s: %v", name, err)
+			continue
+		}
+		if p.Profile != name {
+			t.Errorf("profile %s: got profile %s", name, p.Profile)
+		}
+	}
+
+	if _, err := New(&Options{Profile: "bogus"}); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	p, err := New(&Options{
+		Profile:        "intermediate",
+		MaxVersion:     "1.2",
+		CipherSuites:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+		Curves:         "p384,p256",
+		SessionTickets: "off",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config tls.Config
+	p.Apply(&config)
+	if config.MaxVersion != tls.VersionTLS12 {
+		t.Errorf("expected max version 1.2, got %x", config.MaxVersion)
+	}
+	if len(config.CipherSuites) != 1 || config.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("unexpected cipher suites %v", config.CipherSuites)
+	}
+	if len(config.CurvePreferences) != 2 || config.CurvePreferences[0] != tls.CurveP384 {
+		t.Errorf("unexpected curves %v", config.CurvePreferences)
+	}
+	if !config.SessionTicketsDisabled {
+		t.Error("expected session tickets to be off")
+	}
+
+	// The override mustn't change the profile.
+	p, err = New(&Options{Profile: "intermediate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.CipherSuites) != len(forwardSecretAEAD) {
+		t.Errorf("the intermediate profile was changed by an override")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	bad := []Options{
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{MinVersion: "1.1"},
+		{CipherSuites: "TLS_RSA_WITH_RC4_128_SHA"},
+		{CipherSuites: "TLS_NOT_A_SUITE"},
+		{CipherSuites: "TLS_AES_128_GCM_SHA256"}, // TLS 1.3
+		{Curves: "p999"},
+		{SessionTickets: "maybe"},
+	}
+	for _, o := range bad {
+		if _, err := New(&o); err == nil {
+			t.Errorf("expected an error for %+v", o)
+		}
+	}
+}
+
+func TestTLS13CipherSuites(t *testing.T) {
+	_, err := New(&Options{CipherSuites: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_AES_128_GCM_SHA256"})
+	if err == nil || !strings.Contains(err.Error(), "TLS 1.3 suites can't be configured") {
+		t.Errorf("want an error saying that TLS 1.3 suites can't be configured, got %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Package tracing adds OpenTelemetry distributed tracing to
+secure_greeter_client and secure_greeter_server.  Each RPC gets a span in
+the client and a span in the server, and the trace context goes from one to
+the other in the W3C traceparent header, carried in the gRPC metadata, so
+the two spans belong to the same trace.  The programs add their own spans
+inside those - the server's auth check and the client's token fetch.
+
+-trace says where the finished spans go:
+
+	none     nowhere (the default)
+	stdout   printed on the standard output, one JSON object per line
+	file     appended to -tracefile, in the same format
+	otlp     sent to an OpenTelemetry collector by OTLP over gRPC
+
+The file exporter lets you (and the tests) look at traces without running a
+collector.  For otlp, -otlpendpoint gives the collector's host:port (by
+default $OTEL_EXPORTER_OTLP_ENDPOINT, or localhost:4317) and -otlpinsecure
+turns off TLS, for a collector on the same machine.
+*/
+package tracing
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// instrumentationName names the tracer.
+const instrumentationName = "github.com/goblimey/grpc"
+
+// Options holds the tracing settings.
+type Options struct {
+	Exporter     string // none, stdout, file or otlp
+	File         string // for the file exporter
+	OTLPEndpoint string // host:port, for the otlp exporter
+	OTLPInsecure bool   // send to the collector without TLS
+}
+
+// Flags defines the tracing flags in fs and returns the Options that they
+// set.
+func Flags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	fs.StringVar(&o.Exporter, "trace", "none", "where to send trace spans - none, stdout, file or otlp")
+	fs.StringVar(&o.File, "tracefile", "", "file to append trace spans to, with -trace=file")
+	fs.StringVar(&o.OTLPEndpoint, "otlpendpoint", "",
+		"OpenTelemetry collector host:port, with -trace=otlp (default: $OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4317)")
+	fs.BoolVar(&o.OTLPInsecure, "otlpinsecure", false, "send trace spans to the collector without TLS")
+	return o
+}
+
+// Setup sets up the global tracer provider and the W3C trace context
+// propagator as the options say.  service names the program in the spans.
+// It returns a function that sends any spans still waiting and stops the
+// exporter, which should be called before the program exits.
+func Setup(o *Options, service string) (func(ctx context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanOption sdktrace.TracerProviderOption
+	var file *os.File
+	switch o.Exporter {
+	case "none", "":
+		return func(ctx context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+		// Spans written locally are written as they end, so they aren't lost
+		// if the program exits in a hurry.
+		spanOption = sdktrace.WithSyncer(exporter)
+	case "file":
+		if len(o.File) == 0 {
+			return nil, fmt.Errorf("-trace=file needs -tracefile")
+		}
+		var err error
+		file, err = os.OpenFile(o.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open the trace file - %v", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			return nil, err
+		}
+		spanOption = sdktrace.WithSyncer(exporter)
+	case "otlp":
+		var opts []otlptracegrpc.Option
+		if len(o.OTLPEndpoint) > 0 {
+			opts = append(opts, otlptracegrpc.WithEndpoint(o.OTLPEndpoint))
+		}
+		if o.OTLPInsecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err := otlptracegrpc.New(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create the OTLP exporter - %v", err)
+		}
+		spanOption = sdktrace.WithBatcher(exporter)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q - use none, stdout, file or otlp", o.Exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", service)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(spanOption, sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+// Start starts a span as a child of the one in ctx, if there is one.  The
+// caller must end it.
+func Start(ctx context.Context, name string) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name)
+}
+
+// End ends a span, marking it as failed if err isn't nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the ID of the trace in ctx, or "" if there isn't one, for
+// the log.
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// metadataCarrier lets the propagator read and write gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startRPC starts the span for an RPC.  method is the full method name,
+// /service/method.
+func startRPC(ctx context.Context, method string, kind trace.SpanKind) (context.Context, trace.Span) {
+	name := strings.TrimPrefix(method, "/")
+	service, rpcMethod := name, ""
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		service, rpcMethod = name[:i], name[i+1:]
+	}
+	return otel.Tracer(instrumentationName).Start(ctx, name,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", rpcMethod),
+		))
+}
+
+// endRPC records an RPC's status code and ends its span.
+func endRPC(span trace.Span, err error) {
+	s := status.Convert(err)
+	span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(s.Code())))
+	if err != nil {
+		span.SetStatus(codes.Error, s.Message())
+	}
+	span.End()
+}
+
+// serverContext returns ctx with the trace context that the client sent.
+func serverContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+}
+
+// UnaryServerInterceptor is a grpc.UnaryServerInterceptor that gives each
+// unary RPC a span, continuing the client's trace.
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	ctx, span := startRPC(serverContext(ctx), info.FullMethod, trace.SpanKindServer)
+	resp, err := handler(ctx, req)
+	endRPC(span, err)
+	return resp, err
+}
+
+// StreamServerInterceptor is a grpc.StreamServerInterceptor that gives each
+// streaming RPC a span, continuing the client's trace.
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	ctx, span := startRPC(serverContext(ss.Context()), info.FullMethod, trace.SpanKindServer)
+	err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	endRPC(span, err)
+	return err
+}
+
+// contextStream is a grpc.ServerStream with a different context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// UnaryClientInterceptor is a grpc.UnaryClientInterceptor that gives each
+// RPC a span and sends the trace context to the server.
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+	ctx, span := startRPC(ctx, method, trace.SpanKindClient)
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	err := invoker(metadata.NewOutgoingContext(ctx, md), method, req, reply, cc, opts...)
+	endRPC(span, err)
+	return err
+}
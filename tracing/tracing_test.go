@@ -0,0 +1,129 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// span is the part of a span written by the file exporter that the test
+// looks at.
+type span struct {
+	Name        string
+	SpanKind    int
+	SpanContext struct{ TraceID, SpanID string }
+	Parent      struct{ TraceID, SpanID string }
+	Attributes  []struct {
+		Key   string
+		Value struct{ Value interface{} }
+	}
+}
+
+// kindNames prefixes the names of RPC spans, which are the same at both
+// ends.  The numbers are trace.SpanKind values.
+var kindNames = map[int]string{2: "server ", 3: "client "}
+
+// TestTrace makes an RPC with tracing at both ends, writing the spans to a
+// file, and checks that they make one trace.
+func TestTrace(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "trace.json")
+	stop, err := Setup(&Options{Exporter: "file", File: file}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server has a span of its own inside the RPC's, like the auth
+	// check.
+	check := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+
+		ctx, span := Start(ctx, "auth check")
+		End(span, nil)
+		return handler(ctx, req)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(UnaryServerInterceptor, check))
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, root := Start(context.Background(), "greet")
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	End(root, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	spans := make(map[string]span) // by kind and name
+	var traceIDs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s span
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			t.Fatalf("%v in %s", err, scanner.Text())
+		}
+		spans[kindNames[s.SpanKind]+s.Name] = s
+		traceIDs = append(traceIDs, s.SpanContext.TraceID)
+	}
+
+	if len(traceIDs) != 4 {
+		t.Fatalf("want 4 spans, got %d", len(traceIDs))
+	}
+	for _, id := range traceIDs {
+		if id != traceIDs[0] {
+			t.Errorf("want one trace, got trace IDs %v", traceIDs)
+			break
+		}
+	}
+	rpc := spans["server grpc.health.v1.Health/Check"]
+	client := spans["client grpc.health.v1.Health/Check"]
+	if len(rpc.Name) == 0 || len(client.Name) == 0 || len(spans["auth check"].Name) == 0 {
+		t.Fatalf("want the client, server and auth check spans, got %v", spans)
+	}
+	if spans["auth check"].Parent.SpanID != rpc.SpanContext.SpanID {
+		t.Error("the auth check span isn't inside the server's RPC span")
+	}
+	if rpc.Parent.SpanID != client.SpanContext.SpanID {
+		t.Error("the server's RPC span isn't inside the client's")
+	}
+	if client.Parent.SpanID != spans["greet"].SpanContext.SpanID {
+		t.Error("the client's RPC span isn't inside the greet span")
+	}
+	found := false
+	for _, a := range rpc.Attributes {
+		if a.Key == "rpc.service" && a.Value.Value == "grpc.health.v1.Health" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("want rpc.service in the attributes, got %v", rpc.Attributes)
+	}
+}